@@ -3,6 +3,9 @@ module gtarfile
 go 1.23.3
 
 require (
+	github.com/dsnet/compress v0.0.1
+	github.com/klauspost/compress v1.17.11
 	github.com/ulikunitz/xz v0.5.12
 	golang.org/x/sys v0.31.0
+	golang.org/x/text v0.23.0
 )
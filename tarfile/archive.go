@@ -0,0 +1,210 @@
+package tarfile
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CreateArchive creates the archive dst compressed with comptype, one of
+// the compression types of Open or "" for none, and adds each of paths
+// recursively, like `tar -cf dst paths...`. opts are applied to the new
+// archive. On failure the partially written archive is removed and the
+// first error is returned.
+func CreateArchive(dst string, comptype string, paths []string, opts ...TarFileOption) (err error) {
+	tf, err := Open(dst, "w:"+comptype, nil, RECORDSIZE, opts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	for _, path := range paths {
+		if err := tf.Add(path, "", true, nil); err != nil {
+			tf.Close()
+			return err
+		}
+	}
+	// Closing writes the end-of-archive blocks and flushes the compressor.
+	return tf.Close()
+}
+
+// ExtractArchive extracts all members of the archive src to destDir, like
+// `tar -xf src -C destDir`. The compression of src is detected. Unless
+// opts set another filter with WithExtractionFilter, members pass through
+// DataFilter, which rejects members that would be written outside
+// destDir and special files.
+func ExtractArchive(src, destDir string, opts ...TarFileOption) error {
+	opts = append([]TarFileOption{WithExtractionFilter(DataFilter)}, opts...)
+	tf, err := Open(src, "r", nil, RECORDSIZE, opts...)
+	if err != nil {
+		return err
+	}
+	defer tf.Close()
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	return tf.ExtractAll(destDir)
+}
+
+// tarExtensions lists the file name extensions of tar archives, longest
+// first.
+var tarExtensions = []string{
+	".tar.gz", ".tar.bz2", ".tar.xz", ".tar.lzma", ".tar.zst",
+	".tgz", ".tbz2", ".txz", ".tzst", ".tar",
+}
+
+// ExtractAllRecursive is like ExtractAll, but regular members that are
+// tar archives themselves, compressed or not, are extracted as well, up
+// to maxDepth levels of nesting; with maxDepth 0 it is like ExtractAll.
+// A nested archive is extracted next to it, into a directory named after
+// it without its extension, like "layer" for "layer.tar.gz", or with
+// ".d" appended if the archive is recognized by its contents only.
+// Nested archives are extracted like ExtractArchive does, through
+// DataFilter and with the limit of WithMaxExtractSize, so they cannot
+// write outside their directory. Only the regular files that extraction
+// wrote, under the names the extraction filter gave them, are looked at,
+// and files that cannot be opened as archives are left alone.
+func (tf *TarFile) ExtractAllRecursive(dest string, maxDepth int) error {
+	written, err := tf.extractAllWritten(dest)
+	if err != nil {
+		return err
+	}
+	tf.mu.RLock()
+	opts := []TarFileOption{WithExtractionFilter(DataFilter), WithMaxExtractSize(tf.maxExtractSize)}
+	tf.mu.RUnlock()
+	return extractNested(written, dest, maxDepth, opts)
+}
+
+// extractAllWritten is ExtractAll, but returns the regular files that
+// were written, as the extraction filter changed them.
+func (tf *TarFile) extractAllWritten(dest string) ([]*TarInfo, error) {
+	var reporter *progressReporter
+	defer func() { reporter.wait() }()
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if err := tf.check("r"); err != nil {
+		return nil, err
+	}
+	if !tf.loaded {
+		if err := tf.load(); err != nil {
+			return nil, err
+		}
+	}
+	reporter = newProgressReporter(tf.progress, regularSize(tf.members))
+	if err := tf.extractMembers(context.Background(), tf.members, dest, reporter); err != nil {
+		return nil, err
+	}
+	return tf.extracted, nil
+}
+
+// extractNested extracts the archives among the regular files written
+// to dest, and the archives within them, down to depth levels.
+func extractNested(written []*TarInfo, dest string, depth int, opts []TarFileOption) error {
+	if depth <= 0 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, m := range written {
+		if seen[m.Name] {
+			continue
+		}
+		seen[m.Name] = true
+		name := filepath.Join(dest, filepath.FromSlash(m.Name))
+		if !isFileWithin(name, dest) {
+			continue
+		}
+		dir, ok := nestedArchiveDir(name)
+		if !ok || !isDirWithin(dir, dest) {
+			continue
+		}
+		nested, err := Open(name, "r", nil, RECORDSIZE, opts...)
+		if err != nil {
+			continue
+		}
+		// Creating dir changes the mtime of its parent, which has been
+		// restored from the archive already.
+		parent, err := os.Stat(filepath.Dir(dir))
+		if err != nil {
+			nested.Close()
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			nested.Close()
+			return err
+		}
+		nestedWritten, err := nested.extractAllWritten(dir)
+		if err != nil {
+			nested.Close()
+			return err
+		}
+		if err := os.Chtimes(filepath.Dir(dir), time.Time{}, parent.ModTime()); err != nil {
+			nested.Close()
+			return err
+		}
+		nested.Close()
+		if err := extractNested(nestedWritten, dir, depth-1, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isFileWithin reports whether name is a regular file, not a symlink,
+// whose real path lies within dir.
+func isFileWithin(name, dir string) bool {
+	fi, err := os.Lstat(name)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	return withinDir(realPath(name), realPath(dir))
+}
+
+// isDirWithin reports whether dir, if it exists, is a directory, not a
+// symlink, whose real path lies within parent.
+func isDirWithin(dir, parent string) bool {
+	fi, err := os.Lstat(dir)
+	if err == nil && !fi.IsDir() {
+		return false
+	}
+	return withinDir(realPath(dir), realPath(parent))
+}
+
+// nestedArchiveDir returns the directory to extract the file name to if
+// it looks like a tar archive, from its extension or, failing that, from
+// the magic number of a compression or of a ustar header.
+func nestedArchiveDir(name string) (string, bool) {
+	lower := strings.ToLower(name)
+	for _, ext := range tarExtensions {
+		if strings.HasSuffix(lower, ext) && len(name) > len(ext) {
+			return name[:len(name)-len(ext)], true
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	buf := make([]byte, BLOCKSIZE)
+	n, _ := io.ReadFull(f, buf)
+	buf = buf[:n]
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(buf, m.magic) {
+			return name + ".d", true
+		}
+	}
+	if n == BLOCKSIZE && bytes.HasPrefix(buf[257:], []byte("ustar")) {
+		return name + ".d", true
+	}
+	return "", false
+}
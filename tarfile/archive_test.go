@@ -0,0 +1,252 @@
+package tarfile
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarBytes returns an uncompressed archive with a member for each name,
+// holding the name as data.
+func tarBytes(t testing.TB, names ...string) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "members.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := addData(tf, name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestExtractAllRecursive(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "outer.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("inner.tar", tarBytes(t, "x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	tf, err = Open(path, "r", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	dest := filepath.Join(dir, "dest")
+	if err := tf.ExtractAllRecursive(dest, 1); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "inner", "x")); err != nil || string(data) != "x" {
+		t.Errorf("nested member = %q, %v", data, err)
+	}
+}
+
+func TestExtractAllRecursiveSkipsFilteredMembers(t *testing.T) {
+	dir := t.TempDir()
+	// An archive outside the destination, reachable through a symlink
+	// that the outer archive plants.
+	host := filepath.Join(dir, "host")
+	if err := os.Mkdir(host, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(host, "evil.tar"), tarBytes(t, "x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "outer.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := NewTarInfo("a")
+	link.Type = SYMTYPE
+	link.Linkname = host
+	if err := tf.AddFile(link, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("a/evil.tar", tarBytes(t, "y"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	skip := func(ti *TarInfo, dest string) (*TarInfo, error) {
+		if ti.Name == "a/evil.tar" {
+			return nil, nil
+		}
+		return ti, nil
+	}
+	tf, err = Open(path, "r", nil, 4096, WithExtractionFilter(skip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	if err := tf.ExtractAllRecursive(filepath.Join(dir, "dest"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(host, "evil")); err == nil {
+		t.Error("archive outside the destination was extracted")
+	}
+}
+
+func TestCreateArchive(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"src/a": "a", "src/sub/b": "b", "other": "other"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	dst := filepath.Join(dir, "out.tar.gz")
+	if err := CreateArchive(dst, "gz", []string{"src", "other"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(data)
+	}
+	want := map[string]string{"src/": "", "src/a": "a", "src/sub/": "", "src/sub/b": "b", "other": "other"}
+	if !maps.Equal(got, want) {
+		t.Errorf("archived %v, want %v", got, want)
+	}
+
+	failed := filepath.Join(dir, "failed.tar.gz")
+	if err := CreateArchive(failed, "gz", []string{"src", "missing"}); err == nil {
+		t.Error("CreateArchive() succeeded with a missing path")
+	}
+	if _, err := os.Stat(failed); err == nil {
+		t.Error("partial archive was left behind")
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	dest := t.TempDir()
+	if err := ExtractArchive(filepath.Join("testdata", "archive.tar.lzma"), dest); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(filepath.Join(dest, "dir")); err != nil || !st.IsDir() {
+		t.Errorf("dir not extracted: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "dir", "hello.txt")); err != nil || string(data) != "hello lzma\n" {
+		t.Errorf("extracted %q, %v", data, err)
+	}
+
+	// The default filter keeps members inside the destination.
+	dir := t.TempDir()
+	path := filepath.Join(dir, "evil.tar.gz")
+	tf, err := Open(path, "w:gz", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("../evil", []byte("evil"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+	dest = filepath.Join(dir, "dest")
+	var outside *OutsideDestinationError
+	if err := ExtractArchive(path, dest); !errors.As(err, &outside) {
+		t.Errorf("ExtractArchive() = %v, want an OutsideDestinationError", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil")); err == nil {
+		t.Error("member outside the destination was extracted")
+	}
+}
+
+func TestExtractAllRecursiveDepth(t *testing.T) {
+	gz := func(data []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	archive := func(name string, data []byte) []byte {
+		path := filepath.Join(t.TempDir(), "archive.tar")
+		tf, err := Open(path, "w", nil, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tf.AddBytes(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		tf.Close()
+		data, err = os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	inner := gz(tarBytes(t, "x"))
+	middle := gz(archive("inner.tar.gz", inner))
+	path := tempFile(t, "outer.tar", archive("middle.tar.gz", middle))
+
+	for depth, want := range map[int]map[string]bool{
+		1: {"middle/inner.tar.gz": true, "middle/inner/x": false},
+		2: {"middle/inner.tar.gz": true, "middle/inner/x": true},
+	} {
+		tf := openArchive(t, path)
+		dest := t.TempDir()
+		if err := tf.ExtractAllRecursive(dest, depth); err != nil {
+			t.Fatal(err)
+		}
+		for name, exists := range want {
+			if _, err := os.Stat(filepath.Join(dest, name)); (err == nil) != exists {
+				t.Errorf("depth %d: %s exists %v, want %v", depth, name, err == nil, exists)
+			}
+		}
+	}
+}
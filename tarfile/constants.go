@@ -8,7 +8,7 @@ const (
 	LENGTH_LINK   = 100 // Max length of linkname
 	LENGTH_PREFIX = 155 // Max length of prefix field
 	GNU_MAGIC     = "ustar  \x00"
-	POSIX_MAGIC   = "ustar\x00\x00"
+	POSIX_MAGIC   = "ustar\x0000"
 
 	REGTYPE          = "0"    // Regular file
 	AREGTYPE         = "\x00" // Regular file (old format)
@@ -22,6 +22,7 @@ const (
 	GNUTYPE_LONGNAME = "L"    // GNU long name
 	GNUTYPE_LONGLINK = "K"    // GNU long link
 	GNUTYPE_SPARSE   = "S"    // GNU sparse file
+	GNUTYPE_DUMPDIR  = "D"    // GNU incremental directory dump
 	XHDTYPE          = "x"    // POSIX.1-2001 extended header
 	XGLTYPE          = "g"    // POSIX.1-2001 global header
 	SOLARIS_XHDTYPE  = "X"    // Solaris extended header
@@ -29,13 +30,18 @@ const (
 	USTAR_FORMAT   = 0 // POSIX.1-1988 (ustar) format
 	GNU_FORMAT     = 1 // GNU tar format
 	PAX_FORMAT     = 2 // POSIX.1-2001 (pax) format
+	V7_FORMAT      = 3 // Unix V7 format, without magic and owner names
 	DEFAULT_FORMAT = PAX_FORMAT
 
+	OverwriteAlways  = 0 // Replace existing files on extraction
+	OverwriteNever   = 1 // Keep existing files on extraction
+	OverwriteIfNewer = 2 // Replace existing files older than the member
+
 	ENCODING = "utf-8" // Default encoding
 )
 
 var (
-	SUPPORTED_TYPES = []string{REGTYPE, AREGTYPE, LNKTYPE, SYMTYPE, DIRTYPE, FIFOTYPE, CONTTYPE, CHRTYPE, BLKTYPE, GNUTYPE_LONGNAME, GNUTYPE_LONGLINK, GNUTYPE_SPARSE}
+	SUPPORTED_TYPES = []string{REGTYPE, AREGTYPE, LNKTYPE, SYMTYPE, DIRTYPE, FIFOTYPE, CONTTYPE, CHRTYPE, BLKTYPE, GNUTYPE_LONGNAME, GNUTYPE_LONGLINK, GNUTYPE_SPARSE, GNUTYPE_DUMPDIR}
 	REGULAR_TYPES   = []string{REGTYPE, AREGTYPE, CONTTYPE, GNUTYPE_SPARSE}
-	GNU_TYPES       = []string{GNUTYPE_LONGNAME, GNUTYPE_LONGLINK, GNUTYPE_SPARSE}
+	GNU_TYPES       = []string{GNUTYPE_LONGNAME, GNUTYPE_LONGLINK, GNUTYPE_SPARSE, GNUTYPE_DUMPDIR}
 )
@@ -1,12 +1,20 @@
 package tarfile
 
+import (
+	"errors"
+	"fmt"
+)
+
+// SkipMember can be returned by the callback of Walk to go on with the
+// next member.
+var SkipMember = errors.New("skip this member")
+
 type TarError struct {
 	msg string
 }
 
 func (e *TarError) Error() string { return e.msg }
 
-type ExtractError struct{ TarError }
 type ReadError struct{ TarError }
 type CompressionError struct{ TarError }
 type StreamError struct{ TarError }
@@ -16,15 +24,47 @@ type TruncatedHeaderError struct{ HeaderError }
 type EOFHeaderError struct{ HeaderError }
 type InvalidHeaderError struct{ HeaderError }
 type SubsequentHeaderError struct{ HeaderError }
+type UnsupportedTypeError struct{ TarError }
+
+// MemberLimitError is returned when an archive has more members than
+// WithMaxMembers allows.
+type MemberLimitError struct{ TarError }
+
+// ExtractError is returned when a member could not be extracted. Err is
+// the underlying error, if any. Errors made by NewExtractError are
+// non-fatal, they only mean that an attribute could not be restored or
+// that a member was left out; the error level decides if they are
+// returned.
+type ExtractError struct {
+	TarError
+	Member string // Name of the member
+	Path   string // Path the member was extracted to
+	Err    error
+	fatal  bool
+}
 
 func NewTarError(msg string) error {
 	return &TarError{msg: msg}
 }
 
 func NewExtractError(msg string) error {
-	return &ExtractError{TarError{msg: msg}}
+	return &ExtractError{TarError: TarError{msg: msg}}
+}
+
+// wrapExtractError returns a non-fatal ExtractError for err.
+func wrapExtractError(msg string, err error) error {
+	return &ExtractError{TarError: TarError{msg: fmt.Sprintf("%s: %v", msg, err)}, Err: err}
 }
 
+func (e *ExtractError) Error() string {
+	if e.Member == "" {
+		return e.msg
+	}
+	return fmt.Sprintf("failed to extract %s: %s", e.Member, e.msg)
+}
+
+func (e *ExtractError) Unwrap() error { return e.Err }
+
 func NewReadError(msg string) error {
 	return &ReadError{TarError{msg: msg}}
 }
@@ -56,3 +96,48 @@ func NewInvalidHeaderError(msg string) error {
 func NewSubsequentHeaderError(msg string) error {
 	return &SubsequentHeaderError{HeaderError{TarError{msg: msg}}}
 }
+
+func NewUnsupportedTypeError(name, kind string) error {
+	return &UnsupportedTypeError{TarError{msg: fmt.Sprintf("%q is a %s, which cannot be archived", name, kind)}}
+}
+
+func NewMemberLimitError(n int) error {
+	return &MemberLimitError{TarError{msg: fmt.Sprintf("archive has more than %d members", n)}}
+}
+
+// isHeaderError reports whether err is one of the header error types.
+func isHeaderError(err error) bool {
+	switch err.(type) {
+	case *HeaderError, *EmptyHeaderError, *TruncatedHeaderError, *EOFHeaderError,
+		*InvalidHeaderError, *SubsequentHeaderError:
+		return true
+	}
+	return false
+}
+
+type FilterError struct{ TarError }
+type AbsolutePathError struct{ FilterError }
+type OutsideDestinationError struct{ FilterError }
+type SpecialFileError struct{ FilterError }
+type AbsoluteLinkError struct{ FilterError }
+type LinkOutsideDestinationError struct{ FilterError }
+
+func NewAbsolutePathError(name string) error {
+	return &AbsolutePathError{FilterError{TarError{msg: fmt.Sprintf("member %q has an absolute path", name)}}}
+}
+
+func NewOutsideDestinationError(name, path string) error {
+	return &OutsideDestinationError{FilterError{TarError{msg: fmt.Sprintf("%q would be extracted to %q, which is outside the destination", name, path)}}}
+}
+
+func NewSpecialFileError(name string) error {
+	return &SpecialFileError{FilterError{TarError{msg: fmt.Sprintf("%q is a special file", name)}}}
+}
+
+func NewAbsoluteLinkError(name string) error {
+	return &AbsoluteLinkError{FilterError{TarError{msg: fmt.Sprintf("%q is a link to an absolute path", name)}}}
+}
+
+func NewLinkOutsideDestinationError(name, path string) error {
+	return &LinkOutsideDestinationError{FilterError{TarError{msg: fmt.Sprintf("%q would link to %q, which is outside the destination", name, path)}}}
+}
@@ -0,0 +1,46 @@
+package tarfile
+
+import "context"
+
+// EstimateArchiveSize returns the size of an uncompressed archive in
+// format that holds the files at paths, added recursively by Add with
+// their paths as names. The headers are created the way Add writes them,
+// including GNU long names and PAX records, so the estimate only differs
+// from the archive if the files change in between. It is meant for
+// progress bars that need the final size up front.
+func EstimateArchiveSize(paths []string, format int) (int64, error) {
+	tf, err := NewTarFile("", "w", discardFile{}, WithFormat(format))
+	if err != nil {
+		return 0, err
+	}
+	defer tf.Close()
+
+	var size int64
+	add := func(ti *TarInfo, name string) error {
+		buf, err := ti.ToBuf(tf.format, tf.encoding, tf.errors)
+		if err != nil {
+			return err
+		}
+		size += int64(len(buf)) + ti.block(ti.dataSize())
+		return nil
+	}
+	for _, name := range paths {
+		if err := tf.addTree(context.Background(), name, "", true, nil, add); err != nil {
+			return 0, err
+		}
+	}
+
+	// Close writes two zero blocks and fills up the last record.
+	size += BLOCKSIZE * 2
+	if _, remainder := divmod(size, RECORDSIZE); remainder > 0 {
+		size += RECORDSIZE - remainder
+	}
+	return size, nil
+}
+
+// discardFile is an io.ReadWriteSeeker that discards all writes.
+type discardFile struct{}
+
+func (discardFile) Read(p []byte) (int, error)                   { return 0, nil }
+func (discardFile) Write(p []byte) (int, error)                  { return len(p), nil }
+func (discardFile) Seek(offset int64, whence int) (int64, error) { return 0, nil }
@@ -0,0 +1,71 @@
+package tarfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEstimateArchiveSize(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "tree")
+	long := filepath.Join(root, strings.Repeat("d", 90), strings.Repeat("f", 60))
+	if err := os.MkdirAll(filepath.Dir(long), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]int{
+		filepath.Join(root, "empty"): 0,
+		filepath.Join(root, "small"): 100,
+		filepath.Join(root, "block"): BLOCKSIZE,
+		long:                         3000,
+	}
+	for name, size := range files {
+		if err := os.WriteFile(name, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("small", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []int{USTAR_FORMAT, GNU_FORMAT, PAX_FORMAT} {
+		paths := []string{root}
+		if format == USTAR_FORMAT {
+			// ustar cannot store the long name.
+			paths = []string{filepath.Join(root, "small"), filepath.Join(root, "block")}
+		}
+		estimate, err := EstimateArchiveSize(paths, format)
+		if err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+
+		path := filepath.Join(t.TempDir(), "a.tar")
+		tf, err := Open(path, "w", nil, 4096, WithFormat(format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range paths {
+			if err := tf.Add(name, "", true, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members, err := openArchive(t, path).GetMembers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if estimate < st.Size() || estimate > st.Size()+int64(len(members))*BLOCKSIZE {
+			t.Errorf("format %d: estimate %d for an archive of %d bytes", format, estimate, st.Size())
+		}
+	}
+
+	if _, err := EstimateArchiveSize([]string{filepath.Join(root, "missing")}, PAX_FORMAT); err == nil {
+		t.Error("EstimateArchiveSize of a missing file succeeded")
+	}
+}
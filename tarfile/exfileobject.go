@@ -1,6 +1,12 @@
 package tarfile
 
-import "io"
+import (
+	"fmt"
+	"io"
+)
+
+// exFileBufSize is the size of the read buffer of an ExFileObject.
+const exFileBufSize = 16 * BLOCKSIZE
 
 // ExFileObject provides a file-like interface to a tar member.
 type ExFileObject struct {
@@ -8,6 +14,10 @@ type ExFileObject struct {
 	ti     *TarInfo
 	offset int64
 	pos    int64
+	closed bool
+
+	buf      []byte // Data of the member read ahead
+	bufStart int64  // Position of buf in the member
 }
 
 // NewExFileObject creates a new ExFileObject.
@@ -20,21 +30,156 @@ func NewExFileObject(tf *TarFile, ti *TarInfo) *ExFileObject {
 	}
 }
 
-// Read reads up to len(p) bytes from the tar member.
+// Read reads up to len(p) bytes from the tar member. Small reads are
+// served from a buffer, so that the archive is not seeked and read for
+// every call. The buffer is filled through ReadAt, which makes reads of
+// several ExFileObjects of the same TarFile safe to interleave.
 func (ef *ExFileObject) Read(p []byte) (int, error) {
+	if ef.closed {
+		return 0, fmt.Errorf("I/O operation on closed file")
+	}
 	if ef.pos >= ef.ti.Size {
 		return 0, io.EOF
 	}
-	if _, err := ef.tf.fileObj.Seek(ef.offset+ef.pos, io.SeekStart); err != nil {
-		return 0, err
+	if ef.pos < ef.bufStart || ef.pos >= ef.bufStart+int64(len(ef.buf)) {
+		if len(p) >= exFileBufSize {
+			n, err := ef.ReadAt(p, ef.pos)
+			ef.pos += int64(n)
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			return n, err
+		}
+		if ef.buf == nil {
+			ef.buf = make([]byte, exFileBufSize)
+		}
+		n, err := ef.ReadAt(ef.buf[:cap(ef.buf)], ef.pos)
+		ef.buf, ef.bufStart = ef.buf[:n], ef.pos
+		if n == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, ef.buf[ef.pos-ef.bufStart:])
+	ef.pos += int64(n)
+	return n, nil
+}
+
+// Seek sets the position for the next Read within the tar member. The
+// resulting position is clamped to the member's size.
+func (ef *ExFileObject) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = ef.pos + offset
+	case io.SeekEnd:
+		pos = ef.ti.Size + offset
+	default:
+		return ef.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return ef.pos, fmt.Errorf("negative seek position %d", pos)
 	}
-	n, err := ef.tf.fileObj.Read(p)
-	if err != nil && err != io.EOF {
+	ef.pos = min(pos, ef.ti.Size)
+	return ef.pos, nil
+}
+
+// ReadAt reads len(p) bytes from the tar member starting at offset off.
+// It does not change the position used by Read and may be called from
+// multiple goroutines.
+func (ef *ExFileObject) ReadAt(p []byte, off int64) (int, error) {
+	if ef.closed {
+		return 0, fmt.Errorf("I/O operation on closed file")
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= ef.ti.Size {
+		return 0, io.EOF
+	}
+	want := p
+	if remaining := ef.ti.Size - off; int64(len(want)) > remaining {
+		want = want[:remaining]
+	}
+
+	ef.tf.mu.Lock()
+	defer ef.tf.mu.Unlock()
+	if cache := ef.tf.readCache; cache != nil {
+		n, err := cache.readAt(ef.tf.fileObj, want, ef.offset+off)
+		if err == nil && n < len(p) {
+			err = io.EOF
+		}
 		return n, err
 	}
-	if int64(n) > ef.ti.Size-ef.pos {
-		n = int(ef.ti.Size - ef.pos)
+	if _, err := ef.tf.fileObj.Seek(ef.offset+off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(ef.tf.fileObj, want)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if err == nil && n < len(p) {
+		err = io.EOF
 	}
-	ef.pos += int64(n)
 	return n, err
 }
+
+// WriteTo writes the data of the member from the current position to the
+// end to w in a single copy from the archive and moves the position to
+// the end. It implements io.WriterTo, so io.Copy uses it instead of Read.
+// The TarFile is locked while w is written to, so w must not use it.
+func (ef *ExFileObject) WriteTo(w io.Writer) (int64, error) {
+	if ef.closed {
+		return 0, fmt.Errorf("I/O operation on closed file")
+	}
+	if ef.pos >= ef.ti.Size {
+		return 0, nil
+	}
+
+	ef.tf.mu.Lock()
+	defer ef.tf.mu.Unlock()
+	if ef.tf.readCache != nil {
+		return ef.writeCachedTo(w)
+	}
+	if _, err := ef.tf.fileObj.Seek(ef.offset+ef.pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.CopyN(w, ef.tf.fileObj, ef.ti.Size-ef.pos)
+	ef.pos += n
+	if err == io.EOF {
+		err = NewReadError("unexpected end of data")
+	}
+	return n, err
+}
+
+// writeCachedTo is WriteTo for a TarFile with a read cache. The TarFile
+// must be locked.
+func (ef *ExFileObject) writeCachedTo(w io.Writer) (int64, error) {
+	var n int64
+	buf := make([]byte, exFileBufSize)
+	for ef.pos < ef.ti.Size {
+		p := buf[:min(int64(len(buf)), ef.ti.Size-ef.pos)]
+		m, err := ef.tf.readCache.readAt(ef.tf.fileObj, p, ef.offset+ef.pos)
+		written, werr := w.Write(p[:m])
+		n += int64(written)
+		ef.pos += int64(written)
+		if werr != nil {
+			return n, werr
+		}
+		if err == io.EOF {
+			return n, NewReadError("unexpected end of data")
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Close closes the ExFileObject. The TarFile itself stays open, and
+// calling Close more than once is harmless.
+func (ef *ExFileObject) Close() error {
+	ef.closed = true
+	return nil
+}
@@ -0,0 +1,257 @@
+package tarfile
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// memberFile writes an archive holding a member "m" with data and
+// returns the ExFileObject of the member.
+func memberFile(t testing.TB, data []byte, opts ...TarFileOption) *ExFileObject {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "m.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addData(tf, "m", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tf = openArchive(t, path, opts...)
+	ti, err := tf.GetMember("m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewExFileObject(tf, ti)
+}
+
+func TestExFileObjectSeek(t *testing.T) {
+	f := memberFile(t, []byte("0123456789"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "0123" {
+		t.Fatalf("Read = %q, %v", buf, err)
+	}
+	if pos, err := f.Seek(-3, io.SeekCurrent); err != nil || pos != 1 {
+		t.Fatalf("Seek(-3, SeekCurrent) = %d, %v", pos, err)
+	}
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "1234" {
+		t.Errorf("Read after seeking back = %q, %v", buf, err)
+	}
+	if pos, err := f.Seek(-2, io.SeekEnd); err != nil || pos != 8 {
+		t.Fatalf("Seek(-2, SeekEnd) = %d, %v", pos, err)
+	}
+	if data, err := io.ReadAll(f); err != nil || string(data) != "89" {
+		t.Errorf("Read at the end = %q, %v", data, err)
+	}
+	if pos, err := f.Seek(100, io.SeekStart); err != nil || pos != 10 {
+		t.Errorf("Seek past the end = %d, %v, want 10", pos, err)
+	}
+	if n, err := f.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("Read past the end = %d, %v", n, err)
+	}
+	if _, err := f.Seek(-11, io.SeekEnd); err == nil {
+		t.Error("Seek to a negative position succeeded")
+	}
+	if pos, _ := f.Seek(0, io.SeekCurrent); pos != 10 {
+		t.Errorf("failed Seek moved the position to %d", pos)
+	}
+}
+
+func TestExFileObjectReadAtZip(t *testing.T) {
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	w, err := zw.Create("inner.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "inside the zip"); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f := memberFile(t, zipped.Bytes())
+	var _ io.ReadCloser = f
+	zr, err := zip.NewReader(f, int64(zipped.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zr.Open("inner.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(r); err != nil || string(data) != "inside the zip" {
+		t.Errorf("inner.txt = %q, %v", data, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Error("ReadAt after Close succeeded")
+	}
+}
+
+func TestExFileObjectReadAtConcurrent(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	f := memberFile(t, data)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			buf := make([]byte, 100)
+			for j := 0; j < 50; j++ {
+				if _, err := f.ReadAt(buf, off); err != nil || !bytes.Equal(buf, data[off:off+100]) {
+					t.Errorf("ReadAt(%d) = %q, %v", off, buf, err)
+					return
+				}
+			}
+		}(int64(i * 1000))
+	}
+	wg.Wait()
+}
+
+func TestExFileObjectInterleaved(t *testing.T) {
+	data := make([]byte, 3*exFileBufSize)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	f := memberFile(t, data)
+	g := NewExFileObject(f.tf, f.ti)
+	var gotF, gotG []byte
+	buf := make([]byte, 1000)
+	for len(gotF) < len(data) || len(gotG) < len(data) {
+		for _, r := range []struct {
+			f   *ExFileObject
+			got *[]byte
+		}{{f, &gotF}, {g, &gotG}} {
+			n, err := r.f.Read(buf)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			*r.got = append(*r.got, buf[:n]...)
+		}
+	}
+	if !bytes.Equal(gotF, data) || !bytes.Equal(gotG, data) {
+		t.Error("interleaved reads returned wrong data")
+	}
+}
+
+func BenchmarkExFileObjectRead(b *testing.B) {
+	f := memberFile(b, make([]byte, 16<<20))
+	buf := make([]byte, 4096)
+	b.SetBytes(16 << 20)
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		for {
+			if _, err := f.Read(buf); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestExFileObjectWriteTo(t *testing.T) {
+	f := memberFile(t, []byte("0123456789"))
+	if _, err := f.Seek(3, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if n, err := f.WriteTo(&buf); err != nil || n != 7 || buf.String() != "3456789" {
+		t.Errorf("WriteTo() = %d, %v, wrote %q", n, err, buf.String())
+	}
+	if pos, _ := f.Seek(0, io.SeekCurrent); pos != 10 {
+		t.Errorf("position %d after WriteTo, want 10", pos)
+	}
+}
+
+func BenchmarkExFileObjectCopy(b *testing.B) {
+	const size = 100 << 20
+	f := memberFile(b, make([]byte, size))
+	for _, bench := range []struct {
+		name string
+		src  func() io.Reader
+	}{
+		{"WriterTo", func() io.Reader { return f }},
+		{"Read", func() io.Reader { return struct{ io.Reader }{f} }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, bench.src()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestExFileObjectReadCache(t *testing.T) {
+	names := make([]string, 100)
+	for i := range names {
+		names[i] = fmt.Sprintf("file%03d", i)
+	}
+	tf := openArchive(t, tempFile(t, "many.tar", tarBytes(t, names...)), WithReadCache(16))
+	members, err := tf.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read twice in an order that evicts blocks from the cache.
+	for round := 0; round < 2; round++ {
+		for i := range members {
+			ti := members[(i*37)%len(members)]
+			if data, err := io.ReadAll(NewExFileObject(tf, ti)); err != nil || string(data) != ti.Name {
+				t.Errorf("round %d: %s = %q, %v", round, ti.Name, data, err)
+			}
+		}
+	}
+}
+
+func BenchmarkExFileObjectReadCache(b *testing.B) {
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("dir/file%04d", i)
+	}
+	path := tempFile(b, "many.tar", tarBytes(b, names...))
+	for _, bench := range []struct {
+		name string
+		opts []TarFileOption
+	}{
+		{"NoCache", nil},
+		{"Cache", []TarFileOption{WithReadCache(2 * len(names))}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			tf := openArchive(b, path, bench.opts...)
+			members, err := tf.GetMembers()
+			if err != nil {
+				b.Fatal(err)
+			}
+			buf := make([]byte, 64)
+			for i := 0; i < b.N; i++ {
+				for range 2 {
+					for _, ti := range members {
+						if _, err := NewExFileObject(tf, ti).ReadAt(buf[:ti.Size], 0); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package tarfile
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// DataFilter is an extraction filter for archives of plain data. It
+// mirrors Python's tarfile.data_filter and can be installed with
+// WithExtractionFilter(DataFilter).
+//
+// It rejects members with absolute paths, members that would be
+// extracted outside dest, links whose target is absolute or resolves
+// outside dest, and special files such as devices and FIFOs. Group and
+// other write permissions are cleared from regular files and hard links.
+func DataFilter(ti *TarInfo, dest string) (*TarInfo, error) {
+	ti = ti.clone()
+	name := ti.Name
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return nil, NewAbsolutePathError(ti.Name)
+	}
+
+	destPath := realPath(dest)
+	targetPath := realPath(filepath.Join(destPath, name))
+	if !withinDir(targetPath, destPath) {
+		return nil, NewOutsideDestinationError(ti.Name, targetPath)
+	}
+
+	switch {
+	case ti.IsReg() || ti.IsLnk():
+		mode := ti.Mode & 0755
+		if mode&0100 == 0 {
+			// Clear executable bits if not executable by user.
+			mode &^= 0111
+		}
+		// Ensure owner can read and write.
+		ti.Mode = mode | 0600
+	case ti.IsDir() || ti.IsSym():
+	default:
+		return nil, NewSpecialFileError(ti.Name)
+	}
+
+	if ti.IsLnk() || ti.IsSym() {
+		if filepath.IsAbs(ti.Linkname) || strings.HasPrefix(ti.Linkname, "/") {
+			return nil, NewAbsoluteLinkError(ti.Name)
+		}
+		if ti.IsSym() {
+			targetPath = filepath.Join(destPath, filepath.Dir(name), ti.Linkname)
+		} else {
+			targetPath = filepath.Join(destPath, ti.Linkname)
+		}
+		targetPath = realPath(targetPath)
+		if !withinDir(targetPath, destPath) {
+			return nil, NewLinkOutsideDestinationError(ti.Name, targetPath)
+		}
+	}
+	return ti, nil
+}
+
+// realPath returns the absolute form of path with the symlinks of its
+// longest existing prefix resolved.
+func realPath(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path
+	}
+	return filepath.Join(realPath(parent), filepath.Base(path))
+}
+
+// withinDir reports whether path is dir or lies below it.
+func withinDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
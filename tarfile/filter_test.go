@@ -0,0 +1,89 @@
+package tarfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDataFilter(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "evil.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"../evil", "/abs", "ok"} {
+		if err := addData(tf, name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{"abslink": "/etc", "up": "../..", "dot": "."} {
+		link := NewTarInfo(name)
+		link.Type = SYMTYPE
+		link.Linkname = target
+		if err := tf.AddFile(link, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hard := NewTarInfo("hard")
+	hard.Type = LNKTYPE
+	hard.Linkname = "../evil.tar"
+	fifo := NewTarInfo("fifo")
+	fifo.Type = FIFOTYPE
+	for _, ti := range []*TarInfo{hard, fifo} {
+		if err := tf.AddFile(ti, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tf.Close()
+
+	dest := filepath.Join(dir, "dest")
+	tf = openArchive(t, path, WithExtractionFilter(DataFilter))
+	members, err := tf.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]func(error) bool{
+		"../evil": errorAs[*OutsideDestinationError],
+		"/abs":    errorAs[*AbsolutePathError],
+		"abslink": errorAs[*AbsoluteLinkError],
+		"up":      errorAs[*LinkOutsideDestinationError],
+		"hard":    errorAs[*LinkOutsideDestinationError],
+		"fifo":    errorAs[*SpecialFileError],
+	}
+	for _, m := range members {
+		err := tf.Extract(m, dest)
+		if check := want[m.Name]; check == nil && err != nil {
+			t.Errorf("extracting %q: %v", m.Name, err)
+		} else if check != nil && !check(err) {
+			t.Errorf("extracting %q returned %v", m.Name, err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("extraction wrote outside the destination: %v", entries)
+	}
+	entries, err = os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 2 || names[0] != "dot" || names[1] != "ok" {
+		t.Errorf("extracted %v, want [dot ok]", names)
+	}
+}
+
+// errorAs reports whether err has an error of type T in its chain.
+func errorAs[T error](err error) bool {
+	var target T
+	return errors.As(err, &target)
+}
@@ -0,0 +1,254 @@
+package tarfile
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FS returns a read-only fs.FS view of the archive. The returned file
+// system also implements fs.ReadDirFS and fs.StatFS. Directories that are
+// implied by member names but have no member of their own are listed
+// as well. The members are loaded on first use.
+func (tf *TarFile) FS() fs.FS {
+	return &tarFS{tf: tf}
+}
+
+// tarFS implements fs.FS over the members of a TarFile.
+type tarFS struct {
+	tf *TarFile
+
+	once    sync.Once
+	err     error
+	entries map[string]*TarInfo            // Members by cleaned name
+	dirs    map[string]map[string]struct{} // Child names by directory
+}
+
+func (fsys *tarFS) load() error {
+	fsys.once.Do(func() {
+		members, err := fsys.tf.GetMembers()
+		if err != nil {
+			fsys.err = err
+			return
+		}
+		fsys.entries = map[string]*TarInfo{".": syntheticDir(".")}
+		fsys.dirs = map[string]map[string]struct{}{".": {}}
+		for _, m := range members {
+			name := path.Clean(strings.TrimLeft(m.Name, "/"))
+			if name == "." || !fs.ValidPath(name) {
+				continue
+			}
+			fsys.entries[name] = m
+			if m.IsDir() && fsys.dirs[name] == nil {
+				fsys.dirs[name] = map[string]struct{}{}
+			}
+			// Make sure every parent directory exists and lists its child.
+			for child, dir := name, path.Dir(name); ; child, dir = dir, path.Dir(dir) {
+				if fsys.dirs[dir] == nil {
+					fsys.dirs[dir] = map[string]struct{}{}
+				}
+				fsys.dirs[dir][path.Base(child)] = struct{}{}
+				if _, ok := fsys.entries[dir]; !ok {
+					fsys.entries[dir] = syntheticDir(dir)
+				}
+				if dir == "." {
+					break
+				}
+			}
+		}
+	})
+	return fsys.err
+}
+
+// lookup returns the member for name, or a *fs.PathError for op.
+func (fsys *tarFS) lookup(op, name string) (*TarInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if err := fsys.load(); err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	ti, ok := fsys.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return ti, nil
+}
+
+// Open implements fs.FS.
+func (fsys *tarFS) Open(name string) (fs.File, error) {
+	ti, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	info := &tarFileInfo{name: path.Base(name), ti: ti}
+	if ti.IsDir() {
+		return &tarFSDir{fsys: fsys, name: name, info: info}, nil
+	}
+	f := &tarFSFile{info: info}
+	if ti.IsReg() {
+		f.ef = fsys.tf.fileObject(fsys.tf, ti)
+	}
+	return f, nil
+}
+
+// Stat implements fs.StatFS.
+func (fsys *tarFS) Stat(name string) (fs.FileInfo, error) {
+	ti, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return &tarFileInfo{name: path.Base(name), ti: ti}, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (fsys *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	ti, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !ti.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return fsys.readDir(name), nil
+}
+
+// readDir returns the entries of the directory name sorted by name.
+func (fsys *tarFS) readDir(name string) []fs.DirEntry {
+	children := make([]string, 0, len(fsys.dirs[name]))
+	for child := range fsys.dirs[name] {
+		children = append(children, child)
+	}
+	sort.Strings(children)
+	entries := make([]fs.DirEntry, len(children))
+	for i, child := range children {
+		ti := fsys.entries[path.Join(name, child)]
+		entries[i] = fs.FileInfoToDirEntry(&tarFileInfo{name: child, ti: ti})
+	}
+	return entries
+}
+
+// tarFSFile is an open non-directory member. ExFileObject reads go
+// through ReadAt, so files opened from the same archive can be read
+// concurrently.
+type tarFSFile struct {
+	info *tarFileInfo
+	ef   *ExFileObject // nil for members without data
+}
+
+func (f *tarFSFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *tarFSFile) Read(p []byte) (int, error) {
+	if f.ef == nil {
+		return 0, io.EOF
+	}
+	return f.ef.Read(p)
+}
+
+func (f *tarFSFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.ef == nil {
+		return 0, io.EOF
+	}
+	return f.ef.ReadAt(p, off)
+}
+
+func (f *tarFSFile) Seek(offset int64, whence int) (int64, error) {
+	if f.ef == nil {
+		return 0, nil
+	}
+	return f.ef.Seek(offset, whence)
+}
+
+func (f *tarFSFile) Close() error {
+	if f.ef != nil {
+		return f.ef.Close()
+	}
+	return nil
+}
+
+// tarFSDir is an open directory.
+type tarFSDir struct {
+	fsys    *tarFS
+	name    string
+	info    *tarFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *tarFSDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *tarFSDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *tarFSDir) Close() error { return nil }
+
+func (d *tarFSDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		d.entries = d.fsys.readDir(d.name)
+	}
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(remaining))
+	d.offset += n
+	return remaining[:n], nil
+}
+
+// tarFileInfo implements fs.FileInfo for a member.
+type tarFileInfo struct {
+	name string
+	ti   *TarInfo
+}
+
+func (fi *tarFileInfo) Name() string       { return fi.name }
+func (fi *tarFileInfo) Size() int64        { return fi.ti.Size }
+func (fi *tarFileInfo) Mode() fs.FileMode  { return fileMode(fi.ti) }
+func (fi *tarFileInfo) ModTime() time.Time { return fi.ti.Mtime }
+func (fi *tarFileInfo) IsDir() bool        { return fi.ti.IsDir() }
+func (fi *tarFileInfo) Sys() interface{}   { return fi.ti }
+
+// fileMode maps the mode bits and type of a member to an fs.FileMode.
+func fileMode(ti *TarInfo) fs.FileMode {
+	mode := fs.FileMode(ti.Mode & 0777)
+	if ti.Mode&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if ti.Mode&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if ti.Mode&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	switch {
+	case ti.IsDir():
+		mode |= fs.ModeDir
+	case ti.IsSym():
+		mode |= fs.ModeSymlink
+	case ti.IsChr():
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case ti.IsBlk():
+		mode |= fs.ModeDevice
+	case ti.IsFifo():
+		mode |= fs.ModeNamedPipe
+	}
+	return mode
+}
+
+// syntheticDir returns a TarInfo for a directory that has no member of
+// its own in the archive.
+func syntheticDir(name string) *TarInfo {
+	ti := NewTarInfo(name)
+	ti.Type = DIRTYPE
+	ti.Mode = 0755
+	return ti
+}
@@ -0,0 +1,62 @@
+package tarfile
+
+import (
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestFS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fs.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1700000000, 0)
+	for _, name := range []string{"top.txt", "a/b/nested.txt", "a/c.txt"} {
+		ti := NewTarInfo(name)
+		ti.Size = int64(len(name))
+		ti.Mode = 0640
+		ti.Mtime = mtime
+		if err := tf.AddFile(ti, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tf.Close()
+
+	fsys := openArchive(t, path).FS()
+	if err := fstest.TestFS(fsys, "top.txt", "a/b/nested.txt", "a/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	var walked []string
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		walked = append(walked, name)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".", "a", "a/b", "a/b/nested.txt", "a/c.txt", "top.txt"}
+	if !slices.Equal(walked, want) {
+		t.Errorf("WalkDir visited %v, want %v", walked, want)
+	}
+
+	if data, err := fs.ReadFile(fsys, "a/b/nested.txt"); err != nil || string(data) != "a/b/nested.txt" {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+	fi, err := fs.Stat(fsys, "a/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 7 || fi.Mode() != 0640 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("Stat = size %d, mode %v, mtime %v", fi.Size(), fi.Mode(), fi.ModTime())
+	}
+	if fi, err := fs.Stat(fsys, "a/b"); err != nil || !fi.IsDir() {
+		t.Errorf("implicit directory: %v, %v", fi, err)
+	}
+}
@@ -0,0 +1,154 @@
+package tarfile
+
+import (
+	"io"
+	"sync"
+)
+
+// progressEvent is a report for the callback set with WithProgress.
+type progressEvent struct {
+	ti          *TarInfo
+	done, total int64
+	final       bool // The member is complete
+}
+
+// progressReporter passes the progress of an operation to the callback
+// set with WithProgress. The callback is called on a goroutine of its own,
+// so it never runs while the TarFile is locked and may use its methods.
+// Reports on the data of a member that the callback has not received yet
+// are merged, so a slow callback does not hold up the operation. A nil
+// *progressReporter reports nothing.
+type progressReporter struct {
+	fn func(ti *TarInfo, bytesDone, bytesTotal int64)
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []progressEvent
+	total  int64
+	done   int64
+	seen   map[*TarInfo]int64 // Bytes of data reported per member
+	closed bool
+	exited chan struct{}
+}
+
+// newProgressReporter starts reporting to fn for an operation on total
+// bytes of data. It returns nil if fn is nil.
+func newProgressReporter(fn func(*TarInfo, int64, int64), total int64) *progressReporter {
+	if fn == nil {
+		return nil
+	}
+	p := &progressReporter{
+		fn:     fn,
+		total:  total,
+		seen:   make(map[*TarInfo]int64),
+		exited: make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	go p.run()
+	return p
+}
+
+func (p *progressReporter) run() {
+	defer close(p.exited)
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		ev := p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+		p.fn(ev.ti, ev.done, ev.total)
+	}
+}
+
+// push queues ev, replacing a queued data report of the same member.
+// p.mu must be held.
+func (p *progressReporter) push(ev progressEvent) {
+	if n := len(p.queue); n > 0 && !ev.final {
+		if last := p.queue[n-1]; last.ti == ev.ti && !last.final {
+			p.queue[n-1] = ev
+			return
+		}
+	}
+	p.queue = append(p.queue, ev)
+	p.cond.Signal()
+}
+
+// add reports n more bytes of the data of ti.
+func (p *progressReporter) add(ti *TarInfo, n int64) {
+	if p == nil || n == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	p.seen[ti] += n
+	p.push(progressEvent{ti: ti, done: p.done, total: p.total})
+}
+
+// complete reports that ti is done. Data of a regular file that was not
+// read, such as the holes of sparse files, counts as done as well.
+func (p *progressReporter) complete(ti *TarInfo) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ti.IsReg() {
+		p.done += max(ti.Size-p.seen[ti], 0)
+	}
+	delete(p.seen, ti)
+	p.push(progressEvent{ti: ti, done: p.done, total: p.total, final: true})
+}
+
+// reader returns a reader that reports the data read from r as data of
+// ti.
+func (p *progressReporter) reader(ti *TarInfo, r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p, ti: ti}
+}
+
+// wait stops the reporting and waits until the callback has received
+// every report. It must not be called while tf.mu is held, since the
+// callback may need it.
+func (p *progressReporter) wait() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Signal()
+	p.mu.Unlock()
+	<-p.exited
+}
+
+// progressReader reports the bytes read through it to a progressReporter.
+type progressReader struct {
+	r  io.Reader
+	p  *progressReporter
+	ti *TarInfo
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.p.add(pr.ti, int64(n))
+	return n, err
+}
+
+// regularSize returns the size of the regular files among members.
+func regularSize(members []*TarInfo) int64 {
+	var total int64
+	for _, ti := range members {
+		if ti.IsReg() {
+			total += ti.Size
+		}
+	}
+	return total
+}
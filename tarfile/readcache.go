@@ -0,0 +1,88 @@
+package tarfile
+
+import (
+	"container/list"
+	"io"
+)
+
+// blockCache is an LRU cache of the blocks of an archive being read,
+// keyed by their offset in the archive. Archives opened for reading do
+// not change, so cached blocks never become stale. It is not safe for
+// concurrent use and is protected by the lock of its TarFile.
+type blockCache struct {
+	max    int
+	lru    *list.List              // Cached blocks, most recently used first
+	blocks map[int64]*list.Element // Elements of lru by block offset
+}
+
+// cachedBlock is a block of a blockCache.
+type cachedBlock struct {
+	off  int64
+	data []byte // Shorter than BLOCKSIZE at the end of the archive
+}
+
+// newBlockCache creates a blockCache holding up to max blocks.
+func newBlockCache(max int) *blockCache {
+	return &blockCache{
+		max:    max,
+		lru:    list.New(),
+		blocks: make(map[int64]*list.Element),
+	}
+}
+
+// readAt reads len(p) bytes at offset off of r into p, taking cached
+// blocks from the cache. Missing blocks are read from r in runs of up to
+// max blocks and added to the cache. It returns io.EOF if r ends before
+// p is filled.
+func (c *blockCache) readAt(r io.ReadSeeker, p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		start := pos - pos%BLOCKSIZE
+		if e, ok := c.blocks[start]; ok {
+			c.lru.MoveToFront(e)
+			data := e.Value.(*cachedBlock).data
+			if pos-start >= int64(len(data)) {
+				return n, io.EOF
+			}
+			n += copy(p[n:], data[pos-start:])
+			continue
+		}
+
+		// Read the blocks up to the next cached one at once.
+		stop := start + BLOCKSIZE
+		for stop < end && stop-start < int64(c.max)*BLOCKSIZE && c.blocks[stop] == nil {
+			stop += BLOCKSIZE
+		}
+		if _, err := r.Seek(start, io.SeekStart); err != nil {
+			return n, err
+		}
+		buf := make([]byte, stop-start)
+		m, err := io.ReadFull(r, buf)
+		for i := 0; i < m; i += BLOCKSIZE {
+			c.add(start+int64(i), buf[i:min(i+BLOCKSIZE, m)])
+		}
+		if skip := int(pos - start); skip < m {
+			n += copy(p[n:], buf[skip:m])
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if err != nil && n < len(p) {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// add adds the block at offset off to the cache, evicting the least
+// recently used block if the cache is full.
+func (c *blockCache) add(off int64, data []byte) {
+	if c.lru.Len() >= c.max {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.blocks, e.Value.(*cachedBlock).off)
+	}
+	c.blocks[off] = c.lru.PushFront(&cachedBlock{off: off, data: data})
+}
@@ -0,0 +1,60 @@
+package tarfile
+
+import "io"
+
+// RepackExcluding copies every member of src for which exclude returns
+// false to dst, in archive order and with their data. src must be open
+// for reading and dst for writing; members are rewritten in the format of
+// dst as CopyMemberFrom does.
+func RepackExcluding(src, dst *TarFile, exclude func(*TarInfo) bool) error {
+	return RepackReplacing(src, dst, func(ti *TarInfo) (io.Reader, int64, bool, error) {
+		if exclude(ti) {
+			return nil, 0, false, nil
+		}
+		return nil, 0, true, nil
+	})
+}
+
+// RepackReplacing copies the members of src to dst in archive order and
+// lets replace change their data. For each member replace returns a
+// reader of size bytes that is written instead of the member's data, or
+// a nil reader to copy the member as it is; keep false leaves the member
+// out. Members with new data are stored as regular files.
+func RepackReplacing(src, dst *TarFile, replace func(*TarInfo) (r io.Reader, size int64, keep bool, err error)) error {
+	if err := src.check("r"); err != nil {
+		return err
+	}
+	if err := dst.check("awx"); err != nil {
+		return err
+	}
+	for index := 0; ; index++ {
+		member, err := src.memberAt(index)
+		if err != nil {
+			return err
+		}
+		if member == nil {
+			return nil
+		}
+		r, size, keep, err := replace(member)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
+		if r == nil {
+			if err := dst.CopyMemberFrom(src, member); err != nil {
+				return err
+			}
+			continue
+		}
+
+		ti := copyTarInfo(member)
+		ti.Type = REGTYPE
+		ti.Linkname = ""
+		ti.Size = size
+		if err := dst.AddFile(ti, r); err != nil {
+			return err
+		}
+	}
+}
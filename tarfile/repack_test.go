@@ -0,0 +1,70 @@
+package tarfile
+
+import (
+	"io"
+	"maps"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// memberData returns the data of the regular members of the archive
+// at path by name, along with the names in archive order.
+func memberData(t *testing.T, path string) (map[string]string, []string) {
+	t.Helper()
+	tf := openArchive(t, path)
+	data := map[string]string{}
+	var names []string
+	for ti := range tf.Members {
+		b, err := io.ReadAll(NewExFileObject(tf, ti))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[ti.Name] = string(b)
+		names = append(names, ti.Name)
+	}
+	return data, names
+}
+
+func TestRepackExcluding(t *testing.T) {
+	src := openArchive(t, tempFile(t, "src.tar", tarBytes(t, "a", "b", "c")))
+	path := filepath.Join(t.TempDir(), "out.tar")
+	dst, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RepackExcluding(src, dst, func(ti *TarInfo) bool { return ti.Name == "b" }); err != nil {
+		t.Fatal(err)
+	}
+	dst.Close()
+	data, names := memberData(t, path)
+	if want := map[string]string{"a": "a", "c": "c"}; !maps.Equal(data, want) || strings.Join(names, " ") != "a c" {
+		t.Errorf("repacked %v in order %v", data, names)
+	}
+}
+
+func TestRepackReplacing(t *testing.T) {
+	src := openArchive(t, tempFile(t, "src.tar", tarBytes(t, "a", "b", "c")))
+	path := filepath.Join(t.TempDir(), "out.tar")
+	dst, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RepackReplacing(src, dst, func(ti *TarInfo) (io.Reader, int64, bool, error) {
+		switch ti.Name {
+		case "b":
+			return strings.NewReader("replaced"), 8, true, nil
+		case "c":
+			return nil, 0, false, nil
+		}
+		return nil, 0, true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.Close()
+	data, names := memberData(t, path)
+	if want := map[string]string{"a": "a", "b": "replaced"}; !maps.Equal(data, want) || strings.Join(names, " ") != "a b" {
+		t.Errorf("repacked %v in order %v", data, names)
+	}
+}
@@ -1,15 +1,252 @@
 package tarfile
 
 import (
+	"bufio"
+	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
 	"fmt"
 	"io"
+	"math"
 	"os"
 
+	bzip2w "github.com/dsnet/compress/bzip2" // the stdlib bzip2 package only decompresses
+	"github.com/klauspost/compress/zstd"
 	"github.com/ulikunitz/xz" // 引入第三方 xz 包
+	"github.com/ulikunitz/xz/lzma"
 )
 
+// decompressors maps each compression type to the function that wraps a
+// reader of compressed data.
+var decompressors = map[string]func(io.Reader) (io.Reader, error){
+	"gz":   newGzipReader,
+	"bz2":  func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil },
+	"xz":   func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) },
+	"lzma": func(r io.Reader) (io.Reader, error) { return lzma.NewReader(r) },
+	"zst":  newZstdReader,
+	"zstd": newZstdReader,
+}
+
+// compressionMagics lists the magic numbers that start each kind of
+// compressed data.
+var compressionMagics = []struct {
+	magic    []byte
+	comptype string
+}{
+	{[]byte{0x1f, 0x8b}, "gz"},
+	{[]byte{0x42, 0x5a, 0x68}, "bz2"},
+	{[]byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}, "xz"},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, "zst"},
+}
+
+// DetectCompression peeks at the first bytes of fileobj and returns the
+// comptype they belong to, or "tar" if no compression magic is found. The
+// returned reader yields the complete data including the peeked bytes.
+func DetectCompression(fileobj io.Reader) (string, io.Reader, error) {
+	br := bufio.NewReader(fileobj)
+	buf, err := br.Peek(lzma.HeaderLen)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(buf, m.magic) {
+			return m.comptype, br, nil
+		}
+	}
+	// The LZMA-alone format has no magic number, only a header whose
+	// properties and dictionary size can be checked.
+	if len(buf) == lzma.HeaderLen && lzma.ValidHeader(buf) {
+		return "lzma", br, nil
+	}
+	return "tar", br, nil
+}
+
+// newGzipReader reads all gzip members of r one after the other, as
+// archives may consist of several concatenated members, for example after
+// appending to them.
+func newGzipReader(r io.Reader) (io.Reader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(true)
+	return zr, nil
+}
+
+// compressors maps each compression type to the function that wraps a
+// writer with a compressor of the given level.
+var compressors = map[string]func(w io.Writer, level int) (io.WriteCloser, error){
+	"gz":   func(w io.Writer, level int) (io.WriteCloser, error) { return gzip.NewWriterLevel(w, level) },
+	"bz2":  newBzip2Writer,
+	"xz":   newXzWriter,
+	"lzma": newLzmaWriter,
+	"zst":  newZstdWriter,
+	"zstd": newZstdWriter,
+}
+
+func newZstdReader(r io.Reader) (io.Reader, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return zr.IOReadCloser(), nil
+}
+
+// appendables lists the compression types whose archives can be appended
+// to, with the function that scans one of their compressed streams. Both
+// gzip and xz allow compressed streams to be concatenated, so only the last
+// stream, which holds the end-of-archive blocks, is compressed again and
+// new members are added to it.
+var appendables = map[string]func(cr *countingReader) (size int64, more bool, err error){
+	"gz": scanGzipMember,
+	"xz": scanXzStream,
+}
+
+// defaultCompressLevel selects the default level of a compressor.
+const defaultCompressLevel = math.MinInt
+
+// compressLevels lists the range of levels each compressor accepts, like
+// their command line tools, and the level used by default.
+var compressLevels = map[string]struct{ min, max, def int }{
+	"gz":   {0, 9, 9},
+	"bz2":  {1, 9, 9},
+	"xz":   {0, 9, 6},
+	"lzma": {0, 9, 6},
+	"zst":  {1, 22, 9},
+	"zstd": {1, 22, 9},
+}
+
+// checkCompressLevel validates level for comptype and replaces
+// defaultCompressLevel with the compressor's default. For gzip it also
+// accepts gzip.DefaultCompression.
+func checkCompressLevel(comptype string, level int) (int, error) {
+	levels, ok := compressLevels[comptype]
+	if !ok {
+		return level, nil
+	}
+	if level == defaultCompressLevel {
+		return levels.def, nil
+	}
+	if comptype == "gz" && level == gzip.DefaultCompression {
+		return level, nil
+	}
+	if level < levels.min || level > levels.max {
+		return 0, NewCompressionError(fmt.Sprintf("invalid %s compression level %d, must be between %d and %d", comptype, level, levels.min, levels.max))
+	}
+	return level, nil
+}
+
+// xzDictCaps holds the dictionary sizes of the xz presets 0 to 9, which
+// is what the levels of xz differ in.
+var xzDictCaps = [10]int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// newXzWriter creates an xz compressor with the dictionary size of the
+// xz preset level.
+func newXzWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return xz.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(w)
+}
+
+// newBzip2Writer creates a bzip2 compressor, which the standard library
+// lacks.
+func newBzip2Writer(w io.Writer, level int) (io.WriteCloser, error) {
+	return bzip2w.NewWriter(w, &bzip2w.WriterConfig{Level: level})
+}
+
+// newLzmaWriter creates an LZMA-alone compressor. The presets of lzma are
+// those of xz.
+func newLzmaWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return lzma.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(w)
+}
+
+// newZstdWriter creates a zstd compressor with the encoder level closest
+// to the zstd command line level.
+func newZstdWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+}
+
+// countingReader counts the bytes a decompressor takes from a buffered
+// source, which tells where in the source a compressed stream ends.
+type countingReader struct {
+	r    *bufio.Reader
+	n    int64
+	last byte // The last byte read
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if n > 0 {
+		cr.n += int64(n)
+		cr.last = p[n-1]
+	}
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	c, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+		cr.last = c
+	}
+	return c, err
+}
+
+// scanGzipMember decompresses one gzip member. Outside multistream mode a
+// gzip.Reader stops right after the member's trailer.
+func scanGzipMember(cr *countingReader) (int64, bool, error) {
+	zr, err := gzip.NewReader(cr)
+	if err != nil {
+		return 0, false, err
+	}
+	zr.Multistream(false)
+	size, err := io.Copy(io.Discard, zr)
+	if err != nil {
+		return size, false, err
+	}
+	_, err = cr.r.Peek(1)
+	return size, err == nil, nil
+}
+
+// scanXzStream decompresses one xz stream. A single stream xz.Reader reads
+// one byte past the stream to make sure nothing follows and fails if
+// something does; if that byte starts another stream it is given back.
+func scanXzStream(cr *countingReader) (int64, bool, error) {
+	zr, err := xz.ReaderConfig{SingleStream: true}.NewReader(cr)
+	if err != nil {
+		return 0, false, err
+	}
+	size, err := io.Copy(io.Discard, zr)
+	if err == nil {
+		return size, false, nil
+	}
+	if cr.last != 0xfd { // First byte of the xz magic
+		return size, false, err
+	}
+	cr.n--
+	return size, true, nil
+}
+
+// lastStream returns where the last of the concatenated compressed streams
+// in f starts, both in f and in the decompressed data. Scanning starts at
+// the current position of f.
+func lastStream(f io.ReadSeeker, scan func(*countingReader) (int64, bool, error)) (start, dataStart int64, err error) {
+	start = tell(f)
+	for {
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			return 0, 0, err
+		}
+		cr := &countingReader{r: bufio.NewReader(f)}
+		size, more, err := scan(cr)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !more {
+			return start, dataStart, nil
+		}
+		start += cr.n
+		dataStart += size
+	}
+}
+
 // Stream represents a stream of tar blocks.
 type Stream struct {
 	file io.ReadWriteCloser
@@ -17,99 +254,54 @@ type Stream struct {
 
 // newStream creates a new Stream for tar block streaming.
 func newStream(name, mode, comptype string, fileobj io.ReadWriteSeeker, bufsize, compresslevel int) (*Stream, error) {
-	var f io.ReadWriteCloser
-	if fileobj != nil {
-		switch comptype {
-		case "tar":
-			f = &fileWrapper{rws: fileobj}
-		case "gz":
-			if mode == "r" {
-				gz, err := gzip.NewReader(fileobj)
-				if err != nil {
-					return nil, err
-				}
-				f = &readWriteCloser{r: gz, w: fileobj}
-			} else { // 写模式
-				gz, err := gzip.NewWriterLevel(fileobj, compresslevel)
-				if err != nil {
-					return nil, err
-				}
-				f = &writeCloser{w: gz, c: wrapCloser(fileobj)}
-			}
-		case "bz2":
-			if mode == "r" {
-				f = &readWriteCloser{r: bzip2.NewReader(fileobj), w: fileobj}
-			} else {
-				return nil, NewCompressionError("bz2 streaming write not implemented in stdlib")
-			}
-		case "xz":
-			if mode == "r" {
-				xzReader, err := xz.NewReader(fileobj)
-				if err != nil {
-					return nil, err
-				}
-				f = &readWriteCloser{r: xzReader, w: fileobj}
-			} else {
-				xzWriter, err := xz.NewWriter(fileobj)
-				if err != nil {
-					return nil, err
-				}
-				f = &writeCloser{w: xzWriter, c: wrapCloser(fileobj)}
-			}
-		default:
-			return nil, NewCompressionError("unknown compression type " + comptype)
+	decompress, ok := decompressors[comptype]
+	if !ok && comptype != "tar" {
+		return nil, NewCompressionError("unknown compression type " + comptype)
+	}
+	if mode != "r" {
+		level, err := checkCompressLevel(comptype, compresslevel)
+		if err != nil {
+			return nil, err
 		}
+		compresslevel = level
+	}
+
+	var file io.ReadWriteCloser
+	if fileobj != nil {
+		file = &fileWrapper{rws: fileobj}
 	} else {
-		file, err := os.OpenFile(name, osMode(mode+"b"), 0666)
+		f, err := os.OpenFile(name, osMode(mode+"b"), 0666)
 		if err != nil {
 			return nil, err
 		}
-		switch comptype {
-		case "tar":
-			f = file
-		case "gz":
-			if mode == "r" {
-				gz, err := gzip.NewReader(file)
-				if err != nil {
-					file.Close()
-					return nil, err
-				}
-				f = &readWriteCloser{r: gz, w: file}
-			} else {
-				gz, err := gzip.NewWriterLevel(file, compresslevel)
-				if err != nil {
-					file.Close()
-					return nil, err
-				}
-				f = &writeCloser{w: gz, c: file} // os.File 实现了 io.Closer 和 io.Seeker
-			}
-		case "bz2":
-			if mode == "r" {
-				f = &readWriteCloser{r: bzip2.NewReader(file), w: file}
-			} else {
-				file.Close()
-				return nil, NewCompressionError("bz2 streaming write not implemented in stdlib")
-			}
-		case "xz":
-			if mode == "r" {
-				xzReader, err := xz.NewReader(file)
-				if err != nil {
-					file.Close()
-					return nil, err
-				}
-				f = &readWriteCloser{r: xzReader, w: file}
-			} else {
-				xzWriter, err := xz.NewWriter(file)
-				if err != nil {
-					file.Close()
-					return nil, err
-				}
-				f = &writeCloser{w: xzWriter, c: file}
-			}
-		default:
+		file = f
+	}
+	if comptype == "tar" {
+		return &Stream{file: file}, nil
+	}
+
+	var f io.ReadWriteCloser
+	if mode == "r" {
+		r, err := decompress(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		f = &readWriteCloser{r: r}
+	} else {
+		compress := compressors[comptype]
+		w, err := compress(file, compresslevel)
+		if err != nil {
 			file.Close()
-			return nil, NewCompressionError("unknown compression type " + comptype)
+			return nil, err
+		}
+		wc := &writeCloser{w: w, c: file}
+		if comptype == "xz" {
+			// Flush ends the xz stream and starts a new one, see
+			// writeCloser.Flush.
+			wc.restart = func() (io.WriteCloser, error) { return compress(file, compresslevel) }
 		}
+		f = wc
 	}
 	return &Stream{file: f}, nil
 }
@@ -132,18 +324,34 @@ func (s *Stream) Seek(offset int64, whence int) (int64, error) {
 	return 0, fmt.Errorf("stream does not support seeking")
 }
 
+// Flush writes out the data the compressor of a stream being written
+// holds, so that everything written so far can be decompressed, without
+// closing the stream. See writeCloser.Flush for compressors without a
+// flush of their own. Other streams have nothing to flush.
+func (s *Stream) Flush() error {
+	if f, ok := s.file.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
 // Close implements io.Closer.
 func (s *Stream) Close() error {
 	return s.file.Close()
 }
 
-// readWriteCloser adapts a Reader and Closer to ReadWriteCloser.
+// readWriteCloser adapts a decompressing Reader to ReadWriteCloser. Like
+// any stream it can only seek forward, which is done by reading ahead.
 type readWriteCloser struct {
-	r io.Reader
-	w io.ReadWriteSeeker
+	r   io.Reader
+	pos int64
 }
 
-func (rwc *readWriteCloser) Read(p []byte) (int, error)  { return rwc.r.Read(p) }
+func (rwc *readWriteCloser) Read(p []byte) (int, error) {
+	n, err := rwc.r.Read(p)
+	rwc.pos += int64(n)
+	return n, err
+}
 func (rwc *readWriteCloser) Write(p []byte) (int, error) { return 0, fmt.Errorf("write not supported") }
 func (rwc *readWriteCloser) Close() error {
 	if closer, ok := rwc.r.(io.Closer); ok {
@@ -152,18 +360,96 @@ func (rwc *readWriteCloser) Close() error {
 	return nil
 }
 func (rwc *readWriteCloser) Seek(offset int64, whence int) (int64, error) {
-	return rwc.w.Seek(offset, whence)
+	target, err := seekTarget(rwc.pos, offset, whence)
+	if err != nil {
+		return rwc.pos, err
+	}
+	if target < rwc.pos {
+		return rwc.pos, NewStreamError("seeking backwards is not allowed")
+	}
+	if _, err := io.CopyN(io.Discard, rwc, target-rwc.pos); err != nil && err != io.EOF {
+		return rwc.pos, err
+	}
+	return rwc.pos, nil
 }
 
-// writeCloser adapts a Writer and Closer to ReadWriteCloser.
+// seekTarget returns the absolute position a Seek call asks for.
+// Decompressed data has no known end, so io.SeekEnd is not supported.
+func seekTarget(pos, offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		return offset, nil
+	case io.SeekCurrent:
+		return pos + offset, nil
+	}
+	return pos, NewStreamError("seeking relative to the end is not supported")
+}
+
+// writeCloser adapts a compressing Writer and the Closer of the file it
+// writes to to ReadWriteCloser. restart, if set, creates a new compressor
+// writing to the file for compressors that can only be flushed by ending
+// their stream.
 type writeCloser struct {
-	w io.Writer
-	c io.Closer
+	w       io.Writer
+	c       io.Closer
+	restart func() (io.WriteCloser, error)
+}
+
+func (wc *writeCloser) Read(p []byte) (int, error) { return 0, fmt.Errorf("read not supported") }
+func (wc *writeCloser) Write(p []byte) (int, error) {
+	if wc.w == nil {
+		// The stream was ended by Flush.
+		w, err := wc.restart()
+		if err != nil {
+			return 0, err
+		}
+		wc.w = w
+	}
+	return wc.w.Write(p)
+}
+func (wc *writeCloser) Close() error {
+	// Close the compressor first so it writes out its trailer.
+	if closer, ok := wc.w.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			wc.abort()
+			return err
+		}
+	}
+	return wc.c.Close()
+}
+
+// abort closes the file without closing the compressor, after writing
+// the archive failed. Files that are only changed when they are closed,
+// like the appendFile of an archive being appended to, stay unchanged.
+func (wc *writeCloser) abort() error {
+	if a, ok := wc.c.(aborter); ok {
+		return a.abort()
+	}
+	return wc.c.Close()
+}
+
+// Flush writes out the data the compressor holds. Compressors without a
+// Flush method, like that of xz, end their stream and a new one is
+// started with the next Write, as readers of concatenated streams go on
+// with the next.
+func (wc *writeCloser) Flush() error {
+	if wc.w == nil {
+		return nil
+	}
+	if f, ok := wc.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	closer, ok := wc.w.(io.Closer)
+	if !ok || wc.restart == nil {
+		return NewCompressionError("the compressor cannot be flushed")
+	}
+	if err := closer.Close(); err != nil {
+		return err
+	}
+	wc.w = nil
+	return nil
 }
 
-func (wc *writeCloser) Read(p []byte) (int, error)  { return 0, fmt.Errorf("read not supported") }
-func (wc *writeCloser) Write(p []byte) (int, error) { return wc.w.Write(p) }
-func (wc *writeCloser) Close() error                { return wc.c.Close() }
 func (wc *writeCloser) Seek(offset int64, whence int) (int64, error) {
 	if seeker, ok := wc.c.(io.Seeker); ok {
 		return seeker.Seek(offset, whence)
@@ -171,6 +457,93 @@ func (wc *writeCloser) Seek(offset int64, whence int) (int64, error) {
 	return 0, fmt.Errorf("seek not supported")
 }
 
+// writerFile adapts a Writer to ReadWriteCloser for archives written to
+// it as a stream. It keeps track of the position itself, which is all a
+// TarFile being written asks Seek for.
+type writerFile struct {
+	w   io.Writer
+	pos int64
+}
+
+func (wf *writerFile) Read(p []byte) (int, error) { return 0, fmt.Errorf("read not supported") }
+func (wf *writerFile) Write(p []byte) (int, error) {
+	n, err := wf.w.Write(p)
+	wf.pos += int64(n)
+	return n, err
+}
+func (wf *writerFile) Close() error { return nil } // The Writer belongs to the caller
+func (wf *writerFile) Seek(offset int64, whence int) (int64, error) {
+	target, err := seekTarget(wf.pos, offset, whence)
+	if err != nil {
+		return wf.pos, err
+	}
+	if target != wf.pos {
+		return wf.pos, NewStreamError("seeking is not allowed")
+	}
+	return wf.pos, nil
+}
+
+// aborter is implemented by files that can be closed without completing
+// what was written to them.
+type aborter interface {
+	abort() error
+}
+
+// truncater is implemented by files that can be truncated, like *os.File.
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// appendFile is written to by the compressor of an archive being appended
+// to. It keeps the new last stream in tmp and copies it over the old one,
+// which starts at start of file, only when it is closed, so that the
+// archive is left as it was if appending fails before.
+type appendFile struct {
+	tmp       *os.File
+	file      io.ReadWriteSeeker
+	truncater truncater
+	start     int64
+	close     func() error // Closes file, nil if it belongs to the caller
+}
+
+func (af *appendFile) Write(p []byte) (int, error) { return af.tmp.Write(p) }
+
+// Close replaces the old last stream with the new one and closes the
+// files.
+func (af *appendFile) Close() error {
+	return af.cleanup(af.commit())
+}
+
+// abort closes the files without changing the archive.
+func (af *appendFile) abort() error {
+	return af.cleanup(nil)
+}
+
+func (af *appendFile) commit() error {
+	if _, err := af.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := af.file.Seek(af.start, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.Copy(af.file, af.tmp)
+	if err != nil {
+		return err
+	}
+	return af.truncater.Truncate(af.start + n)
+}
+
+func (af *appendFile) cleanup(err error) error {
+	af.tmp.Close()
+	os.Remove(af.tmp.Name())
+	if af.close != nil {
+		if cerr := af.close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
 // fileWrapper adapts ReadWriteSeeker to ReadWriteCloser.
 type fileWrapper struct {
 	rws io.ReadWriteSeeker
@@ -182,11 +555,3 @@ func (fw *fileWrapper) Seek(offset int64, whence int) (int64, error) {
 	return fw.rws.Seek(offset, whence)
 }
 func (fw *fileWrapper) Close() error { return nil } // No-op for fileobj
-
-// wrapCloser 判断给定的 ReadWriteSeeker 是否实现了 Closer，如果没有，则使用 fileWrapper 包装。
-func wrapCloser(rws io.ReadWriteSeeker) io.Closer {
-	if c, ok := rws.(io.Closer); ok {
-		return c
-	}
-	return &fileWrapper{rws: rws}
-}
@@ -0,0 +1,593 @@
+package tarfile
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// writeArchive writes an archive with a member for each name, holding the
+// name as data, to path in mode, such as "w:gz".
+func writeArchive(t *testing.T, path, mode string, names ...string) {
+	t.Helper()
+	tf, err := Open(path, mode, nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := addData(tf, name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tf.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// archiveNames returns the names of the members of the archive at path.
+func archiveNames(t *testing.T, path string) []string {
+	t.Helper()
+	tf, err := Open(path, "r", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	names, err := tf.GetNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestAppendCompressed(t *testing.T) {
+	for _, comptype := range []string{"gz", "xz"} {
+		t.Run(comptype, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "archive.tar."+comptype)
+			writeArchive(t, path, "w:"+comptype, "a", "b")
+			before, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tf, err := Open(path, "a:"+comptype, nil, 4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tf.AddBytes("c", []byte("c"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// Nothing changes before the archive is closed.
+			during, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(before, during) {
+				t.Error("archive changed before Close")
+			}
+			if err := tf.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := archiveNames(t, path), []string{"a", "b", "c"}; !slices.Equal(got, want) {
+				t.Errorf("names = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		mode  string
+		level int
+		ok    bool
+	}{
+		{"w:gz", gzip.DefaultCompression, true},
+		{"w:gz", 0, true},
+		{"w:gz", 10, false},
+		{"w:gz", -2, false},
+		{"w:xz", gzip.DefaultCompression, false},
+	} {
+		tf, err := Open(filepath.Join(dir, "level.tar"), tt.mode, nil, 4096, WithCompressionLevel(tt.level))
+		if err == nil {
+			err = tf.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("Open(%q) with level %d: %v", tt.mode, tt.level, err)
+		}
+	}
+}
+
+func TestCompressors(t *testing.T) {
+	dir := t.TempDir()
+	for comptype := range compressors {
+		if _, ok := decompressors[comptype]; !ok {
+			t.Errorf("%s: no decompressor", comptype)
+			continue
+		}
+		path := filepath.Join(dir, "archive.tar."+comptype)
+		writeArchive(t, path, "w|"+comptype, "a", "b")
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tf, err := Open("", "r|"+comptype, f, 4096)
+		if err != nil {
+			t.Fatalf("%s: %v", comptype, err)
+		}
+		var names []string
+		for {
+			ti, err := tf.Next()
+			if err != nil {
+				t.Fatalf("%s: %v", comptype, err)
+			} else if ti == nil {
+				break
+			}
+			names = append(names, ti.Name)
+		}
+		tf.Close()
+		f.Close()
+		if !slices.Equal(names, []string{"a", "b"}) {
+			t.Errorf("%s: read %v", comptype, names)
+		}
+	}
+}
+
+// compressedTar returns an archive with a member for each name, holding
+// the name as data, compressed with the comptype "gz", "xz" or "zst" by
+// the compressor libraries themselves.
+func compressedTar(t *testing.T, comptype string, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var zw io.WriteCloser
+	var err error
+	switch comptype {
+	case "gz":
+		zw = gzip.NewWriter(&buf)
+	case "xz":
+		zw, err = xz.NewWriter(&buf)
+	case "zst":
+		zw, err = zstd.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown comptype %q", comptype)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(zw)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(name))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectCompression(t *testing.T) {
+	var bz bytes.Buffer
+	bz.WriteString("BZh91AY&SY")
+	for comptype, data := range map[string][]byte{
+		"gz":  compressedTar(t, "gz", "a"),
+		"bz2": bz.Bytes(),
+		"xz":  compressedTar(t, "xz", "a"),
+		"zst": compressedTar(t, "zst", "a"),
+		"tar": tarBytes(t, "a"),
+	} {
+		got, r, err := DetectCompression(bytes.NewReader(data))
+		if err != nil || got != comptype {
+			t.Errorf("DetectCompression() = %q, %v, want %q", got, err, comptype)
+			continue
+		}
+		// The peeked bytes are read again.
+		if all, err := io.ReadAll(r); err != nil || !bytes.Equal(all, data) {
+			t.Errorf("%s: read back %d bytes, %v, want %d", comptype, len(all), err, len(data))
+		}
+	}
+	if got, _, err := DetectCompression(strings.NewReader("x")); err != nil || got != "tar" {
+		t.Errorf("DetectCompression() of a short reader = %q, %v", got, err)
+	}
+}
+
+func TestZstd(t *testing.T) {
+	path := tempFile(t, "archive.tar.zst", compressedTar(t, "zst", "a", "b"))
+	tf, err := Open(path, "r|zst", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	var names []string
+	for {
+		ti, err := tf.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ti == nil {
+			break
+		}
+		names = append(names, ti.Name)
+	}
+	if !slices.Equal(names, []string{"a", "b"}) {
+		t.Errorf("read %v", names)
+	}
+}
+
+func TestOpenCompressedByName(t *testing.T) {
+	for _, comptype := range []string{"gz", "xz", "zst"} {
+		path := tempFile(t, "archive.tar."+comptype, compressedTar(t, comptype, "a", "b"))
+		for _, mode := range []string{"r:" + comptype, "r"} {
+			tf, err := Open(path, mode, nil, 4096)
+			if err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+			names, err := tf.GetNames()
+			if err != nil || !slices.Equal(names, []string{"a", "b"}) {
+				t.Errorf("%s: read %v, %v", mode, names, err)
+			}
+			tf.Close()
+		}
+	}
+}
+
+func TestCloseFlushesGzip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.tar.gz")
+	writeArchive(t, path, "w:gz", "a", "b")
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	// Reading to the end checks the gzip trailer.
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(names, []string{"a", "b"}) {
+		t.Errorf("archive/tar read %v", names)
+	}
+}
+
+func TestBzip2Stream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.tar.bz2")
+	writeArchive(t, path, "w|bz2", "a", "b")
+	if names := archiveNames(t, path); !slices.Equal(names, []string{"a", "b"}) {
+		t.Errorf("read %v", names)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(io.Discard, bzip2.NewReader(f)); err != nil {
+		t.Errorf("compress/bzip2: %v", err)
+	}
+}
+
+func TestOpenReaderUnseekable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.tar.gz")
+	writeArchive(t, path, "w:gz", "a", "b", "c")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hide the Seek method of the bytes.Reader.
+	r := struct{ io.Reader }{bytes.NewReader(data)}
+	tf, err := OpenReader(r, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	var got []string
+	for {
+		ti, err := tf.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ti == nil {
+			break
+		}
+		content, err := io.ReadAll(NewExFileObject(tf, ti))
+		if err != nil || string(content) != ti.Name {
+			t.Errorf("%s: read %q, %v", ti.Name, content, err)
+		}
+		got = append(got, ti.Name)
+	}
+	if !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("read %v", got)
+	}
+}
+
+func TestCompressionLevelSize(t *testing.T) {
+	// Text with some repetition that the levels compress differently.
+	rng := rand.New(rand.NewPCG(1, 2))
+	words := strings.Fields("the quick brown fox jumps over a lazy dog while tar archives grow")
+	var data bytes.Buffer
+	for data.Len() < 1<<20 {
+		data.WriteString(words[rng.IntN(len(words))] + " ")
+	}
+	dir := t.TempDir()
+	for _, comptype := range []string{"gz", "zst"} {
+		sizes := map[int]int64{}
+		for _, level := range []int{1, 9} {
+			path := filepath.Join(dir, fmt.Sprintf("%d.tar.%s", level, comptype))
+			tf, err := Open(path, "w:"+comptype, nil, 4096, WithCompressionLevel(level))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tf.AddBytes("data", data.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := tf.Close(); err != nil {
+				t.Fatal(err)
+			}
+			st, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes[level] = st.Size()
+		}
+		if sizes[9] >= sizes[1] {
+			t.Errorf("%s: level 9 wrote %d bytes, level 1 %d", comptype, sizes[9], sizes[1])
+		}
+	}
+}
+
+func TestLzma(t *testing.T) {
+	// Written by GNU tar and lzma -9 from XZ Utils.
+	tf := openArchive(t, filepath.Join("testdata", "archive.tar.lzma"))
+	ti, err := tf.GetMember("dir/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data bytes.Buffer
+	if _, err := tf.WriteMemberTo(ti, &data); err != nil || data.String() != "hello lzma\n" {
+		t.Errorf("read %q, %v", data.String(), err)
+	}
+
+	for _, mode := range []string{"w:lzma", "w|lzma"} {
+		path := filepath.Join(t.TempDir(), "archive.tar.lzma")
+		writeArchive(t, path, mode, "a", "b")
+		if names := archiveNames(t, path); !slices.Equal(names, []string{"a", "b"}) {
+			t.Errorf("%s: read %v", mode, names)
+		}
+		if b, err := os.ReadFile(path); err != nil || len(b) == 0 || b[0] != 0x5d {
+			t.Errorf("%s: no LZMA-alone header", mode)
+		}
+	}
+}
+
+func TestConcatenatedGzip(t *testing.T) {
+	archive := tarBytes(t, "a", "b", "c", "d")
+	var buf bytes.Buffer
+	for _, half := range [][]byte{archive[:len(archive)/2], archive[len(archive)/2:]} {
+		zw := gzip.NewWriter(&buf)
+		zw.Write(half)
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "concat.tar.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if names := archiveNames(t, path); !slices.Equal(names, []string{"a", "b", "c", "d"}) {
+		t.Errorf("read %v", names)
+	}
+
+	tf, err := OpenReader(bytes.NewReader(buf.Bytes()), "gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	var names []string
+	for ti := range tf.Members {
+		names = append(names, ti.Name)
+	}
+	if !slices.Equal(names, []string{"a", "b", "c", "d"}) {
+		t.Errorf("read %v from a stream", names)
+	}
+}
+
+func TestXzFooter(t *testing.T) {
+	// readXz decompresses data, which has to end with complete xz streams,
+	// and returns the names archive/tar reads.
+	readXz := func(data []byte) []string {
+		t.Helper()
+		if !bytes.HasSuffix(data, []byte("YZ")) {
+			t.Fatalf("xz data ends with %q, not the magic of a stream footer", data[len(data)-2:])
+		}
+		zr, err := xz.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(zr)
+		var names []string
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				if err != io.EOF && err != io.ErrUnexpectedEOF {
+					t.Fatal(err)
+				}
+				break
+			}
+			names = append(names, hdr.Name)
+		}
+		if _, err := io.Copy(io.Discard, zr); err != nil {
+			t.Fatalf("xz: %v", err)
+		}
+		return names
+	}
+
+	path := filepath.Join(t.TempDir(), "archive.tar.xz")
+	tf, err := Open(path, "w:xz", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("a", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	flushed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := readXz(flushed); !slices.Equal(names, []string{"a"}) {
+		t.Errorf("read %v after Flush, want [a]", names)
+	}
+	if _, err := tf.AddBytes("b", []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := readXz(data); !slices.Equal(names, []string{"a", "b"}) {
+		t.Errorf("read %v after Close, want [a b]", names)
+	}
+}
+
+// closeRecorder is an io.Writer that records whether it was closed.
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestNewWriter(t *testing.T) {
+	src := filepath.Join(t.TempDir(), strings.Repeat("long", 30))
+	if err := os.WriteFile(src, []byte("from disk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var w closeRecorder
+	tf, err := NewWriter(&w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("bytes", []byte("in memory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := NewTarInfo("dir")
+	dir.Type, dir.Mode = DIRTYPE, 0755
+	if err := tf.AddFile(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.Add(src, "dir/"+filepath.Base(src), false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.closed {
+		t.Error("Close closed the writer")
+	}
+	if w.Len()%RECORDSIZE != 0 {
+		t.Errorf("archive of %d bytes is not made of whole records", w.Len())
+	}
+
+	want := map[string]string{"bytes": "in memory", "dir/": "", "dir/" + filepath.Base(src): "from disk"}
+	tr := tar.NewReader(bytes.NewReader(w.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantData, ok := want[hdr.Name]; !ok || string(data) != wantData {
+			t.Errorf("archive/tar read %s = %q", hdr.Name, data)
+		}
+		delete(want, hdr.Name)
+	}
+	if len(want) > 0 {
+		t.Errorf("members %v missing", slices.Sorted(maps.Keys(want)))
+	}
+	if names := archiveNames(t, tempFile(t, "written.tar", w.Bytes())); len(names) != 3 {
+		t.Errorf("read back %v", names)
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	data := tarBytes(t, "a", "b", "c")
+	// Hide the Seek method of the bytes.Reader.
+	tf, err := NewReader(struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	if !tf.IsStream() {
+		t.Error("NewReader did not open a stream")
+	}
+	var names []string
+	for {
+		ti, err := tf.NextHeader()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := tf.WriteMemberTo(ti, &buf); err != nil || buf.String() != ti.Name {
+			t.Errorf("%s: data %q, %v", ti.Name, buf.String(), err)
+		}
+		names = append(names, ti.Name)
+	}
+	if !slices.Equal(names, []string{"a", "b", "c"}) {
+		t.Errorf("read %v", names)
+	}
+	if _, err := tf.NextHeader(); !errors.Is(err, io.EOF) {
+		t.Errorf("NextHeader() after the end = %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,92 @@
+package tarfile
+
+// Summary is an overview of the members of an archive.
+type Summary struct {
+	Members   int   // Number of members
+	Size      int64 // Total size of the regular files
+	Regular   int   // Number of regular files
+	Dirs      int   // Number of directories
+	Symlinks  int   // Number of symbolic links
+	HardLinks int   // Number of hard links
+	Devices   int   // Number of character and block devices and FIFOs
+	Format    int   // Format of the archive, V7_FORMAT, USTAR_FORMAT, GNU_FORMAT or PAX_FORMAT
+}
+
+// Summary counts the members of the archive by type, loading them first
+// if needed. For archives being written Format is the format they are
+// written in, for archives being read it is the format DetectedFormat
+// reports.
+func (tf *TarFile) Summary() (Summary, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if err := tf.check(""); err != nil {
+		return Summary{}, err
+	}
+	if !tf.loaded {
+		if err := tf.load(); err != nil {
+			return Summary{}, err
+		}
+	}
+	s := Summary{
+		Members: len(tf.members),
+		Size:    regularSize(tf.members),
+		Format:  tf.format,
+	}
+	for _, ti := range tf.members {
+		switch {
+		case ti.IsReg():
+			s.Regular++
+		case ti.IsDir():
+			s.Dirs++
+		case ti.IsSym():
+			s.Symlinks++
+		case ti.IsLnk():
+			s.HardLinks++
+		case ti.IsDev():
+			s.Devices++
+		}
+	}
+	if tf.mode == "r" {
+		s.Format = tf.detectedFormat()
+	}
+	return s, nil
+}
+
+// DetectedFormat returns the format most members of the archive were read
+// in, the more capable one on a tie, loading the members first if needed.
+// For an archive without members it returns the format the TarFile
+// writes.
+func (tf *TarFile) DetectedFormat() (int, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if err := tf.check("ra"); err != nil {
+		return 0, err
+	}
+	if !tf.loaded {
+		if err := tf.load(); err != nil {
+			return 0, err
+		}
+	}
+	return tf.detectedFormat(), nil
+}
+
+// detectedFormat is the internal implementation of DetectedFormat for
+// the members loaded.
+func (tf *TarFile) detectedFormat() int {
+	if len(tf.members) == 0 {
+		return tf.format
+	}
+	counts := make(map[int]int)
+	for _, ti := range tf.members {
+		counts[ti.Format]++
+	}
+	format := V7_FORMAT
+	for _, f := range []int{USTAR_FORMAT, GNU_FORMAT, PAX_FORMAT} {
+		if counts[f] >= counts[format] {
+			format = f
+		}
+	}
+	return format
+}
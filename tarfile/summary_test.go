@@ -0,0 +1,45 @@
+package tarfile
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSummary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mixed.tar")
+	tf, err := Open(path, "w", nil, 4096, WithFormat(GNU_FORMAT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{"a": "abc", "b": "bcdef"} {
+		if _, err := tf.AddBytes(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, typ := range map[string]string{"d": DIRTYPE, "s": SYMTYPE, "h": LNKTYPE, "c": CHRTYPE, "p": FIFOTYPE} {
+		ti := NewTarInfo(name)
+		ti.Type = typ
+		if typ == SYMTYPE || typ == LNKTYPE {
+			ti.Linkname = "a"
+		}
+		if err := tf.AddFile(ti, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tf.Close()
+
+	tf = openArchive(t, path)
+	want := Summary{Members: 7, Size: 8, Regular: 2, Dirs: 1, Symlinks: 1, HardLinks: 1, Devices: 2, Format: GNU_FORMAT}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s, err := tf.Summary(); err != nil || s != want {
+				t.Errorf("Summary() = %+v, %v, want %+v", s, err, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -1,20 +1,24 @@
 package tarfile
 
 import (
-	"compress/bzip2"
-	"compress/gzip"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
 	"os"
+	"os/user"
+	"path"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/ulikunitz/xz" // 引入第三方 xz 包
-
 	"golang.org/x/sys/unix"
 )
 
@@ -31,6 +35,28 @@ type TarFile struct {
 	tarInfo          func() *TarInfo                          // Factory for TarInfo objects
 	fileObject       func(*TarFile, *TarInfo) *ExFileObject   // Factory for file objects
 	extractionFilter func(*TarInfo, string) (*TarInfo, error) // Filter for extraction
+	preserveAttrs    bool                                     // Restore mode and mtime on extraction
+	preserveOwner    bool                                     // Restore ownership on extraction
+	numericOwner     bool                                     // Restore ownership from uid/gid only
+	preserveXattrs   bool                                     // Restore extended attributes on extraction
+	reproducible     bool                                     // Normalize TarInfos created from files
+	reproducibleTime time.Time                                // Mtime of TarInfos in reproducible mode
+	maxExtractSize   int64                                    // Limit of bytes written per extraction, 0 for none
+	overwrite        int                                      // Overwrite policy for existing files
+	strictTypes      bool                                     // Fail on files of unsupported types when adding
+	compressLevel    int                                      // Level for compressed archives being written
+	progress         func(*TarInfo, int64, int64)             // Progress callback for adding and extracting
+	maxMembers       int                                      // Limit of members read, 0 for none
+	sparse           bool                                     // Store holes of files added as sparse members
+	dataEncoder      func(io.Writer) io.WriteCloser           // Transform of member data being added
+	dataDecoder      func(io.Reader) io.Reader                // Transform of member data being extracted
+	contiguous       func(*TarInfo) bool                      // Selects regular files added as CONTTYPE
+	strictPadding    bool                                     // Check that the padding after member data is zero
+	flattenSymlinks  bool                                     // Extract symlinks as copies of their targets
+	exactMode        bool                                     // Apply archived modes regardless of the umask
+	readCache        *blockCache                              // Blocks read by ExFileObjects, nil for none
+	shouldInclude    func(string, fs.DirEntry) bool           // Prunes directory entries before Add stats them
+	tolerant         bool                                     // Look for headers after data without padding
 
 	name       string             // Path to the tar file
 	mode       string             // "r", "a", "w", "x"
@@ -43,11 +69,22 @@ type TarFile struct {
 	copyBufSize int                  // Buffer size for copying
 	closed      bool                 // Whether the archive is closed
 	members     []*TarInfo           // List of members
+	memberIndex map[string]*TarInfo  // Last member by name, built once loaded
 	loaded      bool                 // Whether all members are loaded
 	offset      int64                // Current position in the archive
 	inodes      map[[2]uint64]string // Cache of inodes for hard links
+	memberCount int                  // Number of members read, also in stream mode
 	firstMember *TarInfo             // First member for iteration
 
+	skippedErrors []error    // Extraction errors ignored because of errorLevel
+	extractedSize int64      // Bytes written by the current extraction
+	extracted     []*TarInfo // Regular files written by the last extraction, as filtered
+	dataEnd       int64      // End of the data of the member read last
+	fileSize      int64      // Length of a seekable archive being read, or -1
+	start         int64      // Position of the archive in fileObj
+
+	reporter *progressReporter // Progress of the current extraction
+
 	// 添加互斥锁保证并发安全
 	mu sync.RWMutex
 }
@@ -61,25 +98,32 @@ func NewTarFile(name, mode string, fileobj io.ReadWriteSeeker, opts ...TarFileOp
 	}
 
 	tf := &TarFile{
-		debug:       0,
-		dereference: false,
-		ignoreZeros: false,
-		errorLevel:  1,
-		format:      DEFAULT_FORMAT,
-		encoding:    ENCODING,
-		errors:      "surrogateescape",
-		tarInfo:     func() *TarInfo { return NewTarInfo("") },
-		fileObject:  func(tf *TarFile, ti *TarInfo) *ExFileObject { return NewExFileObject(tf, ti) },
-		paxHeaders:  make(map[string]string),
-		mode:        mode,
-		fileMode:    fileMode,
-		inodes:      make(map[[2]uint64]string),
+		debug:         0,
+		dereference:   false,
+		ignoreZeros:   false,
+		errorLevel:    1,
+		preserveAttrs: true,
+		format:        DEFAULT_FORMAT,
+		encoding:      ENCODING,
+		errors:        "surrogateescape",
+		tarInfo:       func() *TarInfo { return NewTarInfo("") },
+		fileObject:    func(tf *TarFile, ti *TarInfo) *ExFileObject { return NewExFileObject(tf, ti) },
+		paxHeaders:    make(map[string]string),
+		mode:          mode,
+		fileMode:      fileMode,
+		inodes:        make(map[[2]uint64]string),
+		fileSize:      -1,
+		compressLevel: defaultCompressLevel,
 	}
 
 	// Apply options
 	for _, opt := range opts {
 		opt(tf)
 	}
+	// Only archives being read cannot change under the cache.
+	if tf.mode != "r" || tf.stream {
+		tf.readCache = nil
+	}
 
 	if fileobj == nil {
 		if tf.mode == "a" && !fileExists(name) {
@@ -110,11 +154,22 @@ func NewTarFile(name, mode string, fileobj io.ReadWriteSeeker, opts ...TarFileOp
 	}
 
 	tf.offset = tell(tf.fileObj)
+	tf.start = tf.offset
 
 	// Initialize based on mode
 	var err error
 	switch tf.mode {
 	case "r":
+		if !tf.stream {
+			// Compressed archives do not know their length and fail here.
+			if end, err := tf.fileObj.Seek(0, io.SeekEnd); err == nil {
+				tf.fileSize = end
+			}
+			if _, err := tf.fileObj.Seek(tf.offset, io.SeekStart); err != nil {
+				tf.Close()
+				return nil, err
+			}
+		}
 		tf.firstMember, err = tf.Next()
 		if err != nil {
 			tf.Close()
@@ -138,8 +193,16 @@ func NewTarFile(name, mode string, fileobj io.ReadWriteSeeker, opts ...TarFileOp
 				tf.Close()
 				return nil, NewReadError(err.Error())
 			}
-			tf.members = append(tf.members, ti)
+			if tf.maxMembers > 0 && tf.memberCount >= tf.maxMembers {
+				tf.Close()
+				return nil, NewMemberLimitError(tf.maxMembers)
+			}
+			tf.memberCount++
+			tf.addMember(ti)
 		}
+		// Reading on would move the file past the end of the archive,
+		// where the next member is to be written.
+		tf.loaded = true
 	case "w", "x":
 		tf.loaded = true
 		if len(tf.paxHeaders) > 0 {
@@ -182,7 +245,232 @@ func WithPaxHeaders(headers map[string]string) TarFileOption {
 	return func(tf *TarFile) { tf.paxHeaders = headers }
 }
 
+// WithExtractionFilter sets the filter applied to each member before extraction.
+func WithExtractionFilter(filter func(*TarInfo, string) (*TarInfo, error)) TarFileOption {
+	return func(tf *TarFile) { tf.extractionFilter = filter }
+}
+
+// WithPreserveAttrs sets whether extraction restores member attributes:
+// owner, times and the mode of directories and of files with the setuid,
+// setgid or sticky bit.
+func WithPreserveAttrs(preserve bool) TarFileOption {
+	return func(tf *TarFile) { tf.preserveAttrs = preserve }
+}
+
+// WithPreserveOwner sets whether extraction restores the owner and group
+// of members. This needs root privileges and is skipped otherwise.
+func WithPreserveOwner(preserve bool) TarFileOption {
+	return func(tf *TarFile) { tf.preserveOwner = preserve }
+}
+
+// WithNumericOwner sets whether ownership is restored from the uid and gid
+// of members only, instead of looking up their user and group names.
+func WithNumericOwner(numeric bool) TarFileOption {
+	return func(tf *TarFile) { tf.numericOwner = numeric }
+}
+
+// WithPreserveXattrs sets whether extraction restores the extended
+// attributes of members. They are only restored along with the other
+// attributes, see WithPreserveAttrs.
+func WithPreserveXattrs(preserve bool) TarFileOption {
+	return func(tf *TarFile) { tf.preserveXattrs = preserve }
+}
+
+// WithExactMode sets whether extraction applies the archived mode of
+// regular files exactly, like tar -p. Otherwise files are created with
+// their mode masked by the process umask. It only has an effect along
+// with the other attributes, see WithPreserveAttrs.
+func WithExactMode(exact bool) TarFileOption {
+	return func(tf *TarFile) { tf.exactMode = exact }
+}
+
+// WithReadCache sets the number of blocks of archives being read that are
+// kept in an LRU cache for the reads of ExFileObjects. This avoids going
+// back to the archive when the same members are read repeatedly in random
+// order. A value of 0 disables the cache, and it is not used in stream
+// mode.
+func WithReadCache(blocks int) TarFileOption {
+	return func(tf *TarFile) {
+		tf.readCache = nil
+		if blocks > 0 {
+			tf.readCache = newBlockCache(blocks)
+		}
+	}
+}
+
+// WithShouldInclude sets a predicate deciding which entries of the
+// directories that Add walks are added, with their path and directory
+// entry. It is called before the file is statted, and excluded
+// directories are not walked, which makes it cheaper than a filter of Add
+// that returns nil. The names passed to Add themselves are always added.
+func WithShouldInclude(include func(path string, d fs.DirEntry) bool) TarFileOption {
+	return func(tf *TarFile) { tf.shouldInclude = include }
+}
+
+// WithTolerant sets whether reading looks for the next header near the
+// end of the data of the previous member when a header is invalid. Some
+// writers omit the padding after member data, so that the next header is
+// not where it is expected. Headers are looked for at every offset within
+// a record from the end of the data; archives read as a stream cannot be
+// searched. Setting ignoreZeros with SetIgnoreZeros does the same.
+func WithTolerant(tolerant bool) TarFileOption {
+	return func(tf *TarFile) { tf.tolerant = tolerant }
+}
+
+// WithCompressionLevel sets the compression level of compressed archives
+// opened for writing or appending. The levels are those of the command
+// line tools: 0 to 9 for gzip, 1 to 9 for bzip2, 0 to 9 for xz and lzma,
+// whose levels select the dictionary size, and 1 to 22 for zstd. gzip
+// also takes gzip.DefaultCompression. Opening fails with a
+// CompressionError for levels out of range. The defaults are 9, except 6
+// for xz and lzma.
+func WithCompressionLevel(level int) TarFileOption {
+	return func(tf *TarFile) { tf.compressLevel = level }
+}
+
+// compressLevelOption returns the compression level set by opts, which
+// is needed before the TarFile exists.
+func compressLevelOption(opts []TarFileOption) int {
+	probe := &TarFile{compressLevel: defaultCompressLevel}
+	for _, opt := range opts {
+		opt(probe)
+	}
+	return probe.compressLevel
+}
+
+// WithStrictTypes sets whether GetTarInfo and Add fail with an
+// UnsupportedTypeError for files that cannot be archived, such as
+// sockets. By default such files are skipped.
+func WithStrictTypes(strict bool) TarFileOption {
+	return func(tf *TarFile) { tf.strictTypes = strict }
+}
+
+// WithSparse sets whether GetTarInfo and Add look for holes in the
+// regular files they add, using SEEK_DATA and SEEK_HOLE, and store files
+// with holes as GNU sparse members holding only their data regions. It
+// only has an effect for archives written in GNU_FORMAT; AddFile writes
+// the Sparse map of a TarInfo set by hand the same way.
+func WithSparse(sparse bool) TarFileOption {
+	return func(tf *TarFile) { tf.sparse = sparse }
+}
+
+// WithFlattenSymlinks sets whether symbolic links are extracted as
+// copies of the regular files they refer to within the archive instead of
+// as links, for destinations that do not allow symlinks. Chains of links
+// are followed. Links whose target is absolute or outside the archive are
+// refused with the error of ResolveLink, while links to missing members
+// or to directories are ExtractErrors subject to the error level.
+func WithFlattenSymlinks(flatten bool) TarFileOption {
+	return func(tf *TarFile) { tf.flattenSymlinks = flatten }
+}
+
+// WithStrictPadding sets whether reading checks that the padding after
+// the data of each member, up to the next block, consists of NUL bytes
+// and fails with a ReadError otherwise, which GetMembers and the other
+// methods that load all members return as well. It catches corrupt
+// archives while members are read, where Verify only checks their
+// structure.
+func WithStrictPadding(strict bool) TarFileOption {
+	return func(tf *TarFile) { tf.strictPadding = strict }
+}
+
+// WithContiguous makes GetTarInfo and Add store the regular files for
+// which match returns true as contiguous files (CONTTYPE), for systems
+// that allocate them contiguously. Other systems read them as regular
+// files. match is called with the TarInfo created for the file.
+func WithContiguous(match func(*TarInfo) bool) TarFileOption {
+	return func(tf *TarFile) { tf.contiguous = match }
+}
+
+// WithDataEncoder sets a transform, such as encryption, that AddFile and
+// Add apply to the data of each regular file before storing it. The
+// headers are written as is and the Size of the member is that of the
+// encoded data, so the data are encoded into a temporary file first.
+// Sparse members cannot be encoded.
+func WithDataEncoder(encode func(io.Writer) io.WriteCloser) TarFileOption {
+	return func(tf *TarFile) { tf.dataEncoder = encode }
+}
+
+// WithDataDecoder sets the transform that undoes the one of
+// WithDataEncoder when regular files are extracted to disk. Sparse
+// members are extracted as stored. Walk, WriteMemberTo and the other
+// readers of member data return the data as stored, and
+// WithMaxExtractSize counts the stored bytes.
+func WithDataDecoder(decode func(io.Reader) io.Reader) TarFileOption {
+	return func(tf *TarFile) { tf.dataDecoder = decode }
+}
+
+// WithReproducible makes archives built from files byte-identical across
+// runs: TarInfos created by GetTarInfo and Add get uid and gid 0, no user
+// and group names, mtime as their modification time, no access and change
+// times and mode 0755 for directories and executables, 0777 for symlinks
+// and 0644 otherwise. A zero mtime stands for the Unix epoch. Add already
+// adds directory contents in sorted order.
+func WithReproducible(mtime time.Time) TarFileOption {
+	return func(tf *TarFile) {
+		tf.reproducible = true
+		if mtime.IsZero() {
+			mtime = time.Unix(0, 0)
+		}
+		tf.reproducibleTime = mtime
+	}
+}
+
+// WithMaxExtractSize limits the number of bytes a call to Extract or
+// ExtractAll writes. Members that would exceed the limit are not extracted
+// and a TarError is returned instead. A limit of 0 means no limit.
+func WithMaxExtractSize(n int64) TarFileOption {
+	return func(tf *TarFile) { tf.maxExtractSize = n }
+}
+
+// WithOverwrite sets how extraction treats files that already exist:
+// OverwriteAlways, the default, replaces them, OverwriteNever keeps them
+// and reports an ExtractError, which is skipped below error level 2, and
+// OverwriteIfNewer only replaces them if the member's mtime is later.
+// The policy applies to all kinds of members.
+func WithOverwrite(policy int) TarFileOption {
+	return func(tf *TarFile) { tf.overwrite = policy }
+}
+
+// WithProgress sets a callback that reports the progress of adding and
+// extracting members. It is called as the data of a member is copied and
+// once when the member is complete. bytesDone and bytesTotal count the
+// data of the current call: the member for AddFile and Extract, and the
+// regular files of the archive for ExtractAll, of which members that are
+// skipped never count as done. The callback runs on a goroutine of its
+// own, never while the TarFile is locked, and has received all reports
+// when the call returns.
+func WithProgress(fn func(ti *TarInfo, bytesDone, bytesTotal int64)) TarFileOption {
+	return func(tf *TarFile) { tf.progress = fn }
+}
+
+// WithMaxMembers limits the number of members read from the archive to
+// n, so that an archive of countless tiny members cannot exhaust memory.
+// Reading further members fails with a MemberLimitError, as do the
+// methods that load all members, like GetMembers and ExtractAll. A limit
+// of 0, the default, means no limit.
+func WithMaxMembers(n int) TarFileOption {
+	return func(tf *TarFile) { tf.maxMembers = n }
+}
+
+// WithTarInfoFactory sets the function that creates the TarInfos of the
+// archive, including every member read from it, for example to keep
+// additional data about members keyed by their TarInfo. The default is
+// NewTarInfo("").
+func WithTarInfoFactory(factory func() *TarInfo) TarFileOption {
+	return func(tf *TarFile) { tf.tarInfo = factory }
+}
+
+// WithFileObjectFactory sets the function that creates the readers of
+// member data for Walk and FS, for example to wrap them in a decrypting
+// reader. The default is NewExFileObject.
+func WithFileObjectFactory(factory func(*TarFile, *TarInfo) *ExFileObject) TarFileOption {
+	return func(tf *TarFile) { tf.fileObject = factory }
+}
+
 // Open opens a tar archive with the specified mode and compression.
+// Appending with "a:gz" or "a:xz" is supported; the other compression
+// types cannot be appended to and return a CompressionError.
 func Open(name, mode string, fileobj io.ReadWriteSeeker, bufsize int, opts ...TarFileOption) (*TarFile, error) {
 	if name == "" && fileobj == nil {
 		return nil, fmt.Errorf("nothing to open")
@@ -190,18 +478,15 @@ func Open(name, mode string, fileobj io.ReadWriteSeeker, bufsize int, opts ...Ta
 
 	switch {
 	case mode == "r" || mode == "r:*":
-		for _, comptype := range []string{"tar", "gz", "bz2", "xz"} {
-			f, err := openMethod(comptype, name, "r", fileobj, opts...)
-			if err == nil {
-				return f, nil
-			}
-			if fileobj != nil {
-				if _, err := fileobj.Seek(0, io.SeekStart); err != nil {
-					return nil, err
-				}
-			}
+		comptype, err := detectFileCompression(name, fileobj)
+		if err != nil {
+			return nil, err
+		}
+		tf, err := openMethod(comptype, name, "r", fileobj, opts...)
+		if err != nil {
+			return nil, NewReadError(fmt.Sprintf("file could not be opened successfully: %v", err))
 		}
-		return nil, NewReadError("file could not be opened successfully")
+		return tf, nil
 
 	case strings.Contains(mode, ":"):
 		filemode, comptype := splitMode(mode, ":")
@@ -212,7 +497,7 @@ func Open(name, mode string, fileobj io.ReadWriteSeeker, bufsize int, opts ...Ta
 		if filemode != "r" && filemode != "w" {
 			return nil, fmt.Errorf("mode must be 'r' or 'w'")
 		}
-		stream, err := newStream(name, filemode, comptype, fileobj, bufsize, 9)
+		stream, err := newStream(name, filemode, comptype, fileobj, bufsize, compressLevelOption(opts))
 		if err != nil {
 			return nil, err
 		}
@@ -231,6 +516,102 @@ func Open(name, mode string, fileobj io.ReadWriteSeeker, bufsize int, opts ...Ta
 	return nil, fmt.Errorf("undiscernible mode")
 }
 
+// OpenReader opens a tar archive for reading from r, which does not need
+// to support seeking, such as a network connection. comptype is one of
+// "tar", "gz", "bz2", "xz", "lzma" and "zst", or "" or "*" to detect the
+// compression from the first bytes of r.
+//
+// The archive is read as a stream: members can only be visited in order
+// with Next or Members, and the data of a member can be read with
+// Extract or an ExFileObject only until the next member is read.
+// GetMembers, GetMember and the other methods that need random access
+// would read the rest of the stream and are not useful here. Closing the
+// TarFile does not close r.
+func OpenReader(r io.Reader, comptype string, opts ...TarFileOption) (*TarFile, error) {
+	if r == nil {
+		return nil, fmt.Errorf("nothing to open")
+	}
+	if comptype == "" || comptype == "*" {
+		var err error
+		if comptype, r, err = DetectCompression(r); err != nil {
+			return nil, err
+		}
+	}
+
+	// Hide any Close method, r belongs to the caller.
+	src := struct{ io.Reader }{r}
+	var data io.Reader = src
+	if comptype != "tar" {
+		decompress, ok := decompressors[comptype]
+		if !ok {
+			return nil, NewCompressionError("unknown compression type " + comptype)
+		}
+		var err error
+		if data, err = decompress(src); err != nil {
+			return nil, NewReadError(fmt.Sprintf("file could not be opened successfully: %v", err))
+		}
+	}
+
+	stream := &Stream{file: &readWriteCloser{r: data}}
+	tf, err := NewTarFile("", "r", stream, append(opts, func(tf *TarFile) { tf.stream = true })...)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	tf.extFileObj = false
+	return tf, nil
+}
+
+// NewReader creates a TarFile that reads an uncompressed archive from r
+// as a stream, like NewReader of archive/tar. It is OpenReader for the
+// "tar" comptype. Use NextHeader to iterate over the members as with
+// archive/tar.Reader, and an ExFileObject to read the data of the current
+// member.
+func NewReader(r io.Reader, opts ...TarFileOption) (*TarFile, error) {
+	return OpenReader(r, "tar", opts...)
+}
+
+// NewWriter creates a TarFile that writes an uncompressed archive to w,
+// like NewWriter of archive/tar. w does not need to support seeking: the
+// archive is written as a stream, and Add, AddFile and Close never seek.
+// Close writes the end of the archive but does not close w.
+func NewWriter(w io.Writer, opts ...TarFileOption) (*TarFile, error) {
+	if w == nil {
+		return nil, fmt.Errorf("nothing to open")
+	}
+	stream := &Stream{file: &writerFile{w: w}}
+	tf, err := NewTarFile("", "w", stream, append(opts, func(tf *TarFile) { tf.stream = true })...)
+	if err != nil {
+		return nil, err
+	}
+	tf.extFileObj = false
+	return tf, nil
+}
+
+// detectFileCompression returns the comptype of fileobj, or of the file
+// called name if fileobj is nil. fileobj is left at its current position.
+func detectFileCompression(name string, fileobj io.ReadWriteSeeker) (string, error) {
+	if fileobj == nil {
+		f, err := os.Open(name)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		comptype, _, err := DetectCompression(f)
+		return comptype, err
+	}
+
+	start := tell(fileobj)
+	comptype, _, err := DetectCompression(fileobj)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fileobj.Seek(start, io.SeekStart); err != nil {
+		return "", err
+	}
+	return comptype, nil
+}
+
 func splitMode(mode, sep string) (string, string) {
 	parts := strings.SplitN(mode, sep, 2)
 	filemode := parts[0]
@@ -245,57 +626,259 @@ func splitMode(mode, sep string) (string, string) {
 }
 
 func openMethod(comptype, name, mode string, fileobj io.ReadWriteSeeker, opts ...TarFileOption) (*TarFile, error) {
-	switch comptype {
-	case "tar":
+	if comptype == "tar" {
 		return NewTarFile(name, mode, fileobj, opts...)
-	case "gz":
-		var f io.ReadWriteSeeker
-		if fileobj != nil {
-			gz, err := gzip.NewReader(fileobj)
-			if err != nil {
-				return nil, err
-			}
-			f = &readWriteSeeker{gz, fileobj}
-		} else {
-			f, _ = os.Open(name) // Simplified, needs proper gzip handling
-		}
-		return NewTarFile(name, mode, f, opts...)
-	case "bz2":
-		f := bzip2.NewReader(fileobj)
-		return NewTarFile(name, mode, &readWriteSeeker{f, fileobj}, opts...)
-	case "xz":
-		f, err := xz.NewReader(fileobj)
+	}
+	newReader, ok := decompressors[comptype]
+	if !ok {
+		return nil, NewCompressionError(fmt.Sprintf("unknown compression type %q", comptype))
+	}
+
+	if mode == "a" {
+		return openAppend(comptype, name, fileobj, opts...)
+	}
+	if mode != "r" {
+		return openStreamWriter(comptype, name, mode, fileobj, opts...)
+	}
+
+	extFileObj := fileobj != nil
+	if !extFileObj {
+		f, err := os.Open(name)
 		if err != nil {
 			return nil, err
 		}
-		return NewTarFile(name, mode, &readWriteSeeker{f, fileobj}, opts...)
-	default:
-		return nil, NewCompressionError(fmt.Sprintf("unknown compression type %q", comptype))
+		fileobj = f
+	}
+	closeFileObj := func() {
+		if c, ok := fileobj.(io.Closer); ok && !extFileObj {
+			c.Close()
+		}
+	}
+
+	f, err := newReadWriteSeeker(fileobj, newReader)
+	if err != nil {
+		closeFileObj()
+		return nil, err
+	}
+	tf, err := NewTarFile(name, mode, f, opts...)
+	if err != nil {
+		closeFileObj()
+		return nil, err
+	}
+	tf.extFileObj = extFileObj
+	return tf, nil
+}
+
+// openStreamWriter opens a compressed archive for writing. The compressor
+// output cannot be seeked, so the archive is written as a stream.
+func openStreamWriter(comptype, name, mode string, fileobj io.ReadWriteSeeker, opts ...TarFileOption) (*TarFile, error) {
+	if mode != "w" && mode != "x" {
+		return nil, NewCompressionError(fmt.Sprintf("mode %q is not supported for compressed archives", mode))
+	}
+	stream, err := newStream(name, mode, comptype, fileobj, RECORDSIZE, compressLevelOption(opts))
+	if err != nil {
+		return nil, err
+	}
+	tf, err := NewTarFile(name, mode, stream, opts...)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	tf.extFileObj = false
+	return tf, nil
+}
+
+// openAppend opens a compressed archive for appending. This is supported
+// for gzip and xz, whose streams can be concatenated: the last stream is
+// compressed again without the end-of-archive blocks and new members are
+// added to it. The file is truncated in the process, so a
+// fileobj must have a Truncate method like *os.File.
+func openAppend(comptype, name string, fileobj io.ReadWriteSeeker, opts ...TarFileOption) (tf *TarFile, err error) {
+	scan, ok := appendables[comptype]
+	if !ok {
+		return nil, NewCompressionError(fmt.Sprintf("appending is not supported for %s archives", comptype))
+	}
+	level, err := checkCompressLevel(comptype, compressLevelOption(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	extFileObj := fileobj != nil
+	if !extFileObj {
+		if !fileExists(name) {
+			return openStreamWriter(comptype, name, "w", nil, opts...)
+		}
+		f, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		fileobj = f
+	}
+	defer func() {
+		if c, ok := fileobj.(io.Closer); ok && err != nil && !extFileObj {
+			c.Close()
+		}
+	}()
+	truncater, ok := fileobj.(truncater)
+	if !ok {
+		return nil, NewCompressionError("appending to a compressed archive needs a file with a Truncate method")
+	}
+
+	origin := tell(fileobj)
+	start, dataStart, err := lastStream(fileobj, scan)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fileobj.Seek(origin, io.SeekStart); err != nil {
+		return nil, err
+	}
+	rws, err := newReadWriteSeeker(fileobj, decompressors[comptype])
+	if err != nil {
+		return nil, err
+	}
+	tf, err = NewTarFile(name, "a", rws, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if tf.offset < dataStart {
+		return nil, NewCompressionError("the end of the archive is not in its last compressed stream")
+	}
+
+	// The last stream is compressed again into a temporary file, with the
+	// data up to the end-of-archive blocks followed by the new members.
+	// It only replaces the old stream once the archive is closed.
+	tmp, err := os.CreateTemp("", "gtarfile-")
+	if err != nil {
+		return nil, err
+	}
+	af := &appendFile{tmp: tmp, file: fileobj, truncater: truncater, start: start}
+	if !extFileObj {
+		af.close = fileobj.(io.Closer).Close
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	compress := compressors[comptype]
+	zw, err := compress(af, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rws.Seek(dataStart, io.SeekStart); err != nil {
+		return nil, err
 	}
+	if _, err := io.CopyN(zw, rws, tf.offset-dataStart); err != nil {
+		return nil, err
+	}
+
+	tf.fileObj = &writeCloser{w: zw, c: af, restart: func() (io.WriteCloser, error) {
+		return compress(af, level)
+	}}
+	tf.extFileObj = false
+	return tf, nil
 }
 
-// readWriteSeeker adapts a Reader to ReadWriteSeeker (simplified).
+// readWriteSeeker adapts a decompressing Reader over a seekable source to
+// ReadWriteSeeker. Seeking forward reads ahead, seeking backwards starts
+// decompressing again from the beginning of the source.
 type readWriteSeeker struct {
-	r io.Reader
-	w io.ReadWriteSeeker
+	r         io.Reader
+	w         io.ReadWriteSeeker
+	newReader func(io.Reader) (io.Reader, error)
+	start     int64 // Position of the compressed data in w
+	pos       int64 // Position in the decompressed data
 }
 
-func (rws *readWriteSeeker) Read(p []byte) (int, error)  { return rws.r.Read(p) }
+func newReadWriteSeeker(w io.ReadWriteSeeker, newReader func(io.Reader) (io.Reader, error)) (*readWriteSeeker, error) {
+	start := tell(w)
+	r, err := newReader(w)
+	if err != nil {
+		return nil, err
+	}
+	return &readWriteSeeker{r: r, w: w, newReader: newReader, start: start}, nil
+}
+
+func (rws *readWriteSeeker) Read(p []byte) (int, error) {
+	n, err := rws.r.Read(p)
+	rws.pos += int64(n)
+	return n, err
+}
 func (rws *readWriteSeeker) Write(p []byte) (int, error) { return 0, fmt.Errorf("write not supported") }
+func (rws *readWriteSeeker) Close() error {
+	if closer, ok := rws.r.(io.Closer); ok {
+		closer.Close()
+	}
+	if closer, ok := rws.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
 func (rws *readWriteSeeker) Seek(offset int64, whence int) (int64, error) {
-	return rws.w.Seek(offset, whence)
+	target, err := seekTarget(rws.pos, offset, whence)
+	if err != nil {
+		return rws.pos, err
+	}
+	if target < 0 {
+		return rws.pos, fmt.Errorf("negative seek position %d", target)
+	}
+	if target < rws.pos {
+		if _, err := rws.w.Seek(rws.start, io.SeekStart); err != nil {
+			return rws.pos, err
+		}
+		if closer, ok := rws.r.(io.Closer); ok {
+			closer.Close()
+		}
+		r, err := rws.newReader(rws.w)
+		if err != nil {
+			return rws.pos, err
+		}
+		rws.r = r
+		rws.pos = 0
+	}
+	if _, err := io.CopyN(io.Discard, rws, target-rws.pos); err != nil && err != io.EOF {
+		return rws.pos, err
+	}
+	return rws.pos, nil
+}
+
+// Flush writes out the data the compressor of an archive being written
+// holds, so that the members added so far can be read from the file,
+// without ending the archive. xz archives get a new xz stream for that.
+// It fails for lzma and bzip2 archives, whose compressors cannot be
+// flushed, and does nothing for uncompressed ones. Members appended to a
+// compressed archive only reach the file when the TarFile is closed.
+func (tf *TarFile) Flush() error {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if err := tf.check("awx"); err != nil {
+		return err
+	}
+	if f, ok := tf.fileObj.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
 }
 
-// Close closes the TarFile.
-func (tf *TarFile) Close() error {
+// Close closes the TarFile. In write mode the end-of-archive blocks are
+// appended and, for compressed archives, the compressor is flushed.
+func (tf *TarFile) Close() (err error) {
 	if tf.closed {
 		return nil
 	}
 	tf.closed = true
 	defer func() {
-		if !tf.extFileObj {
-			if f, ok := tf.fileObj.(*os.File); ok {
-				f.Close()
+		if tf.extFileObj {
+			return
+		}
+		if a, ok := tf.fileObj.(aborter); ok && err != nil {
+			// Do not complete an archive whose end could not be written.
+			a.abort()
+		} else if c, ok := tf.fileObj.(io.Closer); ok {
+			if cerr := c.Close(); err == nil {
+				err = cerr
 			}
 		}
 	}()
@@ -322,7 +905,9 @@ func (tf *TarFile) GetMember(name string) (*TarInfo, error) {
 	tf.mu.Lock()
 	defer tf.mu.Unlock()
 
-	tf.check("r")
+	if err := tf.check("r"); err != nil {
+		return nil, err
+	}
 	tarinfo := tf.getMember(name)
 	if tarinfo == nil {
 		return nil, fmt.Errorf("member %q not found", name)
@@ -330,14 +915,38 @@ func (tf *TarFile) GetMember(name string) (*TarInfo, error) {
 	return tarinfo, nil
 }
 
+// LookupMember returns the member called name, the last one if the name
+// occurs more than once, and whether it was found. It reports false if
+// the archive is closed or not open for reading.
+func (tf *TarFile) LookupMember(name string) (*TarInfo, bool) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if tf.check("r") != nil {
+		return nil, false
+	}
+	tarinfo := tf.getMember(name)
+	return tarinfo, tarinfo != nil
+}
+
+// HasMember reports whether the archive has a member called name.
+func (tf *TarFile) HasMember(name string) bool {
+	_, ok := tf.LookupMember(name)
+	return ok
+}
+
 // GetMembers returns all members as a list of TarInfo objects.
 func (tf *TarFile) GetMembers() ([]*TarInfo, error) {
 	tf.mu.Lock()
 	defer tf.mu.Unlock()
 
-	tf.check("")
+	if err := tf.check(""); err != nil {
+		return nil, err
+	}
 	if !tf.loaded {
-		tf.load()
+		if err := tf.load(); err != nil {
+			return nil, err
+		}
 	}
 	// 返回副本避免外部修改
 	result := make([]*TarInfo, len(tf.members))
@@ -345,22 +954,118 @@ func (tf *TarFile) GetMembers() ([]*TarInfo, error) {
 	return result, nil
 }
 
-// GetNames returns the names of all members.
-func (tf *TarFile) GetNames() ([]string, error) {
-	members, err := tf.GetMembers()
-	if err != nil {
+// GetMemberAt returns the member at index i in archive order. Headers
+// are only read up to that member.
+func (tf *TarFile) GetMemberAt(i int) (*TarInfo, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if err := tf.check(""); err != nil {
 		return nil, err
 	}
-	names := make([]string, len(members))
-	for i, m := range members {
-		names[i] = m.Name
-	}
+	for !tf.stream && !tf.loaded && i >= len(tf.members) {
+		ti, err := tf.next()
+		if err != nil {
+			return nil, err
+		}
+		if ti == nil {
+			break
+		}
+	}
+	if i < 0 || i >= len(tf.members) {
+		return nil, fmt.Errorf("member index %d out of range [0, %d)", i, len(tf.members))
+	}
+	return tf.members[i], nil
+}
+
+// NumMembers returns the number of members of the archive.
+func (tf *TarFile) NumMembers() (int, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if err := tf.check(""); err != nil {
+		return 0, err
+	}
+	if !tf.loaded {
+		if err := tf.load(); err != nil {
+			return 0, err
+		}
+	}
+	return len(tf.members), nil
+}
+
+// GetNames returns the names of all members.
+func (tf *TarFile) GetNames() ([]string, error) {
+	members, err := tf.GetMembers()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(members))
+	for i, m := range members {
+		names[i] = m.Name
+	}
 	return names, nil
 }
 
-// GetTarInfo creates a TarInfo object from a file.
+// List writes the names of the members to w, one per line. If verbose is
+// true the lines look like the output of `tar -tv`, with the mode, owner,
+// size and modification time of each member and the target of links.
+func (tf *TarFile) List(w io.Writer, verbose bool) error {
+	members, err := tf.GetMembers()
+	if err != nil {
+		return err
+	}
+	for _, ti := range members {
+		var line strings.Builder
+		if verbose {
+			owner := ti.Uname
+			if owner == "" {
+				owner = strconv.Itoa(ti.UID)
+			}
+			group := ti.Gname
+			if group == "" {
+				group = strconv.Itoa(ti.GID)
+			}
+			size := strconv.FormatInt(ti.Size, 10)
+			if ti.IsChr() || ti.IsBlk() {
+				size = fmt.Sprintf("%d,%d", ti.DevMajor, ti.DevMinor)
+			}
+			fmt.Fprintf(&line, "%s %s/%s %10s %s ", filemode(ti), owner, group, size,
+				ti.Mtime.Local().Format("2006-01-02 15:04:05"))
+		}
+		line.WriteString(ti.Name)
+		if ti.IsDir() {
+			line.WriteString("/")
+		}
+		if verbose {
+			switch {
+			case ti.IsSym():
+				line.WriteString(" -> " + ti.Linkname)
+			case ti.IsLnk():
+				line.WriteString(" link to " + ti.Linkname)
+			}
+		}
+		line.WriteString("\n")
+		if _, err := io.WriteString(w, line.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hooks for statting the files that are added.
+var (
+	statFile  = syscall.Stat
+	lstatFile = syscall.Lstat
+)
+
+// GetTarInfo creates a TarInfo object from a file. For files that cannot
+// be archived, such as sockets, it returns a nil TarInfo, or an
+// UnsupportedTypeError if WithStrictTypes is set.
 func (tf *TarFile) GetTarInfo(name, arcname string, fileobj *os.File) (*TarInfo, error) {
-	tf.check("awx")
+	if err := tf.check("awx"); err != nil {
+		return nil, err
+	}
 	if fileobj != nil {
 		name = fileobj.Name()
 	}
@@ -374,12 +1079,12 @@ func (tf *TarFile) GetTarInfo(name, arcname string, fileobj *os.File) (*TarInfo,
 	var stat syscall.Stat_t
 	if fileobj == nil {
 		if tf.dereference {
-			err := syscall.Stat(name, &stat)
+			err := statFile(name, &stat)
 			if err != nil {
 				return nil, err
 			}
 		} else {
-			err := syscall.Lstat(name, &stat)
+			err := lstatFile(name, &stat)
 			if err != nil {
 				return nil, err
 			}
@@ -419,8 +1124,10 @@ func (tf *TarFile) GetTarInfo(name, arcname string, fileobj *os.File) (*TarInfo,
 		ti.Type = CHRTYPE
 	case stat.Mode&syscall.S_IFMT == syscall.S_IFBLK:
 		ti.Type = BLKTYPE
+	case stat.Mode&syscall.S_IFMT == syscall.S_IFSOCK:
+		return tf.unsupportedType(name, "socket")
 	default:
-		return nil, nil
+		return tf.unsupportedType(name, fmt.Sprintf("file of unknown type %#o", stat.Mode&syscall.S_IFMT))
 	}
 
 	ti.Name = arcname
@@ -433,18 +1140,160 @@ func (tf *TarFile) GetTarInfo(name, arcname string, fileobj *os.File) (*TarInfo,
 		ti.Size = 0
 	}
 	ti.Mtime = time.Unix(stat.Mtim.Sec, stat.Mtim.Nsec)
+	ti.Atime = time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+	ti.Ctime = time.Unix(stat.Ctim.Sec, stat.Ctim.Nsec)
 	ti.Linkname = linkname
-	// TODO: Set uname and gname using system calls if available
+	if u, err := user.LookupId(strconv.Itoa(ti.UID)); err == nil {
+		ti.Uname = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.Itoa(ti.GID)); err == nil {
+		ti.Gname = g.Name
+	}
 	if ti.Type == CHRTYPE || ti.Type == BLKTYPE {
 		ti.DevMajor = int(unix.Major(uint64(stat.Rdev)))
 		ti.DevMinor = int(unix.Minor(uint64(stat.Rdev)))
 	}
+	if tf.reproducible {
+		normalizeTarInfo(ti, tf.reproducibleTime)
+	}
+	if tf.contiguous != nil && ti.Type == REGTYPE && tf.contiguous(ti) {
+		ti.Type = CONTTYPE
+	}
+	if tf.sparse && tf.format == GNU_FORMAT && ti.Type == REGTYPE && ti.Size > 0 {
+		sparse, err := findSparseRegions(name, fileobj, ti.Size)
+		if err != nil {
+			return nil, err
+		}
+		ti.Sparse = sparse
+	}
 	return ti, nil
 }
 
+// findSparseRegions returns the data regions of the file name, or of
+// fileobj if it is not nil, whose size is size. It returns nil if the
+// file has no holes or the file system cannot tell where they are.
+func findSparseRegions(name string, fileobj *os.File, size int64) ([][2]int64, error) {
+	f := fileobj
+	if f == nil {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	} else {
+		pos, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Seek(pos, io.SeekStart)
+	}
+
+	var regions [][2]int64
+	fd := int(f.Fd())
+	for off := int64(0); off < size; {
+		start, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break // Only a hole is left.
+		} else if err != nil {
+			return nil, nil
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, nil
+		}
+		end = min(end, size)
+		regions = append(regions, [2]int64{start, end - start})
+		off = end
+	}
+	if len(regions) == 1 && regions[0] == [2]int64{0, size} {
+		return nil, nil
+	}
+	if regions == nil {
+		regions = [][2]int64{}
+	}
+	return regions, nil
+}
+
+// unsupportedType is the result of GetTarInfo for files that tar cannot
+// store: no TarInfo, and an UnsupportedTypeError if strictTypes is set.
+func (tf *TarFile) unsupportedType(name, kind string) (*TarInfo, error) {
+	if tf.strictTypes {
+		return nil, NewUnsupportedTypeError(name, kind)
+	}
+	return nil, nil
+}
+
+// normalizeTarInfo clears the attributes of ti that differ between
+// systems and runs, for reproducible archives.
+func normalizeTarInfo(ti *TarInfo, mtime time.Time) {
+	ti.UID, ti.GID = 0, 0
+	ti.Uname, ti.Gname = "", ""
+	ti.Mtime = mtime
+	ti.Atime, ti.Ctime = time.Time{}, time.Time{}
+	switch {
+	case ti.IsSym():
+		ti.Mode = 0777
+	case ti.IsDir() || ti.Mode&0111 != 0:
+		ti.Mode = 0755
+	default:
+		ti.Mode = 0644
+	}
+}
+
 // Add adds a file to the archive.
 func (tf *TarFile) Add(name, arcname string, recursive bool, filter func(*TarInfo) (*TarInfo, error)) error {
-	tf.check("awx")
+	return tf.AddContext(context.Background(), name, arcname, recursive, filter)
+}
+
+// AddContext is like Add but stops with the context's error once ctx is
+// done. The context is checked before each file is added.
+func (tf *TarFile) AddContext(ctx context.Context, name, arcname string, recursive bool, filter func(*TarInfo) (*TarInfo, error)) error {
+	if err := tf.check("awx"); err != nil {
+		return err
+	}
+	return tf.addTree(ctx, name, arcname, recursive, filter, func(ti *TarInfo, name string) error {
+		if !ti.IsReg() {
+			return tf.AddFile(ti, nil)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return tf.AddFile(ti, f)
+	})
+}
+
+// Plan returns the TarInfos that Add would write for the same arguments,
+// in the same order, without writing anything. Hard links are detected
+// as Add would detect them at this point, but the files seen are not
+// remembered for later calls.
+func (tf *TarFile) Plan(name, arcname string, recursive bool, filter func(*TarInfo) (*TarInfo, error)) ([]*TarInfo, error) {
+	if err := tf.check("awx"); err != nil {
+		return nil, err
+	}
+	inodes := tf.inodes
+	tf.inodes = maps.Clone(inodes)
+	defer func() { tf.inodes = inodes }()
+
+	var plan []*TarInfo
+	err := tf.addTree(context.Background(), name, arcname, recursive, filter, func(ti *TarInfo, name string) error {
+		plan = append(plan, ti)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// addTree creates the TarInfos for name and, if recursive, the contents
+// of the directory, and passes each one that the filter keeps to add with
+// the path of its file.
+func (tf *TarFile) addTree(ctx context.Context, name, arcname string, recursive bool, filter func(*TarInfo) (*TarInfo, error), add func(ti *TarInfo, name string) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if arcname == "" {
 		arcname = name
 	}
@@ -474,44 +1323,78 @@ func (tf *TarFile) Add(name, arcname string, recursive bool, filter func(*TarInf
 		}
 	}
 
-	if ti.IsReg() {
-		f, err := os.Open(name)
+	if err := add(ti, name); err != nil {
+		return err
+	}
+	if ti.IsDir() && recursive {
+		files, err := os.ReadDir(name)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-		return tf.AddFile(ti, f)
-	} else if ti.IsDir() {
-		if err := tf.AddFile(ti, nil); err != nil {
-			return err
-		}
-		if recursive {
-			files, err := os.ReadDir(name)
+		sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+		for _, fi := range files {
+			child := filepath.Join(name, fi.Name())
+			if tf.shouldInclude != nil && !tf.shouldInclude(child, fi) {
+				tf.dbg(2, fmt.Sprintf("tarfile: Excluded %q", child))
+				continue
+			}
+			err := tf.addTree(ctx, child, filepath.Join(arcname, fi.Name()), recursive, filter, add)
 			if err != nil {
 				return err
 			}
-			sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
-			for _, fi := range files {
-				err := tf.Add(filepath.Join(name, fi.Name()), filepath.Join(arcname, fi.Name()), recursive, filter)
-				if err != nil {
-					return err
-				}
-			}
 		}
-	} else {
-		return tf.AddFile(ti, nil)
 	}
 	return nil
 }
 
-// AddFile adds a TarInfo object to the archive.
+// AddFile adds a TarInfo object to the archive. For members with data,
+// fileobj must yield at least tarinfo.Size bytes; a ReadError is returned
+// if it ends early. A TarInfo with a Sparse map is written as a GNU sparse
+// member holding only its data regions, which must be sorted; fileobj
+// still yields the whole file. Its regions are widened to whole blocks
+// as GNU tar does and tarinfo.Sparse is set to the map written.
 func (tf *TarFile) AddFile(tarinfo *TarInfo, fileobj io.Reader) error {
-	tf.check("awx")
+	if err := tf.check("awx"); err != nil {
+		return err
+	}
 	if fileobj == nil && tarinfo.IsReg() && tarinfo.Size != 0 {
 		return fmt.Errorf("fileobj not provided for non zero-size regular file")
 	}
 
-	ti := tarinfo // Shallow copy in Go (struct is copied)
+	// The archive keeps a copy, so that changing tarinfo later, or the
+	// size set by the data encoder, does not change the member.
+	ti := tarinfo.clone()
+	if hasControlChars(ti.Name) || hasControlChars(ti.Linkname) {
+		tf.dbg(1, fmt.Sprintf("tarfile: Warning: %q contains control characters", ti.Name))
+	}
+	if tf.dataEncoder != nil && fileobj != nil && ti.IsReg() {
+		if ti.IsSparse() {
+			return fmt.Errorf("%s: sparse files cannot be encoded", ti.Name)
+		}
+		encoded, err := tf.encodeData(ti, fileobj)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(encoded.Name())
+		defer encoded.Close()
+		fileobj = encoded
+	}
+	if ti.IsSparse() && tf.format == GNU_FORMAT {
+		// Record the map as it is stored, which is the one read back.
+		sparse, err := ti.gnuSparseMap()
+		if err != nil {
+			return err
+		}
+		ti.Sparse = sparse
+		tarinfo.Sparse = sparse
+	}
+	var total int64
+	if fileobj != nil {
+		total = ti.dataSize()
+	}
+	reporter := newProgressReporter(tf.progress, total)
+	defer reporter.wait()
+
 	buf, err := ti.ToBuf(tf.format, tf.encoding, tf.errors)
 	if err != nil {
 		return err
@@ -521,11 +1404,21 @@ func (tf *TarFile) AddFile(tarinfo *TarInfo, fileobj io.Reader) error {
 	}
 	tf.offset += int64(len(buf))
 
-	if fileobj != nil {
-		if _, err := io.CopyN(tf.fileObj, fileobj, ti.Size); err != nil {
+	if fileobj != nil && ti.IsSparse() {
+		if err := tf.addSparseData(ti, fileobj, reporter.reader(ti, fileobj)); err != nil {
+			return err
+		}
+	} else if fileobj != nil {
+		if n, err := io.CopyN(tf.fileObj, reporter.reader(ti, fileobj), ti.Size); err != nil {
+			tf.offset += n
+			if err == io.EOF {
+				return NewReadError(fmt.Sprintf("%s: unexpected end of data, expected %d bytes, got %d", ti.Name, ti.Size, n))
+			}
 			return err
 		}
-		blocks, remainder := divmod(ti.Size, BLOCKSIZE)
+	}
+	if fileobj != nil {
+		blocks, remainder := divmod(ti.dataSize(), BLOCKSIZE)
 		if remainder > 0 {
 			_, err := tf.fileObj.Write(make([]byte, BLOCKSIZE-remainder))
 			if err != nil {
@@ -536,99 +1429,520 @@ func (tf *TarFile) AddFile(tarinfo *TarInfo, fileobj io.Reader) error {
 		tf.offset += blocks * BLOCKSIZE
 	}
 
-	tf.members = append(tf.members, ti)
+	tf.addMember(ti)
+	reporter.complete(ti)
 	return nil
 }
 
-// Next returns the next member of the archive.
-func (tf *TarFile) Next() (*TarInfo, error) {
-	tf.mu.Lock()
-	defer tf.mu.Unlock()
-
-	return tf.next()
-}
-
-// Helper methods
-
-func (tf *TarFile) getMember(name string) *TarInfo {
-	members, _ := tf.GetMembers()
-	for i := len(members) - 1; i >= 0; i-- {
-		m := members[i]
-		if name == m.Name {
-			return m
+// encodeData writes the first ti.Size bytes of fileobj through the data
+// encoder to a temporary file, sets ti.Size to the size of the encoded
+// data and returns the file positioned at its start.
+func (tf *TarFile) encodeData(ti *TarInfo, fileobj io.Reader) (*os.File, error) {
+	tmp, err := os.CreateTemp("", "gtarfile-")
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	w := tf.dataEncoder(tmp)
+	if n, err := io.CopyN(w, fileobj, ti.Size); err != nil {
+		if err == io.EOF {
+			err = NewReadError(fmt.Sprintf("%s: unexpected end of data, expected %d bytes, got %d", ti.Name, ti.Size, n))
 		}
+		return fail(err)
 	}
-	return nil
+	if err := w.Close(); err != nil {
+		return fail(err)
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	ti.Size = size
+	return tmp, nil
 }
 
-func (tf *TarFile) load() {
-	if !tf.stream {
-		for {
-			ti, err := tf.next() // 调用内部方法，不获取锁
+// addSparseData writes the data regions of the sparse member ti, read
+// from fileobj holding its whole contents, to the archive. The holes are
+// skipped by seeking if fileobj is an io.Seeker; r is fileobj with
+// progress reporting and is used for the data regions.
+func (tf *TarFile) addSparseData(ti *TarInfo, fileobj, r io.Reader) error {
+	var pos, written int64
+	for _, region := range ti.Sparse {
+		if hole := region[0] - pos; hole > 0 {
+			var err error
+			if seeker, ok := fileobj.(io.Seeker); ok {
+				_, err = seeker.Seek(hole, io.SeekCurrent)
+			} else {
+				_, err = io.CopyN(io.Discard, fileobj, hole)
+			}
 			if err != nil {
-				break // 或根据错误类型处理
+				tf.offset += written
+				if err == io.EOF {
+					return NewReadError(fmt.Sprintf("%s: unexpected end of data", ti.Name))
+				}
+				return err
 			}
-			if ti == nil {
-				break
+		}
+		n, err := io.CopyN(tf.fileObj, r, region[1])
+		written += n
+		if err != nil {
+			tf.offset += written
+			if err == io.EOF {
+				return NewReadError(fmt.Sprintf("%s: unexpected end of data, expected %d bytes at offset %d, got %d", ti.Name, region[1], region[0], n))
 			}
+			return err
 		}
-		tf.loaded = true
+		pos = region[0] + region[1]
 	}
+	return nil
 }
 
-func (tf *TarFile) check(mode string) error {
-	if tf.closed {
-		return fmt.Errorf("TarFile is closed")
+// AddBytes adds a regular file called name holding data to the archive
+// and returns the TarInfo that was written. The member's mtime is the
+// current time.
+func (tf *TarFile) AddBytes(name string, data []byte, mode int64) (*TarInfo, error) {
+	if err := tf.check("awx"); err != nil {
+		return nil, err
 	}
-	if mode != "" && !strings.Contains(mode, tf.mode) {
-		return fmt.Errorf("bad operation for mode %q", tf.mode)
+	ti := tf.tarInfo()
+	ti.Name = name
+	ti.Type = REGTYPE
+	ti.Size = int64(len(data))
+	ti.Mode = mode
+	ti.Mtime = time.Now()
+	if err := tf.AddFile(ti, bytes.NewReader(data)); err != nil {
+		return nil, err
 	}
-	return nil
+	return ti, nil
 }
 
-func (tf *TarFile) dbg(level int, msg string) {
-	if level <= tf.debug {
-		fmt.Fprintf(os.Stderr, "%s\n", msg)
+// AddReader adds a regular file called name to the archive whose data are
+// the next size bytes read from r. It fails if r ends early. The opts are
+// applied to the new TarInfo, which defaults to mode 0644 and the current
+// time as mtime, to set further fields such as Mode, Mtime or Uname.
+func (tf *TarFile) AddReader(name string, r io.Reader, size int64, opts ...func(*TarInfo)) error {
+	if err := tf.check("awx"); err != nil {
+		return err
+	}
+	ti := tf.tarInfo()
+	ti.Name = name
+	ti.Type = REGTYPE
+	ti.Mode = 0644
+	ti.Mtime = time.Now()
+	for _, opt := range opts {
+		opt(ti)
 	}
+	ti.Size = size
+	return tf.AddFile(ti, r)
 }
 
-// Utility functions
+// CopyMemberFrom copies member, a member of the archive src opened for
+// reading, with its data into tf. The header is written anew in the
+// format of tf, so names that need a GNU long name or a PAX record are
+// stored the way tf stores them. Sparse members are copied with their
+// holes filled in.
+func (tf *TarFile) CopyMemberFrom(src *TarFile, member *TarInfo) error {
+	if err := tf.check("awx"); err != nil {
+		return err
+	}
+	ti := copyTarInfo(member)
+	if !ti.IsReg() || ti.Size == 0 {
+		return tf.AddFile(ti, nil)
+	}
 
-func fileExists(name string) bool {
-	_, err := os.Stat(name)
-	return err == nil
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := src.WriteMemberTo(member, pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err := tf.AddFile(ti, pr)
+	// Stop the copy if writing failed early, and wait for it to return.
+	pr.Close()
+	if copyErr := <-done; err == nil {
+		err = copyErr
+	}
+	return err
 }
 
-func osMode(mode string) int {
-	switch mode {
-	case "rb":
-		return os.O_RDONLY
-	case "r+b":
-		return os.O_RDWR
-	case "wb":
-		return os.O_WRONLY | os.O_CREATE | os.O_TRUNC
-	case "xb":
-		return os.O_WRONLY | os.O_CREATE | os.O_EXCL
+// copyTarInfo returns a copy of member to be written to another archive.
+// The PAX records that only describe fields of the TarInfo are dropped,
+// they are written again as the format of the new archive needs them, and
+// sparse members become regular files.
+func copyTarInfo(member *TarInfo) *TarInfo {
+	ti := *member
+	ti.Offset, ti.OffsetData = 0, 0
+	ti.tarfile = nil
+	ti.PaxHeaders = make(map[string]string, len(member.PaxHeaders))
+	for k, v := range member.PaxHeaders {
+		switch {
+		case k == "path", k == "linkpath", k == "size", k == "uid", k == "gid",
+			k == "uname", k == "gname", k == "mtime", k == "atime", k == "ctime",
+			k == "hdrcharset", strings.HasPrefix(k, "GNU.sparse."):
+			continue
+		}
+		ti.PaxHeaders[k] = v
 	}
-	return 0
+	if member.Xattrs != nil {
+		ti.Xattrs = make(map[string][]byte, len(member.Xattrs))
+		for k, v := range member.Xattrs {
+			ti.Xattrs[k] = append([]byte(nil), v...)
+		}
+	}
+	if ti.IsSparse() || ti.Type == GNUTYPE_SPARSE {
+		ti.Type = REGTYPE
+	}
+	ti.Sparse = nil
+	ti.sparseExtended = false
+	ti.origSize = 0
+	return &ti
 }
 
-func tell(r io.Seeker) int64 {
-	pos, _ := r.Seek(0, io.SeekCurrent)
-	return pos
-}
+// UpdateMemberHeader writes the header of member again with its current
+// fields, for example to change its mode or owner without repacking the
+// archive. member must have been read from the archive, which must be an
+// uncompressed archive opened in mode "a". The type and size of the
+// member cannot be changed, and the new header must take up as many
+// blocks as the old one, so changes that would need a longer extended
+// header are rejected. PaxHeaders are written as they are, except for
+// the keys that are set from the fields of member.
+func (tf *TarFile) UpdateMemberHeader(member *TarInfo) error {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
 
-// 公开的访问器方法，提供并发安全的字段访问
+	if err := tf.check("a"); err != nil {
+		return err
+	}
+	if _, ok := tf.fileObj.(*writeCloser); ok {
+		return NewCompressionError("cannot update headers of a compressed archive")
+	}
+	if !slices.Contains(tf.members, member) {
+		return fmt.Errorf("%q is not a member of the archive", member.Name)
+	}
+	if member.IsSparse() {
+		return fmt.Errorf("cannot update the header of sparse file %q", member.Name)
+	}
+	// New members are written at the current offset.
+	offset := tf.offset
+	defer func() {
+		tf.offset = offset
+		tf.fileObj.Seek(offset, io.SeekStart)
+	}()
 
-// GetName returns the name of the tar file
-func (tf *TarFile) GetName() string {
-	tf.mu.RLock()
-	defer tf.mu.RUnlock()
-	return tf.name
+	if _, err := tf.fileObj.Seek(member.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	tf.offset = member.Offset
+	orig, err := tf.tarInfo().FromTarFile(tf)
+	if err != nil {
+		return NewReadError(err.Error())
+	}
+	if orig.Type != member.Type || orig.Size != member.Size {
+		return fmt.Errorf("cannot change the type or size of %q", member.Name)
+	}
+
+	// Keys such as "uname" read from the old header would override the
+	// changed fields.
+	buf, err := copyTarInfo(member).ToBuf(tf.format, tf.encoding, tf.errors)
+	if err != nil {
+		return err
+	}
+	// A longer header would overwrite the data, a shorter one would leave
+	// the end of the old header in front of it.
+	if size := orig.OffsetData - member.Offset; int64(len(buf)) != size {
+		return fmt.Errorf("the header of %q would be %d bytes long instead of %d", member.Name, len(buf), size)
+	}
+	if _, err := tf.fileObj.Seek(member.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = tf.fileObj.Write(buf)
+	return err
 }
 
-// GetMode returns the mode of the tar file
-func (tf *TarFile) GetMode() string {
+// Next returns the next member of the archive, or nil at the end of the
+// archive. NextHeader returns io.EOF at the end instead.
+func (tf *TarFile) Next() (*TarInfo, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	return tf.next()
+}
+
+// NextHeader is like Next, but returns io.EOF at the end of the archive
+// instead of a nil member, like Next of archive/tar.Reader:
+//
+//	for {
+//		ti, err := tf.NextHeader()
+//		if err == io.EOF {
+//			break
+//		}
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+func (tf *TarFile) NextHeader() (*TarInfo, error) {
+	tarinfo, err := tf.Next()
+	if err == nil && tarinfo == nil {
+		return nil, io.EOF
+	}
+	return tarinfo, err
+}
+
+// Members iterates over the members of the archive, reading headers only
+// as they are needed:
+//
+//	for ti := range tf.Members {
+//		...
+//	}
+//
+// Members that were already read are yielded from memory. In stream mode
+// every member is read from the stream as it is reached. Iteration ends
+// at the end of the archive or on the first read error; use Next to
+// inspect errors.
+func (tf *TarFile) Members(yield func(*TarInfo) bool) {
+	for index := 0; ; index++ {
+		tarinfo, err := tf.memberAt(index)
+		if err != nil || tarinfo == nil {
+			return
+		}
+		if !yield(tarinfo) {
+			return
+		}
+	}
+}
+
+// Walk calls fn for each member of the archive in order, with a reader of
+// the member's data that is only valid during the call. Members other than
+// regular files have no data, and the holes of sparse files read as zeros.
+// Walk stops and returns the first error from reading the archive or from
+// fn, unless fn returns SkipMember.
+func (tf *TarFile) Walk(fn func(*TarInfo, io.Reader) error) error {
+	for index := 0; ; index++ {
+		member, err := tf.memberAt(index)
+		if err != nil {
+			return err
+		}
+		if member == nil {
+			return nil
+		}
+		var r io.Reader = strings.NewReader("")
+		var ef *ExFileObject
+		if member.IsReg() {
+			ef = tf.fileObject(tf, member)
+			r = ef
+			if member.IsSparse() {
+				r = &sparseReader{data: ef, sparse: member.Sparse, size: member.Size}
+			}
+		}
+		err = fn(member, r)
+		if ef != nil {
+			ef.Close()
+		}
+		if err != nil && err != SkipMember {
+			return err
+		}
+	}
+}
+
+// sparseReader reads the data of a sparse member from the data regions
+// stored in the archive, with zeros for the holes between them.
+type sparseReader struct {
+	data   io.Reader  // The stored data regions
+	sparse [][2]int64 // Regions not read yet
+	size   int64      // Size of the member
+	pos    int64
+}
+
+func (sr *sparseReader) Read(p []byte) (int, error) {
+	if sr.pos >= sr.size {
+		return 0, io.EOF
+	}
+	for len(sr.sparse) > 0 && sr.sparse[0][0]+sr.sparse[0][1] <= sr.pos {
+		sr.sparse = sr.sparse[1:]
+	}
+	// Read zeros up to the next region, or to the end of the member.
+	next := sr.size
+	if len(sr.sparse) > 0 {
+		next = sr.sparse[0][0]
+	}
+	if sr.pos < next {
+		n := int(min(int64(len(p)), next-sr.pos))
+		clear(p[:n])
+		sr.pos += int64(n)
+		return n, nil
+	}
+	end := min(sr.sparse[0][0]+sr.sparse[0][1], sr.size)
+	n, err := sr.data.Read(p[:min(int64(len(p)), end-sr.pos)])
+	sr.pos += int64(n)
+	if sr.pos >= end {
+		sr.sparse = sr.sparse[1:]
+	}
+	if err == io.EOF {
+		if sr.pos < end {
+			return n, NewReadError("unexpected end of data")
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// Helper methods
+
+// memberAt returns the member at index, reading further headers if it
+// has not been reached yet. It returns nil past the end of the archive.
+// Members are not kept in stream mode, so there it always returns the
+// next member of the stream.
+func (tf *TarFile) memberAt(index int) (*TarInfo, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if err := tf.check("ra"); err != nil {
+		return nil, err
+	}
+	if !tf.stream {
+		if index < len(tf.members) {
+			if tf.members[index] == tf.firstMember {
+				tf.firstMember = nil
+			}
+			return tf.members[index], nil
+		}
+		if tf.loaded {
+			return nil, nil
+		}
+	}
+	return tf.next()
+}
+
+func (tf *TarFile) getMember(name string) *TarInfo {
+	members, _ := tf.getMembers()
+	if !tf.loaded {
+		for i := len(members) - 1; i >= 0; i-- {
+			m := members[i]
+			if name == m.Name {
+				return m
+			}
+		}
+		return nil
+	}
+	if tf.memberIndex == nil {
+		tf.memberIndex = make(map[string]*TarInfo, len(members))
+		for _, m := range members {
+			tf.memberIndex[m.Name] = m
+		}
+	}
+	return tf.memberIndex[name]
+}
+
+// addMember appends ti to the members and keeps the index up to date.
+// Later members replace earlier ones of the same name in the index.
+func (tf *TarFile) addMember(ti *TarInfo) {
+	tf.members = append(tf.members, ti)
+	if tf.memberIndex != nil {
+		tf.memberIndex[ti.Name] = ti
+	}
+}
+
+// load reads all members. Read errors end the archive early, only a
+// MemberLimitError is returned.
+func (tf *TarFile) load() error {
+	return tf.loadContext(context.Background())
+}
+
+// loadContext reads all members like load, checking ctx before each one.
+func (tf *TarFile) loadContext(ctx context.Context) error {
+	if !tf.stream {
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			ti, err := tf.next() // 调用内部方法，不获取锁
+			if err != nil {
+				switch err.(type) {
+				case *MemberLimitError, *InvalidHeaderError:
+					return err
+				}
+				if _, ok := err.(*ReadError); ok && tf.strictPadding {
+					return err
+				}
+				break // 或根据错误类型处理
+			}
+			if ti == nil {
+				break
+			}
+		}
+		tf.loaded = true
+	}
+	return nil
+}
+
+func (tf *TarFile) check(mode string) error {
+	if tf.closed {
+		return fmt.Errorf("TarFile is closed")
+	}
+	if mode != "" && !strings.Contains(mode, tf.mode) {
+		return fmt.Errorf("bad operation for mode %q", tf.mode)
+	}
+	return nil
+}
+
+func (tf *TarFile) dbg(level int, msg string) {
+	if level <= tf.debug {
+		fmt.Fprintf(os.Stderr, "%s\n", msg)
+	}
+}
+
+// Utility functions
+
+// hasControlChars reports whether s contains ASCII control characters,
+// such as newlines, which are valid in names but easily misread.
+func hasControlChars(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func osMode(mode string) int {
+	switch mode {
+	case "rb":
+		return os.O_RDONLY
+	case "r+b":
+		return os.O_RDWR
+	case "wb":
+		return os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case "xb":
+		return os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+	return 0
+}
+
+func tell(r io.Seeker) int64 {
+	pos, _ := r.Seek(0, io.SeekCurrent)
+	return pos
+}
+
+// 公开的访问器方法，提供并发安全的字段访问
+
+// GetName returns the name of the tar file
+func (tf *TarFile) GetName() string {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	return tf.name
+}
+
+// GetMode returns the mode of the tar file
+func (tf *TarFile) GetMode() string {
 	tf.mu.RLock()
 	defer tf.mu.RUnlock()
 	return tf.mode
@@ -669,7 +1983,12 @@ func (tf *TarFile) GetIgnoreZeros() bool {
 	return tf.ignoreZeros
 }
 
-// SetIgnoreZeros sets the ignore zeros setting
+// SetIgnoreZeros sets the ignore zeros setting. By default reading ends
+// at the first zero block, so padding or signatures appended after the
+// end-of-archive blocks are never read. With ignoreZeros true, zero and
+// invalid blocks are skipped instead, to read concatenated archives, and
+// headers are looked for after member data without padding as with
+// WithTolerant.
 func (tf *TarFile) SetIgnoreZeros(ignoreZeros bool) {
 	tf.mu.Lock()
 	defer tf.mu.Unlock()
@@ -683,13 +2002,24 @@ func (tf *TarFile) GetErrorLevel() int {
 	return tf.errorLevel
 }
 
-// SetErrorLevel sets the error level
+// SetErrorLevel sets the error level. At level 0 all extraction errors are
+// ignored, at level 1 only non-fatal ones such as failures to set
+// attributes are, and from level 2 on every error is returned. Extraction
+// errors are returned as *ExtractError.
 func (tf *TarFile) SetErrorLevel(level int) {
 	tf.mu.Lock()
 	defer tf.mu.Unlock()
 	tf.errorLevel = level
 }
 
+// GetSkippedErrors returns the errors that the last Extract or ExtractAll
+// call ignored because of the error level.
+func (tf *TarFile) GetSkippedErrors() []error {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	return append([]error(nil), tf.skippedErrors...)
+}
+
 // GetFormat returns the archive format
 func (tf *TarFile) GetFormat() int {
 	tf.mu.RLock()
@@ -753,6 +2083,97 @@ func (tf *TarFile) SetPaxHeaders(headers map[string]string) {
 	}
 }
 
+// GetPreserveOwner returns whether extraction restores ownership
+func (tf *TarFile) GetPreserveOwner() bool {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	return tf.preserveOwner
+}
+
+// SetPreserveOwner sets whether extraction restores ownership
+func (tf *TarFile) SetPreserveOwner(preserve bool) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	tf.preserveOwner = preserve
+}
+
+// GetNumericOwner returns whether ownership is restored from uid/gid only
+func (tf *TarFile) GetNumericOwner() bool {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	return tf.numericOwner
+}
+
+// SetNumericOwner sets whether ownership is restored from uid/gid only
+func (tf *TarFile) SetNumericOwner(numeric bool) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	tf.numericOwner = numeric
+}
+
+// GetPreserveXattrs returns whether extraction restores extended attributes
+func (tf *TarFile) GetPreserveXattrs() bool {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	return tf.preserveXattrs
+}
+
+// SetPreserveXattrs sets whether extraction restores extended attributes
+func (tf *TarFile) SetPreserveXattrs(preserve bool) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	tf.preserveXattrs = preserve
+}
+
+// GetStrictTypes returns whether adding files of unsupported types fails
+func (tf *TarFile) GetStrictTypes() bool {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	return tf.strictTypes
+}
+
+// SetStrictTypes sets whether adding files of unsupported types fails
+func (tf *TarFile) SetStrictTypes(strict bool) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	tf.strictTypes = strict
+}
+
+// GetPreserveAttrs returns whether extraction restores member attributes
+func (tf *TarFile) GetPreserveAttrs() bool {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	return tf.preserveAttrs
+}
+
+// SetPreserveAttrs sets whether extraction restores member attributes
+func (tf *TarFile) SetPreserveAttrs(preserve bool) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	tf.preserveAttrs = preserve
+}
+
+// GetOverwrite returns the overwrite policy for extraction
+func (tf *TarFile) GetOverwrite() int {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	return tf.overwrite
+}
+
+// SetOverwrite sets the overwrite policy for extraction
+func (tf *TarFile) SetOverwrite(policy int) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	tf.overwrite = policy
+}
+
+// SetExtractionFilter sets the filter applied to each member before extraction
+func (tf *TarFile) SetExtractionFilter(filter func(*TarInfo, string) (*TarInfo, error)) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	tf.extractionFilter = filter
+}
+
 // IsClosed returns whether the archive is closed
 func (tf *TarFile) IsClosed() bool {
 	tf.mu.RLock()
@@ -783,52 +2204,87 @@ func (tf *TarFile) IsStream() bool {
 
 // next is the internal implementation without locking (assumes lock is held)
 func (tf *TarFile) next() (*TarInfo, error) {
-	tf.check("ra")
+	if err := tf.check("ra"); err != nil {
+		return nil, err
+	}
 	if tf.firstMember != nil {
 		m := tf.firstMember
 		tf.firstMember = nil
 		return m, nil
 	}
+	if tf.stream && tf.loaded {
+		// The end of a stream cannot be read again.
+		return nil, nil
+	}
 
 	if tf.offset != tell(tf.fileObj) {
 		if tf.offset == 0 {
 			return nil, nil
 		}
-		if _, err := tf.fileObj.Seek(tf.offset-1, io.SeekStart); err != nil {
-			return nil, err
-		}
-		b := make([]byte, 1)
-		if _, err := tf.fileObj.Read(b); err != nil {
-			return nil, NewReadError("unexpected end of data")
+		if tf.strictPadding && tf.dataEnd > 0 && tf.dataEnd < tf.offset {
+			if err := tf.checkPadding(); err != nil {
+				return nil, err
+			}
+		} else {
+			if _, err := tf.fileObj.Seek(tf.offset-1, io.SeekStart); err != nil {
+				return nil, err
+			}
+			b := make([]byte, 1)
+			if _, err := tf.fileObj.Read(b); err != nil {
+				return nil, NewReadError("unexpected end of data")
+			}
 		}
 	}
 
 	var tarinfo *TarInfo
+	realign := (tf.tolerant || tf.ignoreZeros) && !tf.stream && tf.dataEnd > 0
 	for {
+		// Reading extended headers moves the offset, so errors are told
+		// apart by where the member starts.
+		start := tf.offset
 		ti, err := tf.tarInfo().FromTarFile(tf)
 		if err != nil {
+			if _, ok := err.(*InvalidHeaderError); ok && realign {
+				// Look for the header once, right after the data.
+				realign = false
+				if offset, found := tf.findHeader(tf.dataEnd, tf.offset); found {
+					tf.dbg(2, fmt.Sprintf("0x%X: %s, found header at 0x%X", tf.offset, err, offset))
+					if _, err := tf.fileObj.Seek(offset, io.SeekStart); err != nil {
+						return nil, err
+					}
+					tf.offset = offset
+					continue
+				}
+				// Go on after the invalid header as before.
+				if _, err := tf.fileObj.Seek(tf.offset+BLOCKSIZE, io.SeekStart); err != nil {
+					return nil, err
+				}
+			}
 			switch e := err.(type) {
 			case *EOFHeaderError:
-				if tf.ignoreZeros {
+				// At the end of the file there is no zero block to skip.
+				if tf.ignoreZeros && tell(tf.fileObj) > tf.offset {
 					tf.dbg(2, fmt.Sprintf("0x%X: %s", tf.offset, e))
 					tf.offset += BLOCKSIZE
 					continue
 				}
+				// The archive ends here; whatever follows the zero
+				// block is not part of it.
 			case *InvalidHeaderError:
 				if tf.ignoreZeros {
 					tf.dbg(2, fmt.Sprintf("0x%X: %s", tf.offset, e))
 					tf.offset += BLOCKSIZE
 					continue
 				}
-				if tf.offset == 0 {
+				if start == 0 {
 					return nil, NewReadError(e.Error())
 				}
 			case *EmptyHeaderError:
-				if tf.offset == 0 {
+				if start == 0 {
 					return nil, NewReadError("empty file")
 				}
 			case *TruncatedHeaderError:
-				if tf.offset == 0 {
+				if start == 0 {
 					return nil, NewReadError(e.Error())
 				}
 			case *SubsequentHeaderError:
@@ -841,28 +2297,107 @@ func (tf *TarFile) next() (*TarInfo, error) {
 		break
 	}
 
-	if tarinfo != nil && !tf.stream {
-		tf.members = append(tf.members, tarinfo)
-	} else {
+	// On the errors below the offset goes back to the header, so that
+	// reading on fails the same way instead of ending the archive early.
+	if tarinfo != nil && tf.fileSize >= 0 {
+		if end := tarinfo.OffsetData + tarinfo.dataSize(); end > tf.fileSize {
+			tf.offset = tarinfo.Offset
+			return nil, NewInvalidHeaderError(fmt.Sprintf("%s: data ends at offset %d beyond the end of the archive at %d", tarinfo.Name, end, tf.fileSize))
+		}
+	}
+
+	if tarinfo != nil && tf.maxMembers > 0 && tf.memberCount >= tf.maxMembers {
+		tf.offset = tarinfo.Offset
+		return nil, NewMemberLimitError(tf.maxMembers)
+	}
+
+	if tarinfo == nil {
 		tf.loaded = true
+	} else {
+		tf.memberCount++
+		tf.dataEnd = tarinfo.OffsetData + tarinfo.dataSize()
+		if !tf.stream {
+			tf.addMember(tarinfo)
+		}
 	}
 	return tarinfo, nil
 }
 
+// findHeader looks for a valid header at the offsets within a record
+// from start, except at skip, where the header was found to be invalid.
+func (tf *TarFile) findHeader(start, skip int64) (int64, bool) {
+	buf := make([]byte, RECORDSIZE+BLOCKSIZE)
+	if _, err := tf.fileObj.Seek(start, io.SeekStart); err != nil {
+		return 0, false
+	}
+	n, _ := io.ReadFull(tf.fileObj, buf)
+	for i := 0; i+BLOCKSIZE <= n && i < RECORDSIZE; i++ {
+		if start+int64(i) == skip {
+			continue
+		}
+		if _, err := FromBuf(buf[i:i+BLOCKSIZE], tf.encoding, tf.errors); err == nil {
+			return start + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+// checkPadding reads the padding between the data of the member read
+// last and the next header and checks that it is zero.
+func (tf *TarFile) checkPadding() error {
+	if _, err := tf.fileObj.Seek(tf.dataEnd, io.SeekStart); err != nil {
+		return err
+	}
+	padding := make([]byte, tf.offset-tf.dataEnd)
+	if _, err := io.ReadFull(tf.fileObj, padding); err != nil {
+		return NewReadError("unexpected end of data")
+	}
+	if bytes.Count(padding, []byte{NUL}) != len(padding) {
+		return NewReadError(fmt.Sprintf("0x%X: padding after member data is not zero", tf.dataEnd))
+	}
+	return nil
+}
+
 // Extract extracts a member from the archive to the specified path
 func (tf *TarFile) Extract(member *TarInfo, path string) error {
+	var reporter *progressReporter
+	defer func() { reporter.wait() }()
 	tf.mu.Lock()
 	defer tf.mu.Unlock()
 
 	if err := tf.check("r"); err != nil {
 		return err
 	}
+	reporter = newProgressReporter(tf.progress, regularSize([]*TarInfo{member}))
+	tf.reporter = reporter
+	defer func() { tf.reporter = nil }()
 
-	return tf.extractMember(member, path)
+	tf.skippedErrors = nil
+	tf.extractedSize = 0
+	ti, err := tf.filterMember(member, path)
+	if err != nil {
+		return tf.handleExtractError(member, path, err)
+	}
+	if ti == nil {
+		return nil
+	}
+	if keep, err := tf.keepExisting(ti, path); keep || err != nil {
+		return tf.handleExtractError(ti, path, err)
+	}
+	return tf.handleExtractError(ti, path, tf.extractMember(ti, path, true))
 }
 
 // ExtractAll extracts all members from the archive to the specified path
 func (tf *TarFile) ExtractAll(path string) error {
+	return tf.ExtractAllContext(context.Background(), path)
+}
+
+// ExtractAllContext is like ExtractAll but stops with the context's error
+// once ctx is done. The context is checked before each member is read and
+// extracted, so members extracted until then are left in place.
+func (tf *TarFile) ExtractAllContext(ctx context.Context, path string) error {
+	var reporter *progressReporter
+	defer func() { reporter.wait() }()
 	tf.mu.Lock()
 	defer tf.mu.Unlock()
 
@@ -870,23 +2405,333 @@ func (tf *TarFile) ExtractAll(path string) error {
 		return err
 	}
 
-	members, err := tf.getMembers()
-	if err != nil {
-		return err
+	if !tf.loaded {
+		if err := tf.loadContext(ctx); err != nil {
+			return err
+		}
+	}
+	reporter = newProgressReporter(tf.progress, regularSize(tf.members))
+	return tf.extractMembers(ctx, tf.members, path, reporter)
+}
+
+// GetMembersMatching returns the members whose names match pattern, in
+// archive order. The pattern has the syntax of path.Match and is matched
+// against the cleaned, slash-separated member names, so "*.txt" only
+// matches files at the top of the archive.
+func (tf *TarFile) GetMembersMatching(pattern string) ([]*TarInfo, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if err := tf.check(""); err != nil {
+		return nil, err
+	}
+	members, err := tf.getMembers()
+	if err != nil {
+		return nil, err
+	}
+	return matchMembers(members, pattern, false)
+}
+
+// ExtractMatching extracts the members whose names match pattern to
+// path, like ExtractAll. Matching is done as by GetMembersMatching, and
+// the contents of matching directories are extracted as well.
+func (tf *TarFile) ExtractMatching(pattern, path string) error {
+	var reporter *progressReporter
+	defer func() { reporter.wait() }()
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if err := tf.check("r"); err != nil {
+		return err
+	}
+	members, err := tf.getMembers()
+	if err != nil {
+		return err
 	}
+	matches, err := matchMembers(members, pattern, true)
+	if err != nil {
+		return err
+	}
+	reporter = newProgressReporter(tf.progress, regularSize(matches))
+	return tf.extractMembers(context.Background(), matches, path, reporter)
+}
 
+// matchMembers returns the members whose cleaned names match pattern. If
+// withContents is true the members below matching directories are
+// included as well.
+func matchMembers(members []*TarInfo, pattern string, withContents bool) ([]*TarInfo, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	var matches []*TarInfo
+	var dirs []string
+	for _, ti := range members {
+		name := path.Clean(ti.Name)
+		ok, _ := path.Match(pattern, name)
+		for _, dir := range dirs {
+			ok = ok || strings.HasPrefix(name, dir+"/")
+		}
+		if !ok {
+			continue
+		}
+		matches = append(matches, ti)
+		if withContents && ti.IsDir() {
+			dirs = append(dirs, name)
+		}
+	}
+	return matches, nil
+}
+
+// extractMembers extracts members to path like ExtractAllContext,
+// reporting the progress to reporter.
+func (tf *TarFile) extractMembers(ctx context.Context, members []*TarInfo, path string, reporter *progressReporter) error {
+	tf.reporter = reporter
+	defer func() { tf.reporter = nil }()
+
+	tf.skippedErrors = nil
+	tf.extractedSize = 0
+	tf.extracted = nil
+	var directories []*TarInfo
 	for _, member := range members {
-		if err := tf.extractMember(member, path); err != nil {
-			return fmt.Errorf("failed to extract %s: %w", member.Name, err)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ti, err := tf.filterMember(member, path)
+		if err != nil {
+			if err := tf.handleExtractError(member, path, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if ti == nil {
+			continue
+		}
+		if keep, err := tf.keepExisting(ti, path); keep || err != nil {
+			if err := tf.handleExtractError(ti, path, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if ti.IsDir() {
+			// Directory attributes are set once all members are written,
+			// otherwise extracting their contents would undo them.
+			directories = append(directories, ti)
+		}
+		err = tf.extractMember(ti, path, !ti.IsDir())
+		if err == nil && ti.IsReg() {
+			tf.extracted = append(tf.extracted, ti)
+		}
+		if err := tf.handleExtractError(ti, path, err); err != nil {
+			return err
+		}
+	}
+
+	return tf.setDirectoryAttrs(directories, path)
+}
+
+// ExtractAllParallel is like ExtractAll but writes regular files with up
+// to workers goroutines. Directories are created first, then the regular
+// files are written, then links and other members are extracted in
+// archive order, and directory attributes are set last. If members share
+// a target path, all members are extracted serially in archive order, as
+// ExtractAll does, since the order of writing decides the result. The
+// workers read the archive with ReadAt, so archives whose file is no
+// io.ReaderAt, like compressed ones, are extracted serially.
+func (tf *TarFile) ExtractAllParallel(path string, workers int) error {
+	return tf.ExtractAllParallelContext(context.Background(), path, workers)
+}
+
+// ExtractAllParallelContext is like ExtractAllParallel but stops with the
+// context's error once ctx is done, like ExtractAllContext. The workers
+// check ctx before writing each file.
+func (tf *TarFile) ExtractAllParallelContext(ctx context.Context, path string, workers int) error {
+	tf.mu.Lock()
+	ra, ok := tf.fileObj.(io.ReaderAt)
+	if !ok || tf.stream || workers < 2 {
+		tf.mu.Unlock()
+		return tf.ExtractAllContext(ctx, path)
+	}
+	var reporter *progressReporter
+	defer func() { reporter.wait() }()
+	defer tf.mu.Unlock()
+
+	if err := tf.check("r"); err != nil {
+		return err
+	}
+	if !tf.loaded {
+		if err := tf.loadContext(ctx); err != nil {
+			return err
 		}
 	}
+	members := tf.members
 
+	tf.skippedErrors = nil
+	tf.extracted = nil
+	var filtered []*TarInfo
+	targets := make(map[string]*TarInfo)
+	serial := false
+	for _, member := range members {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ti, err := tf.filterMember(member, path)
+		if err != nil {
+			if err := tf.handleExtractError(member, path, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if ti == nil {
+			continue
+		}
+		// A directory listed twice is created once either way.
+		target := filepath.Clean(filepath.FromSlash(ti.Name))
+		if prev, ok := targets[target]; ok && !(prev.IsDir() && ti.IsDir()) {
+			serial = true
+		}
+		targets[target] = ti
+		filtered = append(filtered, ti)
+	}
+	reporter = newProgressReporter(tf.progress, regularSize(filtered))
+	tf.reporter = reporter
+	defer func() { tf.reporter = nil }()
+
+	tf.extractedSize = 0
+	var files, others, directories []*TarInfo
+	for _, ti := range filtered {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if keep, err := tf.keepExisting(ti, path); keep || err != nil {
+			if err := tf.handleExtractError(ti, path, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if serial {
+			if ti.IsDir() {
+				directories = append(directories, ti)
+			}
+			err := tf.extractMember(ti, path, !ti.IsDir())
+			if err == nil && ti.IsReg() {
+				tf.extracted = append(tf.extracted, ti)
+			}
+			if err := tf.handleExtractError(ti, path, err); err != nil {
+				return err
+			}
+			continue
+		}
+		switch {
+		case ti.IsDir():
+			directories = append(directories, ti)
+			if err := tf.handleExtractError(ti, path, tf.extractMember(ti, path, false)); err != nil {
+				return err
+			}
+		case ti.IsReg():
+			files = append(files, ti)
+		default:
+			others = append(others, ti)
+		}
+	}
+
+	var jobs []*TarInfo
+	for _, ti := range files {
+		if err := tf.handleExtractError(ti, path, tf.reserveExtractSize(ti)); err != nil {
+			return err
+		}
+		jobs = append(jobs, ti)
+	}
+
+	errs := make([]error, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(jobs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				ti := jobs[i]
+				targetPath := filepath.Join(path, ti.Name)
+				err := os.MkdirAll(filepath.Dir(targetPath), 0755)
+				if err == nil {
+					err = writeFile(ti, targetPath, reporter.reader(ti, io.NewSectionReader(ra, ti.OffsetData, ti.dataSize())), tf.dataDecoder)
+				}
+				if err == nil {
+					err = tf.setAttrs(ti, targetPath)
+				}
+				if err == nil {
+					reporter.complete(ti)
+				}
+				errs[i] = err
+			}
+		}()
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			tf.extracted = append(tf.extracted, jobs[i])
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for i, err := range errs {
+		if err := tf.handleExtractError(jobs[i], path, err); err != nil {
+			return err
+		}
+	}
+
+	for _, ti := range others {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := tf.handleExtractError(ti, path, tf.extractMember(ti, path, true)); err != nil {
+			return err
+		}
+	}
+	return tf.setDirectoryAttrs(directories, path)
+}
+
+// setDirectoryAttrs sets the attributes of the extracted directories once
+// all members are written, since extracting their contents would undo
+// them otherwise.
+func (tf *TarFile) setDirectoryAttrs(directories []*TarInfo, path string) error {
+	// Handle the deepest directories first, so that setting the
+	// attributes of a directory cannot change those of its parent.
+	depth := func(ti *TarInfo) int {
+		return strings.Count(filepath.Clean(filepath.FromSlash(ti.Name)), string(filepath.Separator))
+	}
+	sort.SliceStable(directories, func(i, j int) bool {
+		if di, dj := depth(directories[i]), depth(directories[j]); di != dj {
+			return di > dj
+		}
+		return directories[i].Name > directories[j].Name
+	})
+	for _, ti := range directories {
+		if err := tf.handleExtractError(ti, path, tf.setAttrs(ti, filepath.Join(path, ti.Name))); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// extractMember is the internal implementation for extracting a member
-func (tf *TarFile) extractMember(member *TarInfo, basePath string) error {
+// extractMember is the internal implementation for extracting a member.
+// The member's attributes are restored only if setAttrs is true.
+func (tf *TarFile) extractMember(member *TarInfo, basePath string, setAttrs bool) (err error) {
 	targetPath := filepath.Join(basePath, member.Name)
+	defer func() {
+		if err == nil {
+			tf.reporter.complete(member)
+		}
+	}()
 
 	// 确保目标目录存在
 	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
@@ -895,17 +2740,59 @@ func (tf *TarFile) extractMember(member *TarInfo, basePath string) error {
 
 	switch {
 	case member.IsDir():
-		return os.MkdirAll(targetPath, os.FileMode(member.Mode))
+		// Create directories owner-writable so their contents can be
+		// extracted; the archived mode is applied by setAttrs.
+		mode := os.FileMode(0755)
+		if tf.preserveAttrs {
+			mode = 0700
+		}
+		if err := os.MkdirAll(targetPath, mode); err != nil {
+			return err
+		}
+		if setAttrs {
+			return tf.setAttrs(member, targetPath)
+		}
+		return nil
 
 	case member.IsReg():
-		return tf.extractFile(member, targetPath)
+		// Contiguous files (CONTTYPE) have no special meaning on current
+		// systems and are extracted as regular files, as are AREGTYPE
+		// members of old archives.
+		if err := tf.extractFile(member, targetPath, tf.reporter); err != nil {
+			return err
+		}
+		if setAttrs {
+			return tf.setAttrs(member, targetPath)
+		}
+		return nil
+
+	case member.IsSym() && tf.flattenSymlinks:
+		target, err := tf.flattenSymlink(member, basePath, targetPath)
+		if err != nil {
+			return err
+		}
+		if setAttrs {
+			return tf.setAttrs(target, targetPath)
+		}
+		return nil
 
 	case member.IsSym():
-		return os.Symlink(member.Linkname, targetPath)
+		if err := os.Symlink(member.Linkname, targetPath); err != nil {
+			return err
+		}
+		if setAttrs {
+			return tf.setAttrs(member, targetPath)
+		}
+		return nil
 
 	case member.IsLnk():
-		linkTarget := filepath.Join(basePath, member.Linkname)
-		return os.Link(linkTarget, targetPath)
+		if err := tf.makeLink(member, basePath, targetPath); err != nil {
+			return err
+		}
+		if setAttrs {
+			return tf.setAttrs(member, targetPath)
+		}
+		return nil
 
 	default:
 		// 对于设备文件、FIFO等，我们暂时跳过
@@ -914,13 +2801,118 @@ func (tf *TarFile) extractMember(member *TarInfo, basePath string) error {
 	}
 }
 
-// extractFile extracts a regular file
-func (tf *TarFile) extractFile(member *TarInfo, targetPath string) error {
+// makeLink creates a hard link to the extracted target of member. If the
+// target has not been extracted, for example because it comes later in
+// the archive, the data of the target member is copied instead. Targets
+// that resolve to outside basePath are rejected.
+func (tf *TarFile) makeLink(member *TarInfo, basePath, targetPath string) error {
+	linkTarget := filepath.Join(basePath, filepath.FromSlash(member.Linkname))
+	if !withinDir(realPath(linkTarget), realPath(basePath)) {
+		return NewLinkOutsideDestinationError(member.Name, linkTarget)
+	}
+	if _, err := os.Lstat(linkTarget); err == nil {
+		return os.Link(linkTarget, targetPath)
+	}
+
+	target := tf.findLinkTarget(member)
+	if target == nil {
+		return NewExtractError(fmt.Sprintf("unable to resolve link %q inside archive", member.Linkname))
+	}
+	target, err := tf.filterMember(target, basePath)
+	if err != nil {
+		return err
+	}
+	if target == nil || !target.IsReg() {
+		return NewExtractError(fmt.Sprintf("unable to copy link target %q", member.Linkname))
+	}
+	// The copied data is not part of the progress of the extraction.
+	return tf.extractFile(target, targetPath, nil)
+}
+
+// maxLinkHops is the number of links flattenSymlink follows in a row,
+// like the limit of symlinks the kernel follows in a path.
+const maxLinkHops = 40
+
+// flattenSymlink writes the data of the regular file the symlink member
+// resolves to within the archive to targetPath and returns that file's
+// member, whose attributes apply to the copy.
+func (tf *TarFile) flattenSymlink(member *TarInfo, basePath, targetPath string) (*TarInfo, error) {
+	members, err := tf.getMembers()
+	if err != nil {
+		return nil, err
+	}
+	target := member
+	for hops := 0; target.IsSym() || target.IsLnk(); hops++ {
+		if hops == maxLinkHops {
+			return nil, NewExtractError(fmt.Sprintf("too many levels of links resolving %q", member.Linkname))
+		}
+		next, err := target.ResolveLink(members)
+		switch err.(type) {
+		case nil:
+		case *AbsoluteLinkError, *LinkOutsideDestinationError:
+			return nil, err
+		default:
+			return nil, NewExtractError(fmt.Sprintf("unable to resolve link %q inside archive", target.Linkname))
+		}
+		target = next
+	}
+	target, err = tf.filterMember(target, basePath)
+	if err != nil {
+		return nil, err
+	}
+	if target == nil || !target.IsReg() {
+		return nil, NewExtractError(fmt.Sprintf("unable to copy link target %q", member.Linkname))
+	}
+	return target, tf.extractFile(target, targetPath, nil)
+}
+
+// findLinkTarget returns the member a hard link refers to, preferring the
+// last one with that name.
+func (tf *TarFile) findLinkTarget(member *TarInfo) *TarInfo {
+	name := path.Clean(member.Linkname)
+	members, _ := tf.getMembers()
+	for i := len(members) - 1; i >= 0; i-- {
+		if m := members[i]; m != member && path.Clean(m.Name) == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// filterMember runs the extraction filter on a copy of member, so the
+// filter cannot change the archive's own TarInfo. A nil result means the
+// member is to be skipped.
+func (tf *TarFile) filterMember(member *TarInfo, basePath string) (*TarInfo, error) {
+	if tf.extractionFilter == nil {
+		return member, nil
+	}
+	ti, err := tf.extractionFilter(member.clone(), basePath)
+	if err != nil {
+		return nil, err
+	}
+	if ti == nil {
+		tf.dbg(2, fmt.Sprintf("tarfile: Excluded %q", member.Name))
+	}
+	return ti, nil
+}
+
+// extractFile extracts a regular file, reporting the data written to
+// reporter.
+func (tf *TarFile) extractFile(member *TarInfo, targetPath string, reporter *progressReporter) error {
+	if err := tf.reserveExtractSize(member); err != nil {
+		return err
+	}
+
 	// 移动到数据的开始位置
 	if _, err := tf.fileObj.Seek(member.OffsetData, io.SeekStart); err != nil {
 		return err
 	}
+	return writeFile(member, targetPath, reporter.reader(member, tf.fileObj), tf.dataDecoder)
+}
 
+// writeFile creates targetPath with the data of member read from r,
+// passed through decode unless it is nil.
+func writeFile(member *TarInfo, targetPath string, r io.Reader, decode func(io.Reader) io.Reader) error {
 	// 创建目标文件
 	outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(member.Mode))
 	if err != nil {
@@ -928,20 +2920,245 @@ func (tf *TarFile) extractFile(member *TarInfo, targetPath string) error {
 	}
 	defer outFile.Close()
 
+	if member.IsSparse() {
+		return extractSparse(member, outFile, r)
+	}
+	if decode != nil {
+		return decodeFile(member, outFile, r, decode)
+	}
+
 	// 复制数据
-	_, err = io.CopyN(outFile, tf.fileObj, member.Size)
-	if err != nil {
+	if _, err := io.CopyN(outFile, r, member.Size); err != nil {
+		if err == io.EOF {
+			return NewReadError("unexpected end of data")
+		}
 		return err
 	}
+	return nil
+}
+
+// decodeFile writes the data of member read from r and passed through
+// decode to outFile. The decoded data may have any length, but all
+// member.Size bytes stored have to be there.
+func decodeFile(member *TarInfo, outFile *os.File, r io.Reader, decode func(io.Reader) io.Reader) error {
+	data := &io.LimitedReader{R: r, N: member.Size}
+	if _, err := io.Copy(outFile, decode(data)); err != nil {
+		return err
+	}
+	if data.N > 0 {
+		// Whatever the decoder did not read still has to be there.
+		if _, err := io.Copy(io.Discard, data); err != nil {
+			return err
+		}
+		if data.N > 0 {
+			return NewReadError("unexpected end of data")
+		}
+	}
+	return nil
+}
+
+// reserveExtractSize checks that the data of member is consistent with
+// its declared size and adds the number of bytes it will write to the
+// total of the current extraction, failing if that exceeds the limit set
+// with WithMaxExtractSize.
+func (tf *TarFile) reserveExtractSize(member *TarInfo) error {
+	if member.Size < 0 {
+		return NewTarError(fmt.Sprintf("%s: negative size %d", member.Name, member.Size))
+	}
+	size := member.Size
+	if member.IsSparse() {
+		size = 0
+		for _, region := range member.Sparse {
+			if region[0] < 0 || region[1] < 0 || region[0] > member.Size-region[1] {
+				return NewTarError(fmt.Sprintf("%s: sparse region outside of the file size %d", member.Name, member.Size))
+			}
+			size += region[1]
+		}
+	}
+	if tf.maxExtractSize > 0 && size > tf.maxExtractSize-tf.extractedSize {
+		return NewTarError(fmt.Sprintf("%s: extraction would exceed the limit of %d bytes", member.Name, tf.maxExtractSize))
+	}
+	tf.extractedSize += size
+	return nil
+}
+
+// extractSparse writes the data regions of a sparse member at their
+// offsets and leaves holes in between. The file is truncated to the
+// member's size so that a trailing hole is kept as well.
+func extractSparse(member *TarInfo, outFile *os.File, data io.Reader) error {
+	for _, region := range member.Sparse {
+		if _, err := outFile.Seek(region[0], io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(outFile, data, region[1]); err != nil {
+			if err == io.EOF {
+				return NewReadError("unexpected end of data")
+			}
+			return err
+		}
+	}
+	return outFile.Truncate(member.Size)
+}
+
+// setAttrs restores the ownership and the extended attributes of an
+// extracted member if enabled, the mode of an extracted directory, or of
+// any member in exact mode, and the access and modification times of an
+// extracted member, which for symlinks are set on the link itself. It
+// does nothing if attribute restoration is disabled. Failures are
+// returned as ExtractErrors.
+func (tf *TarFile) setAttrs(member *TarInfo, targetPath string) error {
+	if !tf.preserveAttrs {
+		return nil
+	}
+	if err := tf.chown(member, targetPath); err != nil {
+		return err
+	}
+	// Changing the owner clears file capabilities, so set them afterwards.
+	if err := tf.setXattrs(member, targetPath); err != nil {
+		return err
+	}
+	// The access time is restored if the archive has it.
+	atime := member.Atime
+	if atime.IsZero() {
+		atime = member.Mtime
+	}
+	if member.IsSym() {
+		// os.Chtimes follows symlinks, so set the times of the link itself.
+		ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(member.Mtime.UnixNano())}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, targetPath, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return wrapExtractError("could not change modification time", err)
+		}
+		return nil
+	}
+	// Files are created with the setuid, setgid and sticky bits cleared,
+	// and changing the owner clears them as well, so set them explicitly.
+	// In exact mode the bits cleared by the umask are set as well.
+	if member.IsDir() || member.Mode&07000 != 0 || tf.exactMode {
+		mode := fileMode(member) & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if err := os.Chmod(targetPath, mode); err != nil {
+			return wrapExtractError("could not change mode", err)
+		}
+	}
+	if err := os.Chtimes(targetPath, atime, member.Mtime); err != nil {
+		return wrapExtractError("could not change modification time", err)
+	}
+	return nil
+}
+
+// setXattrs restores the extended attributes of an extracted member if
+// enabled.
+func (tf *TarFile) setXattrs(member *TarInfo, targetPath string) error {
+	if !tf.preserveXattrs {
+		return nil
+	}
+	for name, value := range member.Xattrs {
+		if err := unix.Lsetxattr(targetPath, name, value, 0); err != nil {
+			return wrapExtractError("could not set extended attribute "+name, err)
+		}
+	}
+	return nil
+}
+
+// Hooks for changing the ownership of extracted files.
+var (
+	geteuid = os.Geteuid
+	lchown  = os.Lchown
+)
+
+// chown restores the owner and group of an extracted member if enabled
+// and running as root. Unless numericOwner is set, the member's user and
+// group names are looked up first and its uid and gid are only used if
+// the names are unknown.
+func (tf *TarFile) chown(member *TarInfo, targetPath string) error {
+	if !tf.preserveOwner || geteuid() != 0 {
+		return nil
+	}
+	uid, gid := member.UID, member.GID
+	if !tf.numericOwner {
+		if member.Gname != "" {
+			if g, err := user.LookupGroup(member.Gname); err == nil {
+				if n, err := strconv.Atoi(g.Gid); err == nil {
+					gid = n
+				}
+			}
+		}
+		if member.Uname != "" {
+			if u, err := user.Lookup(member.Uname); err == nil {
+				if n, err := strconv.Atoi(u.Uid); err == nil {
+					uid = n
+				}
+			}
+		}
+	}
+	if err := lchown(targetPath, uid, gid); err != nil {
+		return wrapExtractError("could not change owner", err)
+	}
+	return nil
+}
+
+// handleExtractError turns err from extracting member below path into an
+// ExtractError and decides from errorLevel whether it is returned.
+// Non-fatal errors, which only mean that attributes could not be set or
+// that an existing file was kept, are returned from level 2 on and all
+// other errors from level 1 on. Errors that are not returned are
+// collected for GetSkippedErrors.
+func (tf *TarFile) handleExtractError(member *TarInfo, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	ee, ok := err.(*ExtractError)
+	if !ok {
+		ee = &ExtractError{TarError: TarError{msg: err.Error()}, Err: err, fatal: true}
+	}
+	if ee.Member == "" {
+		ee.Member = member.Name
+		ee.Path = filepath.Join(path, member.Name)
+	}
+	level := 1
+	if !ee.fatal {
+		level = 2
+	}
+	if tf.errorLevel >= level {
+		return ee
+	}
+	tf.skippedErrors = append(tf.skippedErrors, ee)
+	tf.dbg(1, fmt.Sprintf("tarfile: %v", ee))
+	return nil
+}
 
-	// 设置修改时间
-	return os.Chtimes(targetPath, member.Mtime, member.Mtime)
+// keepExisting applies the overwrite policy to the target path of member
+// below basePath and reports whether an existing file there is kept. With
+// OverwriteNever this comes with an ExtractError. A file that is replaced
+// is removed first, unless it is a regular file to be overwritten by a
+// regular file or a directory, so that links are created in its place and
+// writes do not follow a symlink.
+func (tf *TarFile) keepExisting(member *TarInfo, basePath string) (bool, error) {
+	targetPath := filepath.Join(basePath, member.Name)
+	st, err := os.Lstat(targetPath)
+	if err != nil {
+		return false, nil
+	}
+	switch tf.overwrite {
+	case OverwriteNever:
+		return true, wrapExtractError("existing file kept", os.ErrExist)
+	case OverwriteIfNewer:
+		if !member.Mtime.After(st.ModTime()) {
+			tf.dbg(1, fmt.Sprintf("%s: existing file is not older, kept", member.Name))
+			return true, nil
+		}
+	}
+	if st.IsDir() || member.IsReg() && st.Mode().IsRegular() {
+		return false, nil
+	}
+	return false, os.Remove(targetPath)
 }
 
 // getMembers is the internal implementation without locking
 func (tf *TarFile) getMembers() ([]*TarInfo, error) {
 	if !tf.loaded {
-		tf.load()
+		if err := tf.load(); err != nil {
+			return nil, err
+		}
 	}
 	return tf.members, nil
 }
@@ -954,3 +3171,111 @@ func (tf *TarFile) ExtractTo(memberName, targetPath string) error {
 	}
 	return tf.Extract(member, targetPath)
 }
+
+// WriteMemberTo copies the data of the regular file member to w and
+// returns the number of bytes written. The holes of sparse members are
+// written as zeros, so w always receives member.Size bytes.
+func (tf *TarFile) WriteMemberTo(member *TarInfo, w io.Writer) (int64, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if err := tf.check("r"); err != nil {
+		return 0, err
+	}
+	if !member.IsReg() {
+		return 0, NewTarError(fmt.Sprintf("%s: not a regular file", member.Name))
+	}
+	if _, err := tf.fileObj.Seek(member.OffsetData, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var written int64
+	copyN := func(r io.Reader, n int64) error {
+		m, err := io.CopyN(w, r, n)
+		written += m
+		if err == io.EOF {
+			return NewReadError("unexpected end of data")
+		}
+		return err
+	}
+	if !member.IsSparse() {
+		return written, copyN(tf.fileObj, member.Size)
+	}
+	for _, region := range member.Sparse {
+		if region[0] < written || region[0] > member.Size-region[1] {
+			return written, NewTarError(fmt.Sprintf("%s: invalid sparse map", member.Name))
+		}
+		if err := copyN(zeroReader{}, region[0]-written); err != nil {
+			return written, err
+		}
+		if err := copyN(tf.fileObj, region[1]); err != nil {
+			return written, err
+		}
+	}
+	return written, copyN(zeroReader{}, member.Size-written)
+}
+
+// ReadMemberInto reads up to len(buf) bytes of the data of the regular
+// file member into buf, like a single ReadAt at offset 0 of the member:
+// if the member is shorter than buf, all of it is read and io.EOF is
+// returned. Unlike an ExFileObject it allocates nothing, so a scanner of
+// many small members can reuse one buffer. The holes of sparse members
+// are read as zeros.
+func (tf *TarFile) ReadMemberInto(member *TarInfo, buf []byte) (int, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if err := tf.check("r"); err != nil {
+		return 0, err
+	}
+	if !member.IsReg() {
+		return 0, NewTarError(fmt.Sprintf("%s: not a regular file", member.Name))
+	}
+	if member.Size < 0 {
+		return 0, NewTarError(fmt.Sprintf("%s: negative size %d", member.Name, member.Size))
+	}
+	if _, err := tf.fileObj.Seek(member.OffsetData, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	want := buf[:min(int64(len(buf)), member.Size)]
+	readFull := func(p []byte) (int, error) {
+		n, err := io.ReadFull(tf.fileObj, p)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = NewReadError("unexpected end of data")
+		}
+		return n, err
+	}
+	if !member.IsSparse() {
+		if n, err := readFull(want); err != nil {
+			return n, err
+		}
+	} else {
+		clear(want)
+		var end int64
+		for _, region := range member.Sparse {
+			if region[0] < end || region[1] < 0 || region[0] > member.Size-region[1] {
+				return 0, NewTarError(fmt.Sprintf("%s: invalid sparse map", member.Name))
+			}
+			end = region[0] + region[1]
+			if region[0] >= int64(len(want)) {
+				break
+			}
+			if n, err := readFull(want[region[0]:min(end, int64(len(want)))]); err != nil {
+				return int(region[0]) + n, err
+			}
+		}
+	}
+	if len(want) < len(buf) {
+		return len(want), io.EOF
+	}
+	return len(want), nil
+}
+
+// zeroReader reads an endless sequence of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
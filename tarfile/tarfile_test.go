@@ -0,0 +1,2270 @@
+package tarfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tempFile writes data to a new file in a temporary directory and
+// returns its path.
+func tempFile(t testing.TB, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// dataPastEnd returns an archive whose second member declares more data
+// than the archive holds.
+func dataPastEnd(t *testing.T) []byte {
+	var archive bytes.Buffer
+	first := NewTarInfo("first")
+	first.Size = 1
+	archive.Write(headerBytes(t, first))
+	archive.Write(make([]byte, BLOCKSIZE))
+	second := NewTarInfo("second")
+	second.Size = 100 * BLOCKSIZE
+	archive.Write(headerBytes(t, second))
+	archive.Write(make([]byte, BLOCKSIZE))
+	return archive.Bytes()
+}
+
+func TestExtractAllDataPastEnd(t *testing.T) {
+	tf := openArchive(t, tempFile(t, "short.tar", dataPastEnd(t)))
+	dest := t.TempDir()
+	if err := tf.ExtractAll(dest); err == nil {
+		t.Fatal("ExtractAll() succeeded")
+	} else if _, ok := err.(*InvalidHeaderError); !ok {
+		t.Errorf("ExtractAll() = %v, want an InvalidHeaderError", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "second")); err == nil {
+		t.Error("member past the end was extracted")
+	}
+}
+
+func TestGetMembersDataPastEnd(t *testing.T) {
+	tf := openArchive(t, tempFile(t, "short.tar", dataPastEnd(t)))
+	if _, err := tf.GetMembers(); err == nil {
+		t.Fatal("GetMembers() succeeded")
+	} else if _, ok := err.(*InvalidHeaderError); !ok {
+		t.Errorf("GetMembers() = %v, want an InvalidHeaderError", err)
+	}
+	if _, err := tf.GetNames(); err == nil {
+		t.Error("GetNames() succeeded")
+	}
+}
+
+func TestUpdateMemberHeaderPaxFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pax.tar")
+	tf, err := Open(path, "w", nil, 4096, WithFormat(PAX_FORMAT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := NewTarInfo("a")
+	ti.Uname = "jürgen"
+	if err := tf.AddFile(ti, nil); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	tf, err = Open(path, "a", nil, 4096, WithFormat(PAX_FORMAT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := tf.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := members[0]
+	member.Uname = "jörgen"
+	if err := tf.UpdateMemberHeader(member); err != nil {
+		t.Fatal(err)
+	}
+	member.Uname = "jörgen-" + strings.Repeat("x", 1000)
+	if err := tf.UpdateMemberHeader(member); err == nil {
+		t.Error("UpdateMemberHeader accepted a longer header")
+	}
+	tf.Close()
+
+	tf, err = Open(path, "r", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	if member, err := tf.GetMember("a"); err != nil {
+		t.Fatal(err)
+	} else if member.Uname != "jörgen" {
+		t.Errorf("Uname = %q, want %q", member.Uname, "jörgen")
+	}
+}
+
+func TestAddFileDataEncoder(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "encoded.tar")
+	encode := func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	tf, err := Open(path, "w", nil, 4096, WithDataEncoder(encode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := NewTarInfo("a")
+	ti.Size = 5
+	if err := tf.AddFile(ti, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if ti.Size != 5 {
+		t.Errorf("AddFile changed Size to %d", ti.Size)
+	}
+	ti.Name = "b"
+	members, err := tf.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].Name != "a" || members[0].Size == 5 {
+		t.Errorf("member = %+v", members[0])
+	}
+	tf.Close()
+
+	decode := func(r io.Reader) io.Reader {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zr
+	}
+	tf, err = Open(path, "r", nil, 4096, WithDataDecoder(decode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	dest := filepath.Join(dir, "dest")
+	if err := tf.ExtractAll(dest); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "a")); err != nil || string(data) != "hello" {
+		t.Errorf("extracted %q, %v", data, err)
+	}
+}
+
+func TestExtractAllParallelSharedTarget(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "shared.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := NewTarInfo("a")
+	link.Type = SYMTYPE
+	link.Linkname = "b"
+	if err := tf.AddFile(link, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("./a", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("c", []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	tf, err = Open(path, "r", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	dest := filepath.Join(dir, "dest")
+	if err := tf.ExtractAllParallel(dest, 4); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Lstat(filepath.Join(dest, "a")); err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("a is not the regular file that came last: %v, %v", fi, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "a")); err != nil || string(data) != "data" {
+		t.Errorf("a = %q, %v", data, err)
+	}
+}
+
+func TestExtractAllParallelFilter(t *testing.T) {
+	for name, names := range map[string][]string{
+		"parallel": {"a", "b", "c"},
+		"serial":   {"a", "b", "a"}, // A shared target
+	} {
+		path := tempFile(t, name+".tar", tarBytes(t, names...))
+		calls := map[string]int{}
+		filter := func(ti *TarInfo, dest string) (*TarInfo, error) {
+			calls[ti.Name]++
+			if ti.Name == "b" {
+				return nil, nil
+			}
+			return ti, nil
+		}
+		tf := openArchive(t, path, WithExtractionFilter(filter))
+		if err := tf.ExtractAllParallel(t.TempDir(), 4); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]int{}
+		var extracted []string
+		for _, n := range names {
+			want[n]++
+			if n != "b" {
+				extracted = append(extracted, n)
+			}
+		}
+		if !maps.Equal(calls, want) {
+			t.Errorf("%s: filter calls %v, want one per member", name, calls)
+		}
+		var got []string
+		for _, ti := range tf.extracted {
+			got = append(got, ti.Name)
+		}
+		if !slices.Equal(got, extracted) {
+			t.Errorf("%s: recorded %v as extracted, want %v", name, got, extracted)
+		}
+	}
+}
+
+func TestExtractAllParallelContextCancel(t *testing.T) {
+	names := make([]string, 100)
+	for i := range names {
+		names[i] = fmt.Sprintf("f%02d", i)
+	}
+	path := tempFile(t, "many.tar", tarBytes(t, names...))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var filtered int
+	cancelAt := func(ti *TarInfo, dest string) (*TarInfo, error) {
+		if filtered++; ti.Name == "f49" {
+			cancel()
+		}
+		return ti, nil
+	}
+	tf := openArchive(t, path, WithExtractionFilter(cancelAt))
+	dest := t.TempDir()
+	if err := tf.ExtractAllParallelContext(ctx, dest, 4); !errors.Is(err, context.Canceled) {
+		t.Errorf("ExtractAllParallelContext() = %v, want context.Canceled", err)
+	}
+	if filtered != 50 {
+		t.Errorf("filter called %d times after the cancellation at 50", filtered)
+	}
+	// Files are only written once all members are filtered.
+	if entries, err := os.ReadDir(dest); err != nil || len(entries) != 0 {
+		t.Errorf("extracted %d members, %v", len(entries), err)
+	}
+}
+
+func TestExtractHardLinkOutside(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "link.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := NewTarInfo("l")
+	link.Type = LNKTYPE
+	link.Linkname = "../secret"
+	if err := tf.AddFile(link, nil); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	tf, err = Open(path, "r", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	dest := filepath.Join(dir, "dest")
+	err = tf.ExtractAll(dest)
+	var outside *LinkOutsideDestinationError
+	if !errors.As(err, &outside) {
+		t.Errorf("ExtractAll() = %v, want a LinkOutsideDestinationError", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "l")); err == nil {
+		t.Error("hard link to a file outside the destination was created")
+	}
+}
+
+func TestCopyMemberFrom(t *testing.T) {
+	src, err := Open(tempFile(t, "src.tar", tarBytes(t, "a", "b")), "r", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	members, err := src.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "dst.tar")
+	dst, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range members {
+		if err := dst.CopyMemberFrom(src, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tf := openArchive(t, path)
+	for _, name := range []string{"a", "b"} {
+		ti, err := tf.GetMember(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(NewExFileObject(tf, ti))
+		if err != nil || ti.Name != name || string(data) != name {
+			t.Errorf("member %q = %q, %v, want %q", ti.Name, data, err, name)
+		}
+	}
+}
+
+// openArchive opens the archive at path for reading and closes it when
+// the test ends.
+func openArchive(t testing.TB, path string, opts ...TarFileOption) *TarFile {
+	t.Helper()
+	tf, err := Open(path, "r", nil, 4096, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tf.Close() })
+	return tf
+}
+
+// addData adds a regular file member name holding data to tf.
+func addData(tf *TarFile, name string, data []byte) error {
+	ti := NewTarInfo(name)
+	ti.Size = int64(len(data))
+	return tf.AddFile(ti, bytes.NewReader(data))
+}
+
+func TestExtractionFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "skip", "fail"} {
+		if err := addData(tf, name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tf.Close()
+
+	var seen []string
+	filter := func(ti *TarInfo, dest string) (*TarInfo, error) {
+		seen = append(seen, ti.Name)
+		switch ti.Name {
+		case "a":
+			ti.Name = "renamed"
+			return ti, nil
+		case "skip":
+			return nil, nil
+		}
+		return nil, errors.New("rejected")
+	}
+	tf = openArchive(t, path, WithExtractionFilter(filter))
+	dest := t.TempDir()
+	if err := tf.ExtractAll(dest); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("ExtractAll() = %v, want the filter's error", err)
+	}
+	if !slices.Equal(seen, []string{"a", "skip", "fail"}) {
+		t.Errorf("filter called for %v", seen)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "renamed")); err != nil || string(data) != "a" {
+		t.Errorf("renamed = %q, %v", data, err)
+	}
+	for _, name := range []string{"a", "skip", "fail"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err == nil {
+			t.Errorf("%s was extracted", name)
+		}
+	}
+	// The filter only changed a copy of the member.
+	if ti, err := tf.GetMember("a"); err != nil || ti.Name != "a" {
+		t.Errorf("GetMember(a) = %v, %v", ti, err)
+	}
+}
+
+func TestExtractDirAttrs(t *testing.T) {
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "dir.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := NewTarInfo("d")
+	dir.Type, dir.Mode, dir.Mtime = DIRTYPE, 0500, mtime
+	if err := tf.AddFile(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Written into the directory after it was created.
+	if err := addData(tf, "d/f", []byte("f")); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	dest := t.TempDir()
+	t.Cleanup(func() { os.Chmod(filepath.Join(dest, "d"), 0700) })
+	if err := openArchive(t, path).ExtractAll(dest); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(filepath.Join(dest, "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0500 || !st.ModTime().Equal(mtime) {
+		t.Errorf("d: mode %v, mtime %v", st.Mode(), st.ModTime())
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "d", "f")); err != nil || string(data) != "f" {
+		t.Errorf("d/f = %q, %v", data, err)
+	}
+}
+
+func TestGnuLongNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gnu.tar")
+	tf, err := Open(path, "w", nil, 4096, WithFormat(GNU_FORMAT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strings.Repeat("n", 300)
+	linkname := strings.Repeat("l", 200)
+	if err := addData(tf, name, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	link := NewTarInfo("link")
+	link.Type = SYMTYPE
+	link.Linkname = linkname
+	if err := tf.AddFile(link, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := openArchive(t, path).GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("read %d members, want 2", len(members))
+	}
+	if members[0].Name != name || members[0].Size != 4 {
+		t.Errorf("member 0 = %q of size %d", members[0].Name, members[0].Size)
+	}
+	if members[1].Name != "link" || members[1].Linkname != linkname {
+		t.Errorf("member 1 = %q -> %q", members[1].Name, members[1].Linkname)
+	}
+}
+
+func TestPaxGlobalHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "global.tar")
+	tf, err := Open(path, "w", nil, 4096, WithFormat(PAX_FORMAT), WithPaxHeaders(map[string]string{"comment": "global"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addData(tf, "a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	b := NewTarInfo("b")
+	b.PaxHeaders["comment"] = "own"
+	if err := tf.AddFile(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tf = openArchive(t, path)
+	if got := tf.GetPaxHeaders()["comment"]; got != "global" {
+		t.Errorf("global comment = %q, want %q", got, "global")
+	}
+	members, err := tf.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"global", "own"} {
+		if got := members[i].PaxHeaders["comment"]; got != want {
+			t.Errorf("comment of %q = %q, want %q", members[i].Name, got, want)
+		}
+	}
+}
+
+func TestMembersBreakEarly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "many.tar")
+	tf, err := Open(path, "w", nil, 4096, WithFormat(USTAR_FORMAT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10000; i++ {
+		if err := tf.AddFile(NewTarInfo(fmt.Sprintf("m%05d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{"r", "r|"} {
+		tf, err = Open(path, mode, nil, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for ti := range tf.Members {
+			names = append(names, ti.Name)
+			if len(names) == 10 {
+				break
+			}
+		}
+		if len(names) != 10 || names[9] != "m00009" {
+			t.Errorf("%s: iterated %v", mode, names)
+		}
+		// Each member is a header without data.
+		if tf.IsLoaded() || tf.GetOffset() != 10*BLOCKSIZE {
+			t.Errorf("%s: read up to offset %d, loaded %v", mode, tf.GetOffset(), tf.IsLoaded())
+		}
+		tf.Close()
+	}
+}
+
+func TestAddBytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blobs.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := map[string]string{"empty": "", "small": "small", "big": strings.Repeat("x", 3*BLOCKSIZE+1)}
+	for _, name := range []string{"empty", "small", "big"} {
+		ti, err := tf.AddBytes(name, []byte(blobs[name]), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ti.Name != name || ti.Size != int64(len(blobs[name])) || ti.Mode != 0600 {
+			t.Errorf("AddBytes returned %q of size %d, mode %o", ti.Name, ti.Size, ti.Mode)
+		}
+	}
+	tf.Close()
+
+	tf = openArchive(t, path)
+	if _, err := tf.AddBytes("x", nil, 0644); err == nil {
+		t.Error("AddBytes succeeded in read mode")
+	}
+	members, err := tf.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ti := range members {
+		data, err := io.ReadAll(NewExFileObject(tf, ti))
+		if err != nil || string(data) != blobs[ti.Name] {
+			t.Errorf("%s = %d bytes, %v", ti.Name, len(data), err)
+		}
+	}
+	if len(members) != len(blobs) {
+		t.Errorf("read %d members, want %d", len(members), len(blobs))
+	}
+}
+
+func TestAddReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reader.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := io.LimitReader(strings.NewReader("streamed data and more"), 13)
+	setMode := func(ti *TarInfo) { ti.Mode = 0600 }
+	if err := tf.AddReader("s", src, 13, setMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.AddReader("short", strings.NewReader("abc"), 4); err == nil {
+		t.Error("AddReader accepted a reader shorter than size")
+	}
+	tf.Close()
+
+	tf = openArchive(t, path)
+	ti, err := tf.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(NewExFileObject(tf, ti))
+	if err != nil || ti.Name != "s" || ti.Mode != 0600 || string(data) != "streamed data" {
+		t.Errorf("member %q mode %o = %q, %v", ti.Name, ti.Mode, data, err)
+	}
+}
+
+// sparseContent returns the file stored in the sparse archives in
+// testdata: region i holds 4 KiB of 'a'+i at 64 KiB * i, everything
+// else including the last 8 KiB is a hole.
+func sparseContent() []byte {
+	data := make([]byte, 6*65536+8192)
+	for i := 0; i < 6; i++ {
+		copy(data[i*65536:], bytes.Repeat([]byte{byte('a' + i)}, 4096))
+	}
+	return data
+}
+
+func TestExtractGnuSparse(t *testing.T) {
+	tf := openArchive(t, filepath.Join("testdata", "gnu-sparse.tar"))
+	dest := t.TempDir()
+	if err := tf.ExtractAll(dest); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dest, "sparse.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sparseContent(); !bytes.Equal(got, want) {
+		t.Errorf("extracted %d bytes that differ from the logical file of %d bytes", len(got), len(want))
+	}
+}
+
+func TestPaxSparse(t *testing.T) {
+	// Written by GNU tar 1.34 with --format=posix --sparse-version=N.
+	for _, version := range []string{"0.1", "1.0"} {
+		t.Run(version, func(t *testing.T) {
+			tf := openArchive(t, filepath.Join("testdata", "pax-sparse-"+version+".tar"))
+			members, err := tf.GetMembers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ti := members[0]; len(members) != 1 || ti.Name != "sparse.bin" || !ti.IsSparse() || ti.Size != 6*65536+8192 {
+				t.Fatalf("member %q is sparse %v with size %d", ti.Name, ti.IsSparse(), ti.Size)
+			}
+			dest := t.TempDir()
+			if err := tf.ExtractAll(dest); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(filepath.Join(dest, "sparse.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, sparseContent()) {
+				t.Errorf("extracted %d bytes that differ from the logical file", len(got))
+			}
+		})
+	}
+}
+
+// fakeChown makes extraction run as root and change owners with fn for
+// the duration of the test.
+func fakeChown(t *testing.T, fn func(path string, uid, gid int) error) {
+	origEuid, origLchown := geteuid, lchown
+	geteuid = func() int { return 0 }
+	lchown = fn
+	t.Cleanup(func() { geteuid, lchown = origEuid, origLchown })
+}
+
+func TestExtractErrorLevel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "levels.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("a", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Extracting "a/b" fails because "a" is a regular file.
+	if _, err := tf.AddBytes("a/b", []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("c", []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	for _, tt := range []struct {
+		level   int
+		fail    bool
+		skipped int
+	}{
+		{0, false, 1},
+		{1, true, 0},
+		{2, true, 0},
+	} {
+		tf := openArchive(t, path)
+		tf.SetErrorLevel(tt.level)
+		dest := t.TempDir()
+		if err := tf.ExtractAll(dest); tt.fail != (err != nil) {
+			t.Errorf("level %d: ExtractAll() = %v", tt.level, err)
+		}
+		if skipped := tf.GetSkippedErrors(); len(skipped) != tt.skipped {
+			t.Errorf("level %d: skipped %v, want %d errors", tt.level, skipped, tt.skipped)
+		}
+		if data, err := os.ReadFile(filepath.Join(dest, "a")); err != nil || string(data) != "a" {
+			t.Errorf("level %d: extracted %q, %v", tt.level, data, err)
+		}
+		// Extraction goes on after skipped errors only.
+		if _, err := os.Stat(filepath.Join(dest, "c")); (err == nil) != !tt.fail {
+			t.Errorf("level %d: extracting c: %v", tt.level, err)
+		}
+	}
+}
+
+func TestExtractOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owner.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := NewTarInfo("a")
+	ti.UID, ti.GID = 1234, 5678
+	ti.Uname, ti.Gname = "root", "no-such-group"
+	if err := tf.AddFile(ti, nil); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	for _, tt := range []struct {
+		numeric  bool
+		uid, gid int
+	}{
+		{true, 1234, 5678},
+		{false, 0, 5678}, // "root" is looked up, the unknown group is not
+	} {
+		var calls [][2]int
+		fakeChown(t, func(path string, uid, gid int) error {
+			calls = append(calls, [2]int{uid, gid})
+			return nil
+		})
+		tf := openArchive(t, path, WithPreserveOwner(true), WithNumericOwner(tt.numeric))
+		if err := tf.ExtractAll(t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+		if len(calls) != 1 || calls[0] != [2]int{tt.uid, tt.gid} {
+			t.Errorf("numeric %v: chown calls %v, want [[%d %d]]", tt.numeric, calls, tt.uid, tt.gid)
+		}
+	}
+
+	called := false
+	fakeChown(t, func(string, int, int) error { called = true; return nil })
+	geteuid = func() int { return 1000 }
+	tf = openArchive(t, path, WithPreserveOwner(true))
+	if err := tf.ExtractAll(t.TempDir()); err != nil || called {
+		t.Errorf("unprivileged ExtractAll() = %v, chown called %v", err, called)
+	}
+}
+
+func TestGetTarInfoOwnerNames(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Skip(err)
+	}
+	path := tempFile(t, "f", []byte("data"))
+	archive := filepath.Join(t.TempDir(), "owner.tar")
+	tf, err := Open(archive, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti, err := tf.GetTarInfo(path, "f", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.Uname != u.Username || ti.Gname != g.Name {
+		t.Errorf("owner %s:%s, want %s:%s", ti.Uname, ti.Gname, u.Username, g.Name)
+	}
+	if err := tf.Add(path, "f", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	ti, err = openArchive(t, archive).GetMember("f")
+	if err != nil || ti.Uname != u.Username {
+		t.Errorf("archived member %v, %v", ti, err)
+	}
+}
+
+func TestExtractHardLinkBeforeTarget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "link.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := NewTarInfo("l")
+	link.Type = LNKTYPE
+	link.Linkname = "t"
+	if err := tf.AddFile(link, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("t", []byte("target"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	tf = openArchive(t, path)
+	dest := t.TempDir()
+	if err := tf.ExtractAll(dest); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"l", "t"} {
+		if data, err := os.ReadFile(filepath.Join(dest, name)); err != nil || string(data) != "target" {
+			t.Errorf("%s: extracted %q, %v", name, data, err)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+	dir := NewTarInfo("d")
+	dir.Type, dir.Mode = DIRTYPE, 0755
+	dir.Uname, dir.Gname = "root", "wheel"
+	sym := NewTarInfo("d/s")
+	sym.Type, sym.Mode, sym.Linkname = SYMTYPE, 0777, "../f"
+	sym.UID, sym.GID = 1000, 100
+	dev := NewTarInfo("null")
+	dev.Type, dev.Mode = CHRTYPE, 0666
+	dev.DevMajor, dev.DevMinor = 1, 3
+	for _, ti := range []*TarInfo{dir, sym, dev} {
+		ti.Mtime = mtime
+		if err := tf.AddFile(ti, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tf.Close()
+
+	for _, tt := range []struct {
+		verbose bool
+		want    string
+	}{
+		{false, "d/\nd/s\nnull\n"},
+		{true, "" +
+			"drwxr-xr-x root/wheel          0 2024-01-02 03:04:05 d/\n" +
+			"lrwxrwxrwx 1000/100          0 2024-01-02 03:04:05 d/s -> ../f\n" +
+			"crw-rw-rw- 0/0        1,3 2024-01-02 03:04:05 null\n"},
+	} {
+		tf := openArchive(t, path)
+		var out strings.Builder
+		if err := tf.List(&out, tt.verbose); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tt.want {
+			t.Errorf("List(verbose %v) =\n%s\nwant\n%s", tt.verbose, out.String(), tt.want)
+		}
+	}
+}
+
+func TestExtractAllContextCancel(t *testing.T) {
+	names := make([]string, 100)
+	for i := range names {
+		names[i] = fmt.Sprintf("f%02d", i)
+	}
+	path := tempFile(t, "many.tar", tarBytes(t, names...))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelAt := func(ti *TarInfo, dest string) (*TarInfo, error) {
+		if ti.Name == "f49" {
+			cancel()
+		}
+		return ti, nil
+	}
+	tf := openArchive(t, path, WithExtractionFilter(cancelAt))
+	dest := t.TempDir()
+	if err := tf.ExtractAllContext(ctx, dest); !errors.Is(err, context.Canceled) {
+		t.Errorf("ExtractAllContext() = %v, want context.Canceled", err)
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 50 {
+		t.Errorf("extracted %d members, want the 50 before the cancellation", len(entries))
+	}
+}
+
+func TestAddContextCancel(t *testing.T) {
+	src := t.TempDir()
+	for i := 0; i < 10; i++ {
+		if err := os.WriteFile(filepath.Join(src, fmt.Sprintf("f%d", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var added int
+	cancelAt := func(ti *TarInfo) (*TarInfo, error) {
+		if added++; added == 3 {
+			cancel()
+		}
+		return ti, nil
+	}
+	tf, err := Open(filepath.Join(t.TempDir(), "cancel.tar"), "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	if err := tf.AddContext(ctx, src, "src", true, cancelAt); !errors.Is(err, context.Canceled) {
+		t.Errorf("AddContext() = %v, want context.Canceled", err)
+	}
+	if added != 3 {
+		t.Errorf("filter called %d times after the cancellation at 3", added)
+	}
+}
+
+func TestGetMemberDuplicates(t *testing.T) {
+	path := tempFile(t, "dup.tar", tarBytes(t, "a", "b", "a"))
+	tf, err := Open(path, "a", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	members, err := tf.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("b", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	tf = openArchive(t, path)
+	for name, index := range map[string]int{"a": 2, "b": 3} {
+		ti, err := tf.GetMember(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ti.Offset != members[1].Offset*int64(index) {
+			t.Errorf("GetMember(%q) found the member at %d, want the last one", name, ti.Offset)
+		}
+	}
+}
+
+func BenchmarkGetMember(b *testing.B) {
+	const n = 50000
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("dir/file%05d", i)
+	}
+	tf := openArchive(b, tempFile(b, "many.tar", tarBytes(b, names...)))
+	members, err := tf.GetMembers()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := tf.GetMember(names[i%n]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	// The reverse scan GetMember did before the index.
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			name := names[i%n]
+			for j := len(members) - 1; j >= 0 && members[j].Name != name; j-- {
+			}
+		}
+	})
+}
+
+func TestReproducible(t *testing.T) {
+	src := t.TempDir()
+	for name, mode := range map[string]os.FileMode{"b": 0600, "a": 0700, "sub/c": 0640} {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a", filepath.Join(src, "l")); err != nil {
+		t.Fatal(err)
+	}
+	archive := func() []byte {
+		path := filepath.Join(t.TempDir(), "r.tar")
+		tf, err := Open(path, "w", nil, 4096, WithReproducible(time.Time{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tf.Add(src, "src", true, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := tf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	first := archive()
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "b"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, archive()) {
+		t.Fatal("archives of the same tree differ")
+	}
+
+	tf := openArchive(t, tempFile(t, "r.tar", first))
+	want := map[string]int64{"src": 0755, "src/a": 0755, "src/b": 0644, "src/l": 0777, "src/sub": 0755, "src/sub/c": 0644}
+	var names []string
+	for ti := range tf.Members {
+		names = append(names, ti.Name)
+		if ti.Mode != want[ti.Name] || ti.UID != 0 || ti.Uname != "" || ti.Mtime.Unix() != 0 {
+			t.Errorf("%s: mode %o, owner %d/%q, mtime %v", ti.Name, ti.Mode, ti.UID, ti.Uname, ti.Mtime)
+		}
+	}
+	if got := strings.Join(names, " "); got != "src src/a src/b src/l src/sub src/sub/c" {
+		t.Errorf("members in order %s", got)
+	}
+}
+
+func TestMaxExtractSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sizes.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if _, err := tf.AddBytes(name, make([]byte, 600), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tf.Close()
+
+	tf = openArchive(t, path, WithMaxExtractSize(1000))
+	dest := t.TempDir()
+	var tarErr *TarError
+	if err := tf.ExtractAll(dest); !errors.As(err, &tarErr) {
+		t.Errorf("ExtractAll() = %v, want a TarError", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "a")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "b")); err == nil {
+		t.Error("member beyond the limit was extracted")
+	}
+
+	// Only the data regions of sparse members count.
+	for limit, ok := range map[int64]bool{6*4096 - 1: false, 6 * 4096: true} {
+		tf := openArchive(t, filepath.Join("testdata", "gnu-sparse.tar"), WithMaxExtractSize(limit))
+		if err := tf.ExtractAll(t.TempDir()); (err == nil) != ok {
+			t.Errorf("limit %d: ExtractAll() = %v", limit, err)
+		}
+	}
+}
+
+// A member declaring more data than the archive holds is rejected
+// before anything is written.
+func TestMemberLargerThanArchive(t *testing.T) {
+	bomb := NewTarInfo("bomb")
+	bomb.Size = 1 << 32
+	archive := append(headerBytes(t, bomb), make([]byte, BLOCKSIZE)...)
+	if tf, err := Open(tempFile(t, "bomb.tar", archive), "r", nil, 4096); err == nil {
+		tf.Close()
+		t.Error("opened an archive whose member is larger than the archive")
+	}
+}
+
+func TestExtractOldRegularTypes(t *testing.T) {
+	var archive bytes.Buffer
+	add := func(name, typ string, mode int64, data string) {
+		ti := NewTarInfo(name)
+		ti.Type, ti.Mode, ti.Size = typ, mode, int64(len(data))
+		if typ == AREGTYPE {
+			ti.Type = REGTYPE
+		}
+		header := headerBytes(t, ti)
+		if typ == AREGTYPE {
+			// ToBuf writes neither the old type byte nor file type bits
+			// in the mode.
+			header[156] = 0
+			copy(header[100:], fmt.Sprintf("%07o\x00", mode))
+			copy(header[148:], fmt.Sprintf("%06o\x00 ", calcChecksum(header)))
+		}
+		archive.Write(header)
+		if data != "" {
+			archive.WriteString(data)
+			archive.Write(make([]byte, BLOCKSIZE-len(data)))
+		}
+	}
+	add("cont", CONTTYPE, 0644, "contiguous")
+	add("old", AREGTYPE, 0644, "old")
+	add("dir/", AREGTYPE, 0755, "")
+	add("moded", AREGTYPE, 040755, "") // S_IFDIR left in the mode
+	archive.Write(make([]byte, 2*BLOCKSIZE))
+
+	tf := openArchive(t, tempFile(t, "old.tar", archive.Bytes()))
+	dest := t.TempDir()
+	if err := tf.ExtractAll(dest); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"cont": "contiguous", "old": "old"} {
+		if data, err := os.ReadFile(filepath.Join(dest, name)); err != nil || string(data) != want {
+			t.Errorf("%s: extracted %q, %v", name, data, err)
+		}
+	}
+	for _, name := range []string{"dir", "moded"} {
+		if st, err := os.Stat(filepath.Join(dest, name)); err != nil || !st.IsDir() {
+			t.Errorf("%s: not extracted as a directory: %v", name, err)
+		}
+	}
+}
+
+func TestWriteMemberTo(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	path := filepath.Join(t.TempDir(), "hash.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("f", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := NewTarInfo("d")
+	dir.Type = DIRTYPE
+	if err := tf.AddFile(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	tf = openArchive(t, path)
+	ti, err := tf.GetMember("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.New()
+	if n, err := tf.WriteMemberTo(ti, h); err != nil || n != int64(len(data)) {
+		t.Fatalf("WriteMemberTo() = %d, %v", n, err)
+	}
+	if want := sha256.Sum256(data); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Errorf("digest %x, want %x", h.Sum(nil), want)
+	}
+	if ti, err := tf.GetMember("d"); err != nil {
+		t.Fatal(err)
+	} else if _, err := tf.WriteMemberTo(ti, io.Discard); err == nil {
+		t.Error("WriteMemberTo() accepted a directory")
+	}
+
+	tf = openArchive(t, filepath.Join("testdata", "gnu-sparse.tar"))
+	ti, err = tf.GetMember("sparse.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := tf.WriteMemberTo(ti, &buf); err != nil || !bytes.Equal(buf.Bytes(), sparseContent()) {
+		t.Errorf("WriteMemberTo() of a sparse member wrote %d bytes, %v", buf.Len(), err)
+	}
+}
+
+func TestExtractOverwrite(t *testing.T) {
+	newer, older := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	existing := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "overwrite.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, mtime := range map[string]time.Time{"newer": newer, "older": older} {
+		if err := tf.AddReader(name, strings.NewReader("new"), 3, func(ti *TarInfo) { ti.Mtime = mtime }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := NewTarInfo("l")
+	link.Type, link.Linkname, link.Mtime = SYMTYPE, "newer", newer
+	if err := tf.AddFile(link, nil); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	for _, tt := range []struct {
+		policy       int
+		newer, older string
+		link         string
+	}{
+		{OverwriteAlways, "new", "new", "newer"},
+		{OverwriteNever, "old", "old", "other"},
+		{OverwriteIfNewer, "new", "old", "newer"},
+	} {
+		dest := t.TempDir()
+		for _, name := range []string{"newer", "older"} {
+			p := filepath.Join(dest, name)
+			if err := os.WriteFile(p, []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(p, existing, existing); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Symlink("other", filepath.Join(dest, "l")); err != nil {
+			t.Fatal(err)
+		}
+
+		tf := openArchive(t, path, WithOverwrite(tt.policy))
+		if err := tf.ExtractAll(dest); err != nil {
+			t.Fatalf("policy %d: %v", tt.policy, err)
+		}
+		for name, want := range map[string]string{"newer": tt.newer, "older": tt.older} {
+			p := filepath.Join(dest, name)
+			data, err := os.ReadFile(p)
+			if err != nil || string(data) != want {
+				t.Errorf("policy %d: %s = %q, %v, want %q", tt.policy, name, data, err, want)
+			}
+			// Replaced files get the mtime of their member.
+			wantMtime := existing
+			if want == "new" {
+				wantMtime = map[string]time.Time{"newer": newer, "older": older}[name]
+			}
+			if st, err := os.Stat(p); err != nil {
+				t.Error(err)
+			} else if !st.ModTime().Equal(wantMtime) {
+				t.Errorf("policy %d: %s has mtime %v, want %v", tt.policy, name, st.ModTime(), wantMtime)
+			}
+		}
+		if target, err := os.Readlink(filepath.Join(dest, "l")); err != nil || target != tt.link {
+			t.Errorf("policy %d: link points to %q, %v, want %q", tt.policy, target, err, tt.link)
+		}
+		if skipped := len(tf.GetSkippedErrors()); (tt.policy == OverwriteNever) != (skipped > 0) {
+			t.Errorf("policy %d: %d errors skipped", tt.policy, skipped)
+		}
+	}
+}
+
+func TestExtractSymlinkMtime(t *testing.T) {
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "link.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := NewTarInfo("l")
+	link.Type, link.Linkname, link.Mtime = SYMTYPE, "missing", mtime
+	if err := tf.AddFile(link, nil); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	tf = openArchive(t, path)
+	dest := t.TempDir()
+	if err := tf.ExtractAll(dest); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Lstat(filepath.Join(dest, "l")); err != nil {
+		t.Fatal(err)
+	} else if !st.ModTime().Equal(mtime) {
+		t.Errorf("symlink mtime %v, want %v", st.ModTime(), mtime)
+	}
+}
+
+func TestAddSocket(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "f"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", filepath.Join(src, "sock"))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	for _, strict := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "socket.tar")
+		tf, err := Open(path, "w", nil, 4096, WithStrictTypes(strict))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tf.Add(src, "src", true, nil)
+		var unsupported *UnsupportedTypeError
+		if strict != errors.As(err, &unsupported) || !strict && err != nil {
+			t.Errorf("strict %v: Add() = %v", strict, err)
+		}
+		tf.Close()
+		if strict {
+			continue
+		}
+		tf = openArchive(t, path)
+		if names, err := tf.GetNames(); err != nil || !slices.Equal(names, []string{"src", "src/f"}) {
+			t.Errorf("archived %v, %v", names, err)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "walk.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := NewTarInfo("d")
+	dir.Type = DIRTYPE
+	if err := tf.AddFile(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int{"d/a": 100, "d/b": 2000, "c": 0} {
+		if _, err := tf.AddBytes(name, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tf.Close()
+
+	tf = openArchive(t, path)
+	var total int64
+	err = tf.Walk(func(ti *TarInfo, r io.Reader) error {
+		n, err := io.Copy(io.Discard, r)
+		total += n
+		return err
+	})
+	if err != nil || total != 2100 {
+		t.Errorf("Walk() summed %d bytes, %v", total, err)
+	}
+
+	var visited []string
+	stop := errors.New("stop")
+	err = tf.Walk(func(ti *TarInfo, r io.Reader) error {
+		visited = append(visited, ti.Name)
+		switch {
+		case ti.IsDir():
+			return SkipMember
+		case len(visited) == 3:
+			return stop
+		}
+		return nil
+	})
+	if err != stop || len(visited) != 3 {
+		t.Errorf("Walk() = %v after visiting %v, want it to stop at the third member", err, visited)
+	}
+}
+
+func TestExtractErrorContext(t *testing.T) {
+	tf := openArchive(t, tempFile(t, "a.tar", tarBytes(t, "a/b")))
+	ti, err := tf.GetMember("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	// "a" is in the way as a regular file.
+	if err := os.WriteFile(filepath.Join(dest, "a"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = tf.Extract(ti, dest)
+	var ee *ExtractError
+	if !errors.As(err, &ee) {
+		t.Fatalf("Extract() = %v, want an ExtractError", err)
+	}
+	if ee.Member != "a/b" || ee.Path != filepath.Join(dest, "a/b") {
+		t.Errorf("ExtractError for member %q at %q", ee.Member, ee.Path)
+	}
+	if !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("Extract() = %v, want it to wrap ENOTDIR", err)
+	}
+}
+
+func TestAddFileChecks(t *testing.T) {
+	tf := openArchive(t, tempFile(t, "r.tar", tarBytes(t, "a")))
+	if err := tf.AddFile(NewTarInfo("b"), nil); err == nil {
+		t.Error("AddFile() succeeded in read mode")
+	}
+
+	tf, err := Open(filepath.Join(t.TempDir(), "w.tar"), "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	ti := NewTarInfo("short")
+	ti.Size = 10
+	err = tf.AddFile(ti, strings.NewReader("abc"))
+	if _, ok := err.(*ReadError); !ok {
+		t.Errorf("AddFile() with a short reader = %v, want a ReadError", err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	path := tempFile(t, "a.tar", tarBytes(t, "a"))
+	r := openArchive(t, path)
+	member, err := r.GetMember("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	w, err := Open(filepath.Join(t.TempDir(), "w.tar"), "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	dest := t.TempDir()
+	walk := func(*TarInfo, io.Reader) error { return nil }
+
+	for name, call := range map[string]func() error{
+		"GetMember":          func() error { _, err := r.GetMember("a"); return err },
+		"GetMembers":         func() error { _, err := r.GetMembers(); return err },
+		"GetMemberAt":        func() error { _, err := r.GetMemberAt(0); return err },
+		"NumMembers":         func() error { _, err := r.NumMembers(); return err },
+		"GetNames":           func() error { _, err := r.GetNames(); return err },
+		"GetMembersMatching": func() error { _, err := r.GetMembersMatching("*"); return err },
+		"List":               func() error { return r.List(io.Discard, false) },
+		"Next":               func() error { _, err := r.Next(); return err },
+		"NextHeader":         func() error { _, err := r.NextHeader(); return err },
+		"Walk":               func() error { return r.Walk(walk) },
+		"Verify":             func() error { return r.Verify() },
+		"Extract":            func() error { return r.Extract(member, dest) },
+		"ExtractTo":          func() error { return r.ExtractTo("a", dest) },
+		"ExtractAll":         func() error { return r.ExtractAll(dest) },
+		"ExtractMatching":    func() error { return r.ExtractMatching("*", dest) },
+		"ExtractAllParallel": func() error { return r.ExtractAllParallel(dest, 2) },
+		"WriteMemberTo":      func() error { _, err := r.WriteMemberTo(member, io.Discard); return err },
+		"ReadMemberInto":     func() error { _, err := r.ReadMemberInto(member, make([]byte, 1)); return err },
+		"GetTarInfo":         func() error { _, err := w.GetTarInfo(path, "a", nil); return err },
+		"Add":                func() error { return w.Add(path, "a", false, nil) },
+		"Plan":               func() error { _, err := w.Plan(path, "a", false, nil); return err },
+		"AddFile":            func() error { return w.AddFile(NewTarInfo("a"), nil) },
+		"AddBytes":           func() error { _, err := w.AddBytes("a", nil, 0644); return err },
+		"AddReader":          func() error { return w.AddReader("a", strings.NewReader(""), 0) },
+		"CopyMemberFrom":     func() error { return w.CopyMemberFrom(r, member) },
+		"Flush":              func() error { return w.Flush() },
+	} {
+		if err := call(); err == nil || !strings.Contains(err.Error(), "TarFile is closed") {
+			t.Errorf("%s() = %v, want a closed error", name, err)
+		}
+	}
+	if r.HasMember("a") {
+		t.Error("HasMember() found a member of a closed archive")
+	}
+	if _, ok := r.LookupMember("a"); ok {
+		t.Error("LookupMember() found a member of a closed archive")
+	}
+}
+
+func TestExtractSpecialModeBits(t *testing.T) {
+	src := tempFile(t, "suid", []byte("#!/bin/sh\n"))
+	if err := os.Chmod(src, 04755); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]os.FileMode{"suid": os.ModeSetuid | 0755, "sticky": os.ModeDir | os.ModeSticky | 0777}
+	if st, err := os.Stat(src); err != nil {
+		t.Fatal(err)
+	} else if st.Mode()&os.ModeSetuid == 0 {
+		// Some file systems and sandboxes drop the bit.
+		t.Log("setuid bit not supported here")
+		delete(want, "suid")
+	}
+	dir := NewTarInfo("sticky")
+	dir.Type, dir.Mode = DIRTYPE, 01777
+	path := filepath.Join(t.TempDir(), "modes.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.Add(src, "suid", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.AddFile(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	tf = openArchive(t, path)
+	dest := t.TempDir()
+	if err := tf.ExtractAll(dest); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range want {
+		if st, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Error(err)
+		} else if st.Mode() != want {
+			t.Errorf("%s: mode %v, want %v", name, st.Mode(), want)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	type report struct{ done, total int64 }
+	var reports []report
+	var tf *TarFile
+	progress := func(ti *TarInfo, done, total int64) {
+		tf.GetFormat() // Must not deadlock.
+		reports = append(reports, report{done, total})
+	}
+	path := filepath.Join(t.TempDir(), "progress.tar")
+	tf, err := Open(path, "w", nil, 4096, WithProgress(progress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := []int{100000, 50000, 0}
+	for i, size := range sizes {
+		reports = nil
+		if _, err := tf.AddBytes(fmt.Sprint(i), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if last := reports[len(reports)-1]; last != (report{int64(size), int64(size)}) {
+			t.Errorf("AddBytes of %d bytes last reported %v", size, last)
+		}
+	}
+	tf.Close()
+
+	reports = nil
+	tf, err = Open(path, "r", nil, 4096, WithProgress(progress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	if err := tf.ExtractAll(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if last := reports[len(reports)-1]; last != (report{150000, 150000}) {
+		t.Errorf("ExtractAll last reported %v", last)
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i].done < reports[i-1].done {
+			t.Fatalf("progress went back from %v to %v", reports[i-1], reports[i])
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"a.go", "b.txt", "sub/c.go", "sub/d.txt"} {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	noText := func(ti *TarInfo) (*TarInfo, error) {
+		if strings.HasSuffix(ti.Name, ".txt") {
+			return nil, nil
+		}
+		return ti, nil
+	}
+	path := filepath.Join(t.TempDir(), "plan.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := tf.Plan(src, "src", true, noText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(path); err != nil || st.Size() != 0 {
+		t.Errorf("Plan() wrote to the archive: %v, %v", st, err)
+	}
+	if err := tf.Add(src, "src", true, noText); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	tf = openArchive(t, path)
+	members, err := tf.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	describe := func(tis []*TarInfo) []string {
+		var s []string
+		for _, ti := range tis {
+			s = append(s, fmt.Sprintf("%s %s %o %d", ti.Name, ti.Type, ti.Mode, ti.Size))
+		}
+		return s
+	}
+	if got, want := describe(plan), describe(members); !slices.Equal(got, want) {
+		t.Errorf("Plan() = %v, Add() wrote %v", got, want)
+	}
+	if len(plan) != 4 {
+		t.Errorf("planned %d members, want src, src/a.go, src/sub and src/sub/c.go", len(plan))
+	}
+}
+
+func TestGetMemberAt(t *testing.T) {
+	names := make([]string, 10)
+	for i := range names {
+		names[i] = fmt.Sprint(i)
+	}
+	tf := openArchive(t, tempFile(t, "ten.tar", tarBytes(t, names...)))
+	for _, i := range []int{5, 0, 9} {
+		ti, err := tf.GetMemberAt(i)
+		if err != nil || ti.Name != names[i] {
+			t.Errorf("GetMemberAt(%d) = %v, %v", i, ti, err)
+		}
+		if i == 5 && tf.IsLoaded() {
+			t.Error("GetMemberAt(5) read all headers")
+		}
+	}
+	for _, i := range []int{-1, 10} {
+		if ti, err := tf.GetMemberAt(i); err == nil {
+			t.Errorf("GetMemberAt(%d) = %v", i, ti)
+		}
+	}
+	if n, err := tf.NumMembers(); err != nil || n != 10 {
+		t.Errorf("NumMembers() = %d, %v", n, err)
+	}
+}
+
+func TestGetMembersMatching(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "match.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := NewTarInfo("docs")
+	dir.Type = DIRTYPE
+	if err := tf.AddFile(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.go", "docs/c.txt", "docs/deep/d.txt"} {
+		if _, err := tf.AddBytes(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tf.Close()
+
+	tf = openArchive(t, path)
+	for pattern, want := range map[string][]string{
+		"*.txt":        {"a.txt"},
+		"docs/*/*.txt": {"docs/deep/d.txt"},
+		"*.rs":         nil,
+	} {
+		matches, err := tf.GetMembersMatching(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, ti := range matches {
+			names = append(names, ti.Name)
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("GetMembersMatching(%q) = %v, want %v", pattern, names, want)
+		}
+	}
+	if _, err := tf.GetMembersMatching("["); err == nil {
+		t.Error("GetMembersMatching() accepted a bad pattern")
+	}
+
+	dest := t.TempDir()
+	if err := tf.ExtractMatching("docs", dest); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"docs/c.txt": true, "docs/deep/d.txt": true, "a.txt": false} {
+		if _, err := os.Stat(filepath.Join(dest, name)); (err == nil) != want {
+			t.Errorf("%s extracted %v, want %v", name, err == nil, want)
+		}
+	}
+}
+
+func TestTrailingGarbage(t *testing.T) {
+	garbage := make([]byte, 4096)
+	rand.NewChaCha8([32]byte{7}).Read(garbage)
+	archive := append(tarBytes(t, "a", "b"), garbage...)
+
+	path := tempFile(t, "garbage.tar", archive)
+	tf := openArchive(t, path)
+	if names, err := tf.GetNames(); err != nil || !slices.Equal(names, []string{"a", "b"}) {
+		t.Errorf("GetNames() = %v, %v", names, err)
+	}
+	if err := tf.ExtractAll(t.TempDir()); err != nil {
+		t.Errorf("ExtractAll() = %v", err)
+	}
+
+	tf, err := Open(path, "r|", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	var names []string
+	for {
+		ti, err := tf.Next()
+		if err != nil {
+			t.Fatal(err)
+		} else if ti == nil {
+			break
+		}
+		names = append(names, ti.Name)
+	}
+	if !slices.Equal(names, []string{"a", "b"}) {
+		t.Errorf("read %v from a stream", names)
+	}
+}
+
+func TestLookupMember(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lookup.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"first", "other", "second"} {
+		name := "dup"
+		if data == "other" {
+			name = "other"
+		}
+		if _, err := tf.AddBytes(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tf.Close()
+
+	tf = openArchive(t, path)
+	if !tf.HasMember("other") || tf.HasMember("missing") {
+		t.Error("HasMember() is wrong")
+	}
+	if ti, ok := tf.LookupMember("missing"); ok || ti != nil {
+		t.Errorf("LookupMember(missing) = %v, %v", ti, ok)
+	}
+	ti, ok := tf.LookupMember("dup")
+	if !ok {
+		t.Fatal("LookupMember(dup) found nothing")
+	}
+	var data bytes.Buffer
+	if _, err := tf.WriteMemberTo(ti, &data); err != nil || data.String() != "second" {
+		t.Errorf("LookupMember(dup) found the member holding %q, %v, want the last one", data.String(), err)
+	}
+}
+
+func TestExtractDirMtime(t *testing.T) {
+	mtimes := map[string]time.Time{
+		"d":     time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+		"d/sub": time.Date(2002, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	path := filepath.Join(t.TempDir(), "dirs.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"d", "d/sub"} {
+		dir := NewTarInfo(name)
+		dir.Type, dir.Mode, dir.Mtime = DIRTYPE, 0755, mtimes[name]
+		if err := tf.AddFile(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Written into both directories after they were created.
+	for _, name := range []string{"d/f", "d/sub/g"} {
+		if _, err := tf.AddBytes(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tf.Close()
+
+	tf = openArchive(t, path)
+	dest := t.TempDir()
+	if err := tf.ExtractAll(dest); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range mtimes {
+		if st, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Error(err)
+		} else if !st.ModTime().Equal(want) {
+			t.Errorf("%s: mtime %v, want %v", name, st.ModTime(), want)
+		}
+	}
+}
+
+func TestMaxMembers(t *testing.T) {
+	// 100 empty members are just 100 header blocks.
+	var archive bytes.Buffer
+	for i := 0; i < 100; i++ {
+		archive.Write(headerBytes(t, NewTarInfo(fmt.Sprint(i))))
+	}
+	archive.Write(make([]byte, 2*BLOCKSIZE))
+	path := tempFile(t, "many.tar", archive.Bytes())
+
+	tf := openArchive(t, path, WithMaxMembers(10))
+	if _, err := tf.GetMembers(); !errorAs[*MemberLimitError](err) {
+		t.Errorf("GetMembers() = %v, want a MemberLimitError", err)
+	}
+	if err := tf.ExtractAll(t.TempDir()); !errorAs[*MemberLimitError](err) {
+		t.Errorf("ExtractAll() = %v, want a MemberLimitError", err)
+	}
+
+	tf, err := Open(path, "r|", nil, 4096, WithMaxMembers(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	n := 0
+	for ; ; n++ {
+		var ti *TarInfo
+		if ti, err = tf.Next(); err != nil || ti == nil {
+			break
+		}
+	}
+	if n != 10 || !errorAs[*MemberLimitError](err) {
+		t.Errorf("Next() = %v after %d members", err, n)
+	}
+
+	tf = openArchive(t, path, WithMaxMembers(100))
+	if n, err := tf.NumMembers(); err != nil || n != 100 {
+		t.Errorf("NumMembers() = %d, %v at the limit", n, err)
+	}
+}
+
+func TestAppendMaxMembers(t *testing.T) {
+	dir := t.TempDir()
+	for _, comptype := range []string{"", "gz"} {
+		path := filepath.Join(dir, "append.tar."+comptype)
+		suffix := ""
+		if comptype != "" {
+			suffix = ":" + comptype
+		}
+		writeArchive(t, path, "w"+suffix, "a", "b", "c")
+
+		if _, err := Open(path, "a"+suffix, nil, 4096, WithMaxMembers(2)); !errorAs[*MemberLimitError](err) {
+			t.Errorf("%q: Open() = %v, want a MemberLimitError", "a"+suffix, err)
+		}
+		tf, err := Open(path, "a"+suffix, nil, 4096, WithMaxMembers(3))
+		if err != nil {
+			t.Fatalf("%q: Open() at the limit: %v", "a"+suffix, err)
+		}
+		if err := tf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAddSparse(t *testing.T) {
+	const size = 1 << 20
+	want := make([]byte, size)
+	copy(want, bytes.Repeat([]byte("a"), 4096))
+	copy(want[size/2:], bytes.Repeat([]byte("b"), 4096))
+	src := filepath.Join(t.TempDir(), "sparse")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{0, size / 2} {
+		if _, err := f.WriteAt(want[off:off+4096], off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	path := filepath.Join(t.TempDir(), "sparse.tar")
+	tf, err := Open(path, "w", nil, 4096, WithFormat(GNU_FORMAT), WithSparse(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti, err := tf.GetTarInfo(src, "sparse", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ti.IsSparse() {
+		t.Skip("file system does not report holes")
+	}
+	if err := tf.Add(src, "sparse", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	// An explicit map for data that is not sparse on disk.
+	explicit := NewTarInfo("explicit")
+	explicit.Size = size
+	explicit.Sparse = [][2]int64{{0, 4096}, {size / 2, 4096}}
+	if err := tf.AddFile(explicit, bytes.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+	if st, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if st.Size() >= size {
+		t.Errorf("archive of %d bytes stores the holes", st.Size())
+	}
+
+	tf = openArchive(t, path)
+	err = tf.Walk(func(ti *TarInfo, r io.Reader) error {
+		var regions [][2]int64
+		for _, region := range ti.Sparse {
+			if region[1] > 0 {
+				regions = append(regions, region)
+			}
+		}
+		if ti.Type != GNUTYPE_SPARSE || ti.Size != size || !slices.Equal(regions, [][2]int64{{0, 4096}, {size / 2, 4096}}) {
+			t.Errorf("%s: type %q, size %d, map %v", ti.Name, ti.Type, ti.Size, ti.Sparse)
+		}
+		data, err := io.ReadAll(r)
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s: read %d bytes that differ from the file", ti.Name, len(data))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadMemberInto(t *testing.T) {
+	tf := openArchive(t, tempFile(t, "a.tar", tarBytes(t, "name")))
+	ti, err := tf.GetMember("name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		size int
+		want string
+		err  error
+	}{
+		{2, "na", nil},
+		{4, "name", nil},
+		{8, "name", io.EOF},
+	} {
+		buf := make([]byte, tt.size)
+		if n, err := tf.ReadMemberInto(ti, buf); string(buf[:n]) != tt.want || err != tt.err {
+			t.Errorf("ReadMemberInto(%d bytes) = %q, %v, want %q, %v", tt.size, buf[:n], err, tt.want, tt.err)
+		}
+	}
+
+	tf = openArchive(t, "testdata/gnu-sparse.tar")
+	members, err := tf.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sparseContent()
+	buf := make([]byte, len(want)+1)
+	if n, err := tf.ReadMemberInto(members[0], buf); err != io.EOF || !bytes.Equal(buf[:n], want) {
+		t.Errorf("ReadMemberInto(sparse member) read %d bytes, %v", n, err)
+	}
+}
+
+func BenchmarkReadMemberInto(b *testing.B) {
+	names := make([]string, 5000)
+	for i := range names {
+		names[i] = fmt.Sprintf("dir/file%05d", i)
+	}
+	tf := openArchive(b, tempFile(b, "many.tar", tarBytes(b, names...)))
+	members, err := tf.GetMembers()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("ReadMemberInto", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := make([]byte, 512)
+		for i := 0; i < b.N; i++ {
+			if _, err := tf.ReadMemberInto(members[i%len(members)], buf); err != nil && err != io.EOF {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ExFileObject", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := make([]byte, 512)
+		for i := 0; i < b.N; i++ {
+			f := NewExFileObject(tf, members[i%len(members)])
+			if _, err := io.ReadFull(f, buf); err != nil && err != io.ErrUnexpectedEOF {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestAddContiguous(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"cont", "reg"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name+" data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "cont.tar")
+	tf, err := Open(path, "w", nil, 4096, WithContiguous(func(ti *TarInfo) bool { return ti.Name == "cont" }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cont", "reg"} {
+		if err := tf.Add(filepath.Join(dir, name), name, false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tf.Close()
+	archive, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf = openArchive(t, path)
+	for name, typ := range map[string]string{"cont": CONTTYPE, "reg": REGTYPE} {
+		ti, err := tf.GetMember(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flag := archive[ti.OffsetData-BLOCKSIZE+156]; string(flag) != typ {
+			t.Errorf("%s: typeflag %q, want %q", name, flag, typ)
+		}
+		if ti.Type != typ || !ti.IsReg() {
+			t.Errorf("%s: type %q, IsReg %v, want %q", name, ti.Type, ti.IsReg(), typ)
+		}
+	}
+	out := t.TempDir()
+	if err := tf.ExtractAll(out); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(out, "cont")); err != nil || string(data) != "cont data" {
+		t.Errorf("extracted cont = %q, %v", data, err)
+	}
+}
+
+func TestStrictPadding(t *testing.T) {
+	data := tarBytes(t, "a", "b")
+	tf := openArchive(t, tempFile(t, "a.tar", data))
+	ti, err := tf.GetMember("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[ti.OffsetData+ti.Size+1] = 'x'
+	path := tempFile(t, "bad.tar", data)
+
+	if members, err := openArchive(t, path).GetMembers(); err != nil || len(members) != 2 {
+		t.Errorf("GetMembers() without strict padding = %d members, %v", len(members), err)
+	}
+	if _, err := openArchive(t, path, WithStrictPadding(true)).GetMembers(); !errorAs[*ReadError](err) {
+		t.Errorf("GetMembers() with strict padding = %v, want a ReadError", err)
+	}
+	tf = openArchive(t, path, WithStrictPadding(true))
+	if ti, err := tf.Next(); err != nil || ti.Name != "a" {
+		t.Fatalf("Next() = %v, %v", ti, err)
+	}
+	if _, err := tf.Next(); !errorAs[*ReadError](err) {
+		t.Errorf("Next() after the corrupt padding = %v, want a ReadError", err)
+	}
+}
+
+func TestExtractFlattenSymlinks(t *testing.T) {
+	write := func(links map[string]string) string {
+		path := filepath.Join(t.TempDir(), "links.tar")
+		tf, err := Open(path, "w", nil, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tf.AddBytes("dir/target", []byte("target data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range slices.Sorted(maps.Keys(links)) {
+			link := NewTarInfo(name)
+			link.Type = SYMTYPE
+			link.Linkname = links[name]
+			if err := tf.AddFile(link, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tf.Close()
+		return path
+	}
+
+	dest := t.TempDir()
+	tf := openArchive(t, write(map[string]string{"dir/link": "target", "chain": "dir/link"}), WithFlattenSymlinks(true))
+	if err := tf.ExtractAll(dest); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dir/link", "chain"} {
+		fi, err := os.Lstat(filepath.Join(dest, name))
+		if err != nil || !fi.Mode().IsRegular() || fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: %v, %v, want a regular file like the target", name, fi, err)
+			continue
+		}
+		if data, err := os.ReadFile(filepath.Join(dest, name)); err != nil || string(data) != "target data" {
+			t.Errorf("%s = %q, %v", name, data, err)
+		}
+	}
+
+	tf = openArchive(t, write(map[string]string{"dir/escape": "../../outside"}), WithFlattenSymlinks(true))
+	if err := tf.ExtractAll(t.TempDir()); !errorAs[*LinkOutsideDestinationError](err) {
+		t.Errorf("link outside the archive gave %v, want a LinkOutsideDestinationError", err)
+	}
+
+	path := write(map[string]string{"dir/dangling": "missing"})
+	for _, level := range []int{1, 2} {
+		tf = openArchive(t, path, WithFlattenSymlinks(true))
+		tf.SetErrorLevel(level)
+		dest := t.TempDir()
+		err := tf.ExtractAll(dest)
+		if level == 1 && (err != nil || len(tf.GetSkippedErrors()) != 1) {
+			t.Errorf("level 1: dangling link gave %v, skipped %v", err, tf.GetSkippedErrors())
+		}
+		if level == 2 && !errorAs[*ExtractError](err) {
+			t.Errorf("level 2: dangling link gave %v, want an ExtractError", err)
+		}
+		if _, err := os.Lstat(filepath.Join(dest, "dir/dangling")); err == nil {
+			t.Errorf("level %d: dangling link was extracted", level)
+		}
+	}
+}
+
+func TestExtractExactMode(t *testing.T) {
+	old := syscall.Umask(027)
+	defer syscall.Umask(old)
+	path := filepath.Join(t.TempDir(), "modes.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("file", []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	for _, tt := range []struct {
+		exact bool
+		want  os.FileMode
+	}{
+		{false, 0640},
+		{true, 0666},
+	} {
+		dest := t.TempDir()
+		if err := openArchive(t, path, WithExactMode(tt.exact)).ExtractAll(dest); err != nil {
+			t.Fatal(err)
+		}
+		if st, err := os.Stat(filepath.Join(dest, "file")); err != nil {
+			t.Error(err)
+		} else if st.Mode() != tt.want {
+			t.Errorf("exact %v: mode %v, want %v", tt.exact, st.Mode(), tt.want)
+		}
+	}
+}
+
+func TestAddShouldInclude(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "repo")
+	for _, name := range []string{".git/objects/ab/cdef", ".git/HEAD", "src/main.go", "README"} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var statted []string
+	origLstat := lstatFile
+	lstatFile = func(path string, stat *syscall.Stat_t) error {
+		statted = append(statted, path)
+		return origLstat(path, stat)
+	}
+	t.Cleanup(func() { lstatFile = origLstat })
+
+	path := filepath.Join(t.TempDir(), "repo.tar")
+	tf, err := Open(path, "w", nil, 4096, WithShouldInclude(func(path string, d fs.DirEntry) bool {
+		return !(d.IsDir() && d.Name() == ".git")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.Add(root, "repo", true, nil); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	if len(statted) != 4 {
+		t.Errorf("statted %q, want repo, README, src and src/main.go", statted)
+	}
+	for _, path := range statted {
+		if strings.Contains(path, ".git") {
+			t.Errorf("statted %s", path)
+		}
+	}
+	names, err := openArchive(t, path).GetNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"repo", "repo/README", "repo/src", "repo/src/main.go"}; !slices.Equal(names, want) {
+		t.Errorf("archived %v, want %v", names, want)
+	}
+}
+
+func TestNextHeaderEOF(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":   tarBytes(t),
+		"members": tarBytes(t, "a", "b"),
+	} {
+		tf := openArchive(t, tempFile(t, name+".tar", data))
+		n := 0
+		for {
+			_, err := tf.NextHeader()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			n++
+		}
+		if _, err := tf.NextHeader(); !errors.Is(err, io.EOF) {
+			t.Errorf("%s: NextHeader() after the end = %v, want io.EOF", name, err)
+		}
+		// Next keeps returning a nil member.
+		if ti, err := tf.Next(); ti != nil || err != nil {
+			t.Errorf("%s: Next() after the end = %v, %v", name, ti, err)
+		}
+		if members, err := tf.GetMembers(); err != nil || len(members) != n {
+			t.Errorf("%s: GetMembers() = %d members, %v, want %d", name, len(members), err, n)
+		}
+	}
+
+	// A truncated archive is an error, not an empty one, even if only the
+	// data of its first extended header is cut off.
+	data, err := NewTarInfo(strings.Repeat("n", 200)).ToBuf(PAX_FORMAT, ENCODING, "surrogateescape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{BLOCKSIZE / 2, BLOCKSIZE + 100} {
+		if _, err := Open(tempFile(t, "truncated.tar", data[:size]), "r", nil, 4096); !errorAs[*ReadError](err) {
+			t.Errorf("Open(%d bytes of an archive) = %v, want a ReadError", size, err)
+		}
+	}
+}
+
+func TestTolerantUnpadded(t *testing.T) {
+	var archive bytes.Buffer
+	a := NewTarInfo("a")
+	a.Size = 5
+	archive.Write(headerBytes(t, a))
+	archive.WriteString("hello") // No padding
+	b := NewTarInfo("b")
+	b.Size = 5
+	archive.Write(headerBytes(t, b))
+	archive.WriteString("world")
+	archive.Write(make([]byte, BLOCKSIZE-5+2*BLOCKSIZE))
+	path := tempFile(t, "unpadded.tar", archive.Bytes())
+
+	if names, _ := openArchive(t, path).GetNames(); slices.Contains(names, "b") {
+		t.Errorf("found %v without realignment", names)
+	}
+	ignoreZeros := openArchive(t, path)
+	ignoreZeros.SetIgnoreZeros(true)
+	for name, tf := range map[string]*TarFile{
+		"tolerant":    openArchive(t, path, WithTolerant(true)),
+		"ignoreZeros": ignoreZeros,
+	} {
+		members, err := tf.GetMembers()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var got []string
+		for _, ti := range members {
+			buf := make([]byte, ti.Size)
+			if _, err := tf.ReadMemberInto(ti, buf); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			got = append(got, ti.Name+"="+string(buf))
+		}
+		if want := []string{"a=hello", "b=world"}; !slices.Equal(got, want) {
+			t.Errorf("%s: read %v, want %v", name, got, want)
+		}
+	}
+}
@@ -5,9 +5,16 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
 )
 
 // TarInfo represents metadata about a single tar archive member.
@@ -18,6 +25,8 @@ type TarInfo struct {
 	GID        int               // Group ID
 	Size       int64             // Size in bytes
 	Mtime      time.Time         // Modification time
+	Atime      time.Time         // Access time, zero if unknown (PAX only)
+	Ctime      time.Time         // Status change time, zero if unknown (PAX only)
 	Chksum     int               // Header checksum
 	Type       string            // File type (e.g., REGTYPE, DIRTYPE)
 	Linkname   string            // Target file name for links
@@ -29,9 +38,26 @@ type TarInfo struct {
 	OffsetData int64             // Offset of the data in the tar file
 	PaxHeaders map[string]string // PAX extended header key-value pairs
 	Sparse     [][2]int64        // Sparse file info: [offset, size]
+	Xattrs     map[string][]byte // Extended attributes (SCHILY.xattr records)
+	Dumpdir    []DumpdirEntry    // Directory listing of a GNUTYPE_DUMPDIR member
+	Format     int               // Format the member was read in, V7_FORMAT, USTAR_FORMAT, GNU_FORMAT or PAX_FORMAT
 	tarfile    *TarFile          // Reference to the containing TarFile (undocumented, deprecated)
+
+	sparseExtended bool  // Extended sparse headers follow the GNU sparse header
+	origSize       int64 // Real size of a GNU sparse file
+}
+
+// DumpdirEntry is an entry of the directory listing that GNU tar stores
+// in the data of a GNUTYPE_DUMPDIR member of an incremental archive.
+type DumpdirEntry struct {
+	Control byte   // 'Y' for files in the archive, 'N' for files not in it, 'D' for directories, 'R', 'T' or 'X' for renames
+	Name    string // Name of the entry, relative to the directory for 'Y', 'N' and 'D'
 }
 
+// xattrPrefix starts the keywords of PAX records that hold extended
+// attributes, as written by star and GNU tar.
+const xattrPrefix = "SCHILY.xattr."
+
 // NewTarInfo creates a new TarInfo object with default values.
 func NewTarInfo(name string) *TarInfo {
 	return &TarInfo{
@@ -55,6 +81,76 @@ func NewTarInfo(name string) *TarInfo {
 	}
 }
 
+// TarInfoFromFileInfo creates a TarInfo from fi without accessing the
+// file system, like FileInfoHeader of archive/tar. link is the target of
+// symbolic links. The member is named after the base name of fi. If fi
+// comes from TarInfo.FileInfo, the ownership and times of that member are
+// copied as well, and if fi.Sys() is a *syscall.Stat_t, the owner IDs,
+// times and device numbers are taken from it.
+func TarInfoFromFileInfo(fi os.FileInfo, link string) (*TarInfo, error) {
+	if fi == nil {
+		return nil, fmt.Errorf("fileinfo may not be nil")
+	}
+	mode := fi.Mode()
+	ti := NewTarInfo(fi.Name())
+	ti.Mode = int64(mode.Perm())
+	ti.Mtime = fi.ModTime()
+	switch {
+	case mode.IsRegular():
+		ti.Type = REGTYPE
+		ti.Size = fi.Size()
+	case mode.IsDir():
+		ti.Type = DIRTYPE
+	case mode&os.ModeSymlink != 0:
+		ti.Type = SYMTYPE
+		ti.Linkname = link
+	case mode&os.ModeDevice != 0:
+		if mode&os.ModeCharDevice != 0 {
+			ti.Type = CHRTYPE
+		} else {
+			ti.Type = BLKTYPE
+		}
+	case mode&os.ModeNamedPipe != 0:
+		ti.Type = FIFOTYPE
+	case mode&os.ModeSocket != 0:
+		return nil, NewUnsupportedTypeError(fi.Name(), "socket")
+	default:
+		return nil, NewUnsupportedTypeError(fi.Name(), fmt.Sprintf("file of unknown mode %v", mode))
+	}
+	if mode&os.ModeSetuid != 0 {
+		ti.Mode |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		ti.Mode |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		ti.Mode |= 01000
+	}
+
+	switch sys := fi.Sys().(type) {
+	case *TarInfo:
+		ti.UID, ti.GID = sys.UID, sys.GID
+		ti.Uname, ti.Gname = sys.Uname, sys.Gname
+		ti.Atime, ti.Ctime = sys.Atime, sys.Ctime
+		ti.DevMajor, ti.DevMinor = sys.DevMajor, sys.DevMinor
+		if sys.Xattrs != nil {
+			ti.Xattrs = make(map[string][]byte, len(sys.Xattrs))
+			for k, v := range sys.Xattrs {
+				ti.Xattrs[k] = append([]byte(nil), v...)
+			}
+		}
+	case *syscall.Stat_t:
+		ti.UID, ti.GID = int(sys.Uid), int(sys.Gid)
+		ti.Atime = time.Unix(sys.Atim.Sec, sys.Atim.Nsec)
+		ti.Ctime = time.Unix(sys.Ctim.Sec, sys.Ctim.Nsec)
+		if ti.Type == CHRTYPE || ti.Type == BLKTYPE {
+			ti.DevMajor = int(unix.Major(uint64(sys.Rdev)))
+			ti.DevMinor = int(unix.Minor(uint64(sys.Rdev)))
+		}
+	}
+	return ti, nil
+}
+
 // Path returns the name (alias for PAX "path").
 func (ti *TarInfo) Path() string {
 	return ti.Name
@@ -114,6 +210,53 @@ func (ti *TarInfo) Replace(name, linkname, uname, gname *string, mtime *time.Tim
 	return &result
 }
 
+// clone returns a deep copy of the TarInfo.
+func (ti *TarInfo) clone() *TarInfo {
+	result := *ti
+	result.PaxHeaders = make(map[string]string, len(ti.PaxHeaders))
+	for k, v := range ti.PaxHeaders {
+		result.PaxHeaders[k] = v
+	}
+	if ti.Sparse != nil {
+		result.Sparse = append([][2]int64(nil), ti.Sparse...)
+	}
+	return &result
+}
+
+// PaxRecord returns the value of the PAX record key of the member, such
+// as "comment" or a vendor record like "acme.build-id". Records of the
+// member's extended header and of preceding global headers are kept in
+// PaxHeaders when the member is read.
+func (ti *TarInfo) PaxRecord(key string) (string, bool) {
+	value, ok := ti.PaxHeaders[key]
+	return value, ok
+}
+
+// SetPaxRecord sets the PAX record key of the member to value. Archives
+// in PAX_FORMAT write it to the member's extended header, where records
+// for fields such as "mtime" or "path" take precedence over the values
+// derived from the TarInfo. Keys must not be empty or contain "=" or a
+// newline.
+func (ti *TarInfo) SetPaxRecord(key, value string) error {
+	if err := checkPaxKey(key); err != nil {
+		return err
+	}
+	if ti.PaxHeaders == nil {
+		ti.PaxHeaders = make(map[string]string)
+	}
+	ti.PaxHeaders[key] = value
+	return nil
+}
+
+// checkPaxKey checks that key can be written as the keyword of a PAX
+// record.
+func checkPaxKey(key string) error {
+	if key == "" || strings.ContainsAny(key, "=\n") {
+		return fmt.Errorf("invalid pax record key %q", key)
+	}
+	return nil
+}
+
 // GetInfo returns the TarInfo's attributes as a map.
 func (ti *TarInfo) GetInfo() map[string]interface{} {
 	info := map[string]interface{}{
@@ -128,8 +271,12 @@ func (ti *TarInfo) GetInfo() map[string]interface{} {
 		"linkname": ti.Linkname,
 		"uname":    ti.Uname,
 		"gname":    ti.Gname,
-		"devmajor": ti.DevMajor,
-		"devminor": ti.DevMinor,
+		"prefix":   "",
+	}
+	// Device numbers only mean something for character and block devices.
+	if ti.Type == CHRTYPE || ti.Type == BLKTYPE {
+		info["devmajor"] = ti.DevMajor
+		info["devminor"] = ti.DevMinor
 	}
 	if ti.Type == DIRTYPE && !strings.HasSuffix(info["name"].(string), "/") {
 		info["name"] = info["name"].(string) + "/"
@@ -144,6 +291,15 @@ func (ti *TarInfo) ToBuf(format int, encoding, errors string) ([]byte, error) {
 		if v == nil {
 			return nil, fmt.Errorf("%s may not be None", k)
 		}
+		// A NUL byte would end the string in the header, so the member
+		// would be read back with a different name.
+		if s, ok := v.(string); ok && strings.IndexByte(s, NUL) >= 0 {
+			return nil, fmt.Errorf("%s %q contains a NUL byte", k, s)
+		}
+	}
+	// Only the GNU format can store a sparse map next to the header.
+	if ti.IsSparse() && format != GNU_FORMAT {
+		return nil, fmt.Errorf("%s: sparse files can only be written in GNU format", ti.Name)
 	}
 	switch format {
 	case USTAR_FORMAT:
@@ -152,19 +308,24 @@ func (ti *TarInfo) ToBuf(format int, encoding, errors string) ([]byte, error) {
 		return ti.createGnuHeader(info, encoding, errors)
 	case PAX_FORMAT:
 		return ti.createPaxHeader(info, encoding)
+	case V7_FORMAT:
+		return ti.createV7Header(info, encoding, errors)
 	default:
 		return nil, fmt.Errorf("invalid format")
 	}
 }
 
+// ToBytes converts the TarInfo to its header in format with the default
+// encoding of a TarFile, without an open archive. Names too long for
+// the header make it longer than a block, with a GNU long name header or
+// a PAX extended header in front.
+func (ti *TarInfo) ToBytes(format int) ([]byte, error) {
+	return ti.ToBuf(format, ENCODING, "surrogateescape")
+}
+
 func (ti *TarInfo) createUstarHeader(info map[string]interface{}, encoding, errors string) ([]byte, error) {
 	info["magic"] = POSIX_MAGIC
 
-	// 初始化prefix字段
-	if _, exists := info["prefix"]; !exists {
-		info["prefix"] = ""
-	}
-
 	if len(info["linkname"].(string)) > LENGTH_LINK {
 		return nil, fmt.Errorf("linkname is too long")
 	}
@@ -179,14 +340,36 @@ func (ti *TarInfo) createUstarHeader(info map[string]interface{}, encoding, erro
 	return ti.createHeader(info, USTAR_FORMAT, encoding, errors)
 }
 
+// createV7Header creates a header of the Unix V7 format, which has no
+// magic, owner names, device numbers or name prefix. Regular files are
+// stored with the old AREGTYPE and directories as regular files whose
+// name ends in a slash; other members besides links cannot be stored.
+func (ti *TarInfo) createV7Header(info map[string]interface{}, encoding, errors string) ([]byte, error) {
+	info["magic"] = string(make([]byte, 8))
+	info["uname"] = ""
+	info["gname"] = ""
+	switch info["type"] {
+	case REGTYPE, AREGTYPE, CONTTYPE, DIRTYPE:
+		info["type"] = AREGTYPE
+	case LNKTYPE, SYMTYPE:
+	default:
+		return nil, fmt.Errorf("%s: type %q cannot be stored in V7 format", ti.Name, ti.Type)
+	}
+	for _, field := range []string{"name", "linkname"} {
+		b, err := encode(info[field].(string), encoding, errors)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > LENGTH_NAME {
+			return nil, fmt.Errorf("%s is too long", field)
+		}
+	}
+	return ti.createHeader(info, V7_FORMAT, encoding, errors)
+}
+
 func (ti *TarInfo) createGnuHeader(info map[string]interface{}, encoding, errors string) ([]byte, error) {
 	info["magic"] = GNU_MAGIC
 
-	// 初始化prefix字段
-	if _, exists := info["prefix"]; !exists {
-		info["prefix"] = ""
-	}
-
 	buf := []byte{}
 	if len(info["linkname"].(string)) > LENGTH_LINK {
 		longLink, err := ti.createGnuLongHeader(info["linkname"].(string), GNUTYPE_LONGLINK, encoding, errors)
@@ -202,25 +385,130 @@ func (ti *TarInfo) createGnuHeader(info map[string]interface{}, encoding, errors
 		}
 		buf = append(buf, longName...)
 	}
+	var extended []byte
+	if ti.IsSparse() {
+		if !ti.IsReg() {
+			return nil, fmt.Errorf("%s: only regular files can be sparse", ti.Name)
+		}
+		regions, err := ti.gnuSparseMap()
+		if err != nil {
+			return nil, err
+		}
+		sparse, ext, err := ti.createGnuSparse(regions)
+		if err != nil {
+			return nil, err
+		}
+		var size int64
+		for _, region := range regions {
+			size += region[1]
+		}
+		info["type"] = GNUTYPE_SPARSE
+		info["size"] = size
+		info["sparse"] = sparse
+		extended = ext
+	}
 	header, err := ti.createHeader(info, GNU_FORMAT, encoding, errors)
 	if err != nil {
 		return nil, err
 	}
-	return append(buf, header...), nil
+	buf = append(buf, header...)
+	return append(buf, extended...), nil
 }
 
-func (ti *TarInfo) createPaxHeader(info map[string]interface{}, encoding string) ([]byte, error) {
-	info["magic"] = POSIX_MAGIC
+// gnuSparseMap returns the sparse map the way GNU tar writes it. GNU tar
+// reads the data of every region from a new block, so the regions are
+// widened to whole blocks, merging those that meet, and the map ends with
+// a region at the real size, from which GNU tar takes the size of the
+// file.
+func (ti *TarInfo) gnuSparseMap() ([][2]int64, error) {
+	var regions [][2]int64
+	var last int64
+	for _, region := range ti.Sparse {
+		if region[0] < last || region[1] < 0 || region[0]+region[1] > ti.Size {
+			return nil, fmt.Errorf("%s: invalid sparse map", ti.Name)
+		}
+		last = region[0] + region[1]
+		if region[1] == 0 {
+			continue
+		}
+		start := region[0] / BLOCKSIZE * BLOCKSIZE
+		end := min(ti.block(region[0]+region[1]), ti.Size)
+		if n := len(regions); n > 0 && start <= regions[n-1][0]+regions[n-1][1] {
+			regions[n-1][1] = end - regions[n-1][0]
+			continue
+		}
+		regions = append(regions, [2]int64{start, end - start})
+	}
+	if n := len(regions); n == 0 && ti.Size > 0 || n > 0 && regions[n-1][0]+regions[n-1][1] < ti.Size {
+		regions = append(regions, [2]int64{ti.Size, 0})
+	}
+	if regions == nil {
+		regions = [][2]int64{}
+	}
+	return regions, nil
+}
+
+// createGnuSparse creates the fields of a GNU sparse header that take the
+// place of the ustar prefix, holding the first 4 regions of the sparse map
+// and the real size, and the extended sparse headers of 21 regions each
+// for the rest of the map.
+func (ti *TarInfo) createGnuSparse(regions [][2]int64) ([]byte, []byte, error) {
+	putStructs := func(buf []byte, regions [][2]int64) error {
+		for i, region := range regions {
+			for j, v := range region {
+				b, err := itn(v, 12, GNU_FORMAT)
+				if err != nil {
+					return err
+				}
+				copy(buf[i*24+j*12:], b)
+			}
+		}
+		return nil
+	}
+
+	// The prefix field starts at offset 345, the sparse map at 386.
+	sparse := make([]byte, LENGTH_PREFIX)
+	n := min(len(regions), 4)
+	if err := putStructs(sparse[41:137], regions[:n]); err != nil {
+		return nil, nil, err
+	}
+	if len(regions) > n {
+		sparse[137] = 1
+	}
+	realsize, err := itn(ti.Size, 12, GNU_FORMAT)
+	if err != nil {
+		return nil, nil, err
+	}
+	copy(sparse[138:150], realsize)
 
-	// 初始化prefix字段
-	if _, exists := info["prefix"]; !exists {
-		info["prefix"] = ""
+	var extended []byte
+	for regions = regions[n:]; len(regions) > 0; regions = regions[n:] {
+		n = min(len(regions), 21)
+		block := make([]byte, BLOCKSIZE)
+		if err := putStructs(block, regions[:n]); err != nil {
+			return nil, nil, err
+		}
+		if len(regions) > n {
+			block[504] = 1
+		}
+		extended = append(extended, block...)
 	}
+	return sparse, extended, nil
+}
+
+func (ti *TarInfo) createPaxHeader(info map[string]interface{}, encoding string) ([]byte, error) {
+	info["magic"] = POSIX_MAGIC
 
 	paxHeaders := make(map[string]string)
 	for k, v := range ti.PaxHeaders {
+		if ti.Xattrs != nil && strings.HasPrefix(k, xattrPrefix) {
+			continue
+		}
 		paxHeaders[k] = v
 	}
+	for name, value := range ti.Xattrs {
+		paxHeaders[xattrPrefix+name] = string(value)
+	}
 
 	// 定义字段映射
 	fields := [][3]interface{}{
@@ -240,8 +528,9 @@ func (ti *TarInfo) createPaxHeader(info map[string]interface{}, encoding string)
 		if _, ok := paxHeaders[hname]; ok {
 			continue
 		}
-		// 检查是否为纯数字（模拟 Python 的 ASCII 检查）
-		if _, err := strconv.ParseUint(n, 10, 64); err == nil {
+		// The ustar header is written as ASCII, so anything else has
+		// to go into the extended header.
+		if _, err := encode(n, "ascii", "strict"); err != nil {
 			paxHeaders[hname] = n
 			continue
 		}
@@ -250,6 +539,17 @@ func (ti *TarInfo) createPaxHeader(info map[string]interface{}, encoding string)
 		}
 	}
 
+	// The ustar header only holds whole seconds of the mtime and no other
+	// times.
+	if _, ok := paxHeaders["mtime"]; !ok && ti.Mtime.Nanosecond() != 0 {
+		paxHeaders["mtime"] = formatPaxTime(ti.Mtime)
+	}
+	for name, t := range map[string]time.Time{"atime": ti.Atime, "ctime": ti.Ctime} {
+		if _, ok := paxHeaders[name]; !ok && !t.IsZero() {
+			paxHeaders[name] = formatPaxTime(t)
+		}
+	}
+
 	// 处理数字字段
 	for name, digits := range map[string]int{
 		"mode":  8,
@@ -328,22 +628,27 @@ func (ti *TarInfo) createHeader(info map[string]interface{}, format int, encodin
 	var devMajor, devMinor []byte
 	var err error
 	if hasDeviceFields {
-		devMajor, err = itn(int64(info["devmajor"].(int)), 8, format)
+		major, _ := info["devmajor"].(int)
+		minor, _ := info["devminor"].(int)
+		devMajor, err = itn(int64(major), 8, format)
 		if err != nil {
 			return nil, err
 		}
-		devMinor, err = itn(int64(info["devminor"].(int)), 8, format)
+		devMinor, err = itn(int64(minor), 8, format)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		devMajor = stn("", 8, encoding)
-		devMinor = stn("", 8, encoding)
+		devMajor = make([]byte, 8)
+		devMinor = make([]byte, 8)
 	}
 
 	filetype := info["type"].(string)
 	parts := make([][]byte, 15) // 预分配 15 个元素，与字段数一致
-	parts[0] = stn(info["name"].(string), 100, encoding)
+	parts[0], err = stn(info["name"].(string), 100, encoding, errors)
+	if err != nil {
+		return nil, err
+	}
 
 	// mode
 	parts[1], err = itn(info["mode"].(int64), 8, format)
@@ -377,13 +682,30 @@ func (ti *TarInfo) createHeader(info map[string]interface{}, format int, encodin
 
 	parts[6] = []byte("        ") // checksum placeholder (8 spaces)
 	parts[7] = []byte(filetype)
-	parts[8] = stn(info["linkname"].(string), 100, encoding)
+	parts[8], err = stn(info["linkname"].(string), 100, encoding, errors)
+	if err != nil {
+		return nil, err
+	}
 	parts[9] = []byte(info["magic"].(string))
-	parts[10] = stn(info["uname"].(string), 32, encoding)
-	parts[11] = stn(info["gname"].(string), 32, encoding)
+	parts[10], err = stn(info["uname"].(string), 32, encoding, errors)
+	if err != nil {
+		return nil, err
+	}
+	parts[11], err = stn(info["gname"].(string), 32, encoding, errors)
+	if err != nil {
+		return nil, err
+	}
 	parts[12] = devMajor
 	parts[13] = devMinor
-	parts[14] = stn(info["prefix"].(string), 155, encoding)
+	if sparse, ok := info["sparse"].([]byte); ok {
+		parts[14] = sparse
+	} else {
+		prefix, _ := info["prefix"].(string)
+		parts[14], err = stn(prefix, 155, encoding, errors)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// 检查 nil 值
 	for i := 1; i < 6; i++ {
@@ -408,7 +730,11 @@ func (ti *TarInfo) createHeader(info map[string]interface{}, format int, encodin
 	return b[:BLOCKSIZE], nil
 }
 func (ti *TarInfo) createGnuLongHeader(name, typ, encoding, errors string) ([]byte, error) {
-	nameBytes := append([]byte(name), NUL)
+	nameBytes, err := encode(name, encoding, errors)
+	if err != nil {
+		return nil, err
+	}
+	nameBytes = append(nameBytes, NUL)
 	info := map[string]interface{}{
 		"name":     "././@LongLink",
 		"mode":     int64(0),
@@ -434,10 +760,29 @@ func (ti *TarInfo) createGnuLongHeader(name, typ, encoding, errors string) ([]by
 	return append(header, payload...), nil
 }
 
+// paxRecordLength returns the length in bytes of a "%d %s=%s\n" PAX
+// record whose keyword and value are size bytes long together. The length
+// counts its own decimal digits, so it is the length with d digits for
+// the smallest d that leaves it d digits long: 94 bytes of keyword and
+// value make a record of 99 bytes, but 95 bytes one of 101.
+func paxRecordLength(size int) int {
+	l := size + 3 // " " + "=" + "\n"
+	for digits := 1; ; digits++ {
+		if n := l + digits; len(strconv.Itoa(n)) == digits {
+			return n
+		}
+	}
+}
+
 func (ti *TarInfo) createPaxGenericHeader(paxHeaders map[string]string, typ, encoding string) ([]byte, error) {
+	// Values that are not valid UTF-8 hold raw bytes of another encoding,
+	// which hdrcharset=BINARY marks. The values of extended attributes
+	// are raw bytes anyway and are always written as they are, but their
+	// names are encoded like other values.
 	binary := false
-	for _, v := range paxHeaders {
-		if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+	for k, v := range paxHeaders {
+		name, isXattr := strings.CutPrefix(k, xattrPrefix)
+		if !utf8.ValidString(name) || !isXattr && !utf8.ValidString(v) {
 			binary = true
 			break
 		}
@@ -448,24 +793,37 @@ func (ti *TarInfo) createPaxGenericHeader(paxHeaders map[string]string, typ, enc
 		records = append(records, []byte("21 hdrcharset=BINARY\n")...)
 	}
 
-	for k, v := range paxHeaders {
+	// Write the records in a fixed order so that archives are reproducible.
+	keys := make([]string, 0, len(paxHeaders))
+	for k := range paxHeaders {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := checkPaxKey(k); err != nil {
+			return nil, err
+		}
+		v := paxHeaders[k]
 		kBytes := []byte(k)
-		var vBytes []byte
-		if binary {
-			vBytes = []byte(v)
-		} else {
-			vBytes = []byte(v)
-		}
-		l := len(kBytes) + len(vBytes) + 3 // " " + "=" + "\n"
-		n := 0
-		for {
-			p := l + len(strconv.Itoa(n))
-			if p == n {
-				break
+		vBytes := []byte(v)
+		if name, isXattr := strings.CutPrefix(k, xattrPrefix); binary && isXattr {
+			nameBytes, err := encode(name, encoding, "surrogateescape")
+			if err != nil {
+				return nil, err
+			}
+			kBytes = append([]byte(xattrPrefix), nameBytes...)
+		} else if binary {
+			var err error
+			if vBytes, err = encode(v, encoding, "surrogateescape"); err != nil {
+				return nil, err
 			}
-			n = p
 		}
-		records = append(records, []byte(fmt.Sprintf("%d %s=%s\n", n, k, v))...)
+		n := paxRecordLength(len(kBytes) + len(vBytes))
+		records = append(records, fmt.Sprintf("%d ", n)...)
+		records = append(records, kBytes...)
+		records = append(records, '=')
+		records = append(records, vBytes...)
+		records = append(records, '\n')
 	}
 
 	info := map[string]interface{}{
@@ -501,35 +859,506 @@ func (ti *TarInfo) createPayload(payload []byte) []byte {
 	return payload
 }
 
-// FromTarFile reads a TarInfo from the TarFile's current position.
+// FromTarFile reads a TarInfo from the TarFile's current position into
+// ti. The member returned is ti itself, unless ti is an extended header,
+// in which case it is a new TarInfo from the TarFile's factory for the
+// member that follows.
 func (ti *TarInfo) FromTarFile(tf *TarFile) (*TarInfo, error) {
 	buf := make([]byte, BLOCKSIZE)
-	n, err := tf.fileObj.Read(buf)
+	n, err := io.ReadFull(tf.fileObj, buf)
 	if err != nil {
 		if err == io.EOF && n == 0 {
 			return nil, NewEOFHeaderError("end of file header")
 		}
 		return nil, NewTruncatedHeaderError("truncated header")
 	}
-	if n != BLOCKSIZE {
-		return nil, NewTruncatedHeaderError("truncated header")
-	}
 
-	ti, err = FromBuf(buf, tf.encoding, tf.errors)
+	obj, err := FromBuf(buf, tf.encoding, tf.errors)
 	if err != nil {
 		return nil, err
 	}
+	ti.setHeaderFields(obj)
 	ti.Offset = tf.offset
-	ti.OffsetData = tf.offset + BLOCKSIZE
 	tf.offset += BLOCKSIZE
+	return ti.procMember(tf)
+}
+
+// setHeaderFields copies the fields FromBuf parsed from obj into ti and
+// leaves the others as the TarInfo factory set them, like the tarfile
+// back-pointer.
+func (ti *TarInfo) setHeaderFields(obj *TarInfo) {
+	ti.Name, ti.Mode, ti.UID, ti.GID = obj.Name, obj.Mode, obj.UID, obj.GID
+	ti.Size, ti.Mtime, ti.Chksum, ti.Type = obj.Size, obj.Mtime, obj.Chksum, obj.Type
+	ti.Linkname, ti.Uname, ti.Gname = obj.Linkname, obj.Uname, obj.Gname
+	ti.DevMajor, ti.DevMinor, ti.Format = obj.DevMajor, obj.DevMinor, obj.Format
+	ti.Sparse, ti.sparseExtended, ti.origSize = obj.Sparse, obj.sparseExtended, obj.origSize
+	if ti.PaxHeaders == nil {
+		ti.PaxHeaders = obj.PaxHeaders
+	}
+}
+
+// procMember chooses the right processing method for the member's type.
+func (ti *TarInfo) procMember(tf *TarFile) (*TarInfo, error) {
+	switch ti.Type {
+	case GNUTYPE_LONGNAME, GNUTYPE_LONGLINK:
+		return ti.procGnulong(tf)
+	case GNUTYPE_SPARSE:
+		return ti.procSparse(tf)
+	case GNUTYPE_DUMPDIR:
+		return ti.procDumpdir(tf)
+	case XHDTYPE, XGLTYPE, SOLARIS_XHDTYPE:
+		return ti.procPax(tf)
+	default:
+		return ti.procBuiltin(tf)
+	}
+}
+
+// procBuiltin processes a member of one of the builtin types and moves
+// tf.offset past its data.
+func (ti *TarInfo) procBuiltin(tf *TarFile) (*TarInfo, error) {
+	ti.OffsetData = tf.offset
+	if ti.IsReg() || !contains(ti.Type, SUPPORTED_TYPES) {
+		// Skip the following data blocks.
+		tf.offset += ti.block(ti.Size)
+	}
+
+	// Global PAX headers act as defaults for every member.
+	ti.applyPaxInfo(tf.paxHeaders, tf.encoding, tf.errors)
+	if ti.IsDir() {
+		ti.Name = strings.TrimSuffix(ti.Name, "/")
+	}
+	return ti, nil
+}
+
+// procSparse processes a GNU sparse member. The extended headers that
+// follow the member header continue its sparse map; each holds up to 21
+// structs and has its own flag for another header following it.
+func (ti *TarInfo) procSparse(tf *TarFile) (*TarInfo, error) {
+	for ti.sparseExtended {
+		buf := make([]byte, BLOCKSIZE)
+		if _, err := io.ReadFull(tf.fileObj, buf); err != nil {
+			return nil, NewTruncatedHeaderError("truncated sparse header")
+		}
+		tf.offset += BLOCKSIZE
+		structs, err := parseSparseStructs(buf[:504], 21)
+		if err != nil {
+			return nil, NewInvalidHeaderError("invalid sparse header")
+		}
+		ti.Sparse = append(ti.Sparse, structs...)
+		ti.sparseExtended = buf[504] != 0
+	}
+	if ti.Sparse == nil {
+		ti.Sparse = [][2]int64{}
+	}
+
+	ti.OffsetData = tf.offset
+	tf.offset += ti.block(ti.Size)
+	ti.Size = ti.origSize
+
+	ti.applyPaxInfo(tf.paxHeaders, tf.encoding, tf.errors)
+	return ti, nil
+}
+
+// readPayload reads the data of ti, padded to whole blocks, from the
+// TarFile's current position and moves tf.offset past it. The size comes
+// from the header, so the buffer only grows as far as the data goes.
+func (ti *TarInfo) readPayload(tf *TarFile) ([]byte, error) {
+	size := ti.block(ti.Size)
+	if tf.fileSize >= 0 && tf.offset+size > tf.fileSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf, err := io.ReadAll(io.LimitReader(tf.fileObj, size))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	tf.offset += size
+	return buf, nil
+}
+
+// procDumpdir processes a GNU incremental directory member and parses
+// the directory listing stored in its data.
+func (ti *TarInfo) procDumpdir(tf *TarFile) (*TarInfo, error) {
+	ti.OffsetData = tf.offset
+	buf, err := ti.readPayload(tf)
+	if err != nil {
+		return nil, NewTruncatedHeaderError("truncated dumpdir payload")
+	}
+
+	dumpdir, err := parseDumpdir(buf[:ti.Size], tf.encoding, tf.errors)
+	if err != nil {
+		return nil, err
+	}
+	ti.Dumpdir = dumpdir
+
+	ti.applyPaxInfo(tf.paxHeaders, tf.encoding, tf.errors)
+	ti.Name = strings.TrimSuffix(ti.Name, "/")
 	return ti, nil
 }
 
+// parseDumpdir parses a GNU dumpdir listing: entries of a control
+// character and a name, each ending in a NUL, followed by an empty entry.
+func parseDumpdir(buf []byte, encoding, errors string) ([]DumpdirEntry, error) {
+	dumpdir := []DumpdirEntry{}
+	for len(buf) > 0 && buf[0] != NUL {
+		end := bytes.IndexByte(buf, NUL)
+		if end == -1 {
+			return nil, NewInvalidHeaderError("unterminated dumpdir entry")
+		}
+		name, err := decode(buf[1:end], encoding, errors)
+		if err != nil {
+			return nil, err
+		}
+		dumpdir = append(dumpdir, DumpdirEntry{Control: buf[0], Name: name})
+		buf = buf[end+1:]
+	}
+	return dumpdir, nil
+}
+
+// parseSparseStructs parses up to n (offset, numbytes) pairs of 12-byte
+// numbers from buf. An empty pair ends the list.
+func parseSparseStructs(buf []byte, n int) ([][2]int64, error) {
+	var structs [][2]int64
+	for pos := 0; pos < n*24; pos += 24 {
+		offset, err := nti(buf[pos : pos+12])
+		if err != nil {
+			return nil, err
+		}
+		numbytes, err := nti(buf[pos+12 : pos+24])
+		if err != nil {
+			return nil, err
+		}
+		if offset == 0 && numbytes == 0 {
+			break
+		}
+		if offset < 0 || numbytes < 0 {
+			return nil, NewInvalidHeaderError("invalid sparse map")
+		}
+		structs = append(structs, [2]int64{offset, numbytes})
+	}
+	return structs, nil
+}
+
+// procGnulong processes the blocks that hold a GNU longname or longlink
+// member and applies them to the member that follows.
+func (ti *TarInfo) procGnulong(tf *TarFile) (*TarInfo, error) {
+	buf, err := ti.readPayload(tf)
+	if err != nil {
+		return nil, NewTruncatedHeaderError("truncated longname/longlink payload")
+	}
+
+	next, err := tf.tarInfo().FromTarFile(tf)
+	if err != nil {
+		if isHeaderError(err) {
+			return nil, NewSubsequentHeaderError(err.Error())
+		}
+		return nil, err
+	}
+
+	// Patch the TarInfo object from the next header with the longname
+	// or longlink information.
+	next.Offset = ti.Offset
+	switch ti.Type {
+	case GNUTYPE_LONGNAME:
+		next.Name, err = nts(buf, tf.encoding, tf.errors)
+	case GNUTYPE_LONGLINK:
+		next.Linkname, err = nts(buf, tf.encoding, tf.errors)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if next.IsDir() {
+		next.Name = strings.TrimSuffix(next.Name, "/")
+	}
+	return next, nil
+}
+
+// procPax processes an extended or global PAX header and applies its
+// records to the member that follows. Solaris extended headers use the
+// same record format and are handled like PAX extended headers.
+func (ti *TarInfo) procPax(tf *TarFile) (*TarInfo, error) {
+	buf, err := ti.readPayload(tf)
+	if err != nil {
+		return nil, NewTruncatedHeaderError("truncated pax header payload")
+	}
+
+	// A global header updates the archive-wide defaults, an extended
+	// header only applies to the next member.
+	var paxHeaders map[string]string
+	if ti.Type == XGLTYPE {
+		paxHeaders = tf.paxHeaders
+	} else {
+		paxHeaders = make(map[string]string, len(tf.paxHeaders))
+		for k, v := range tf.paxHeaders {
+			paxHeaders[k] = v
+		}
+	}
+	if err := parsePaxRecords(buf[:ti.Size], paxHeaders, tf.encoding, tf.errors); err != nil {
+		return nil, err
+	}
+
+	next, err := tf.tarInfo().FromTarFile(tf)
+	if err != nil {
+		if isHeaderError(err) {
+			return nil, NewSubsequentHeaderError(err.Error())
+		}
+		return nil, err
+	}
+
+	// Process GNU sparse information.
+	dataStart := next.OffsetData
+	if _, ok := paxHeaders["GNU.sparse.map"]; ok {
+		// GNU extended sparse format version 0.1.
+		err = next.procGnuSparse01(paxHeaders)
+	} else if paxHeaders["GNU.sparse.major"] == "1" && paxHeaders["GNU.sparse.minor"] == "0" {
+		// GNU extended sparse format version 1.0.
+		err = next.procGnuSparse10(tf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ti.Type != XGLTYPE {
+		if size, ok := paxHeaders["size"]; ok {
+			if n, err := strconv.ParseInt(size, 10, 64); err != nil || n < 0 {
+				return nil, NewInvalidHeaderError(fmt.Sprintf("invalid pax size %q", size))
+			}
+		}
+		// Patch the TarInfo object with the extended header info.
+		next.applyPaxInfo(paxHeaders, tf.encoding, tf.errors)
+		next.Offset = ti.Offset
+		next.Format = PAX_FORMAT
+
+		if size, ok := paxHeaders["size"]; ok {
+			// If the extended header replaces the size field,
+			// we need to recalculate the offset where the next
+			// header starts. The size of a sparse file is not
+			// the size of its data, so use the record itself.
+			offset := dataStart
+			if next.IsReg() || next.Type == GNUTYPE_DUMPDIR || !contains(next.Type, SUPPORTED_TYPES) {
+				n, _ := strconv.ParseInt(size, 10, 64)
+				offset += next.block(n)
+			}
+			tf.offset = offset
+		}
+	}
+	return next, nil
+}
+
+// procGnuSparse01 reads the sparse map of the GNU sparse format 0.1,
+// which is a comma separated list of offsets and sizes in a PAX record.
+func (ti *TarInfo) procGnuSparse01(paxHeaders map[string]string) error {
+	sparse, err := parseSparseMap(strings.Split(paxHeaders["GNU.sparse.map"], ","))
+	if err != nil {
+		return err
+	}
+	ti.Sparse = sparse
+	return nil
+}
+
+// procGnuSparse10 reads the sparse map of the GNU sparse format 1.0. The
+// map is stored at the start of the member's data as decimal numbers on
+// lines of their own: the number of regions followed by the offset and
+// size of each. It is padded to a full block and the data follows it.
+func (ti *TarInfo) procGnuSparse10(tf *TarFile) error {
+	var buf []byte
+	var fields []string
+	numFields := int64(-1)
+	for numFields < 0 || int64(len(fields)) < numFields {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			block := make([]byte, BLOCKSIZE)
+			if _, err := io.ReadFull(tf.fileObj, block); err != nil {
+				return NewTruncatedHeaderError("truncated sparse map")
+			}
+			buf = append(buf, block...)
+			ti.OffsetData += BLOCKSIZE
+			continue
+		}
+		field := string(buf[:i])
+		buf = buf[i+1:]
+		if numFields < 0 {
+			n, err := strconv.ParseInt(field, 10, 64)
+			if err != nil || n < 0 || n > math.MaxInt32 {
+				return NewInvalidHeaderError("invalid sparse map")
+			}
+			numFields = 2 * n
+			continue
+		}
+		fields = append(fields, field)
+	}
+	sparse, err := parseSparseMap(fields)
+	if err != nil {
+		return err
+	}
+	ti.Sparse = sparse
+	return nil
+}
+
+// parseSparseMap turns a flat list of decimal offsets and sizes into
+// sparse regions.
+func parseSparseMap(fields []string) ([][2]int64, error) {
+	if len(fields)%2 != 0 {
+		return nil, NewInvalidHeaderError("invalid sparse map")
+	}
+	sparse := make([][2]int64, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		offset, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || offset < 0 {
+			return nil, NewInvalidHeaderError("invalid sparse map")
+		}
+		numbytes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || numbytes < 0 {
+			return nil, NewInvalidHeaderError("invalid sparse map")
+		}
+		sparse = append(sparse, [2]int64{offset, numbytes})
+	}
+	return sparse, nil
+}
+
+// applyPaxInfo replaces fields with supplemental information from a
+// previous PAX extended or global header.
+func (ti *TarInfo) applyPaxInfo(paxHeaders map[string]string, encoding, errors string) {
+	for keyword, value := range paxHeaders {
+		switch keyword {
+		case "path":
+			ti.Name = strings.TrimRight(value, "/")
+		case "linkpath":
+			ti.Linkname = value
+		case "uname":
+			ti.Uname = value
+		case "gname":
+			ti.Gname = value
+		case "uid":
+			n, _ := strconv.Atoi(value)
+			ti.UID = n
+		case "gid":
+			n, _ := strconv.Atoi(value)
+			ti.GID = n
+		case "size":
+			n, _ := strconv.ParseInt(value, 10, 64)
+			ti.Size = n
+		case "mtime":
+			if mtime, err := parsePaxTime(value); err == nil {
+				ti.Mtime = mtime
+			}
+		case "atime":
+			if atime, err := parsePaxTime(value); err == nil {
+				ti.Atime = atime
+			}
+		case "ctime":
+			if ctime, err := parsePaxTime(value); err == nil {
+				ti.Ctime = ctime
+			}
+		default:
+			if name, ok := strings.CutPrefix(keyword, xattrPrefix); ok {
+				if ti.Xattrs == nil {
+					ti.Xattrs = make(map[string][]byte)
+				}
+				ti.Xattrs[name] = []byte(value)
+			}
+		}
+	}
+
+	// GNU sparse files keep their real name and size in records of
+	// their own, which take precedence over path and size.
+	if name, ok := paxHeaders["GNU.sparse.name"]; ok {
+		ti.Name = name
+	}
+	for _, keyword := range []string{"GNU.sparse.size", "GNU.sparse.realsize"} {
+		if value, ok := paxHeaders[keyword]; ok {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			ti.Size = n
+		}
+	}
+
+	ti.PaxHeaders = make(map[string]string, len(paxHeaders))
+	for k, v := range paxHeaders {
+		ti.PaxHeaders[k] = v
+	}
+}
+
+// parsePaxRecords parses the "%d %s=%s\n" records in buf into headers.
+// Values are UTF-8, unless a hdrcharset=BINARY record marks them as raw
+// bytes, which are decoded from encoding like the fields of the ustar
+// header. Values that are not valid UTF-8 are decoded the same way even
+// without it. The values of extended attributes always keep their raw
+// bytes, their names are decoded like other values.
+func parsePaxRecords(buf []byte, headers map[string]string, encoding, errors string) error {
+	type pending struct{ keyword, value []byte }
+	var records []pending
+	// The hdrcharset record applies to all records of the header, also
+	// to those before it, so the values are decoded once all are read.
+	binary := false
+	pos := 0
+	for pos < len(buf) && buf[pos] != NUL {
+		sp := bytes.IndexByte(buf[pos:], ' ')
+		if sp <= 0 {
+			return NewInvalidHeaderError("invalid header")
+		}
+		length, err := strconv.Atoi(string(buf[pos : pos+sp]))
+		if err != nil || length < 5 || length <= sp+1 || pos+length > len(buf) {
+			return NewInvalidHeaderError("invalid header")
+		}
+		record := buf[pos+sp+1 : pos+length]
+		if record[len(record)-1] != '\n' {
+			return NewInvalidHeaderError("invalid header")
+		}
+		keyword, value, ok := bytes.Cut(record[:len(record)-1], []byte("="))
+		if !ok || len(keyword) == 0 {
+			return NewInvalidHeaderError("invalid header")
+		}
+		if string(keyword) == "hdrcharset" {
+			binary = string(value) == "BINARY"
+		}
+		records = append(records, pending{keyword, value})
+		pos += length
+	}
+	for _, r := range records {
+		keyword := string(r.keyword)
+		if name, ok := bytes.CutPrefix(r.keyword, []byte(xattrPrefix)); ok {
+			keyword = xattrPrefix + decodePaxValue("", name, binary, encoding, errors)
+		}
+		headers[keyword] = decodePaxValue(keyword, r.value, binary, encoding, errors)
+	}
+	return nil
+}
+
+// decodePaxValue returns the value of the PAX record keyword as a string.
+func decodePaxValue(keyword string, value []byte, binary bool, encoding, errors string) string {
+	if strings.HasPrefix(keyword, xattrPrefix) || (!binary && utf8.Valid(value)) {
+		return string(value)
+	}
+	s, err := decode(value, encoding, errors)
+	if err != nil {
+		return string(value)
+	}
+	return s
+}
+
+// block rounds count up to the next multiple of BLOCKSIZE.
+func (ti *TarInfo) block(count int64) int64 {
+	blocks, remainder := divmod(count, BLOCKSIZE)
+	if remainder > 0 {
+		blocks++
+	}
+	return blocks * BLOCKSIZE
+}
+
 // CreatePaxGlobalHeader creates a PAX global header from headers.
 func (ti *TarInfo) CreatePaxGlobalHeader(headers map[string]string) ([]byte, error) {
 	return ti.createPaxGenericHeader(headers, XGLTYPE, "ascii")
 }
 
+// TarInfoFromBytes parses a single 512-byte header block with the default
+// encoding of a TarFile, without an open archive. Extended headers, such
+// as those ToBytes puts in front of long names, are not applied.
+func TarInfoFromBytes(buf []byte) (*TarInfo, error) {
+	return FromBuf(buf, ENCODING, "surrogateescape")
+}
+
 // FromBuf constructs a TarInfo from a 512-byte buffer.
 func FromBuf(buf []byte, encoding, errors string) (*TarInfo, error) {
 	if len(buf) == 0 {
@@ -546,18 +1375,24 @@ func FromBuf(buf []byte, encoding, errors string) (*TarInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	if chksum != calcChecksum(buf) {
+	if !validChecksum(buf, chksum) {
 		return nil, NewInvalidHeaderError("bad checksum")
 	}
 
 	ti := NewTarInfo("")
-	ti.Name = nts(buf[0:100], encoding, errors)
+	ti.Name, err = nts(buf[0:100], encoding, errors)
+	if err != nil {
+		return nil, err
+	}
 
 	// Mode
 	mode, err := nti(buf[100:108])
 	if err != nil {
 		return nil, err
 	}
+	if mode < 0 || mode > 07777777 {
+		return nil, NewInvalidHeaderError(fmt.Sprintf("invalid mode %d", mode))
+	}
 	ti.Mode = mode
 
 	// UID
@@ -579,6 +1414,11 @@ func FromBuf(buf []byte, encoding, errors string) (*TarInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	// A negative size, possible with base-256 numbers, would move the
+	// offset of the next header backwards.
+	if size < 0 {
+		return nil, NewInvalidHeaderError(fmt.Sprintf("negative size %d", size))
+	}
 	ti.Size = size
 
 	// Mtime
@@ -590,65 +1430,86 @@ func FromBuf(buf []byte, encoding, errors string) (*TarInfo, error) {
 
 	ti.Chksum = int(chksum)
 	ti.Type = string(buf[156:157])
-	ti.Linkname = nts(buf[157:257], encoding, errors)
-	ti.Uname = nts(buf[265:297], encoding, errors)
-	ti.Gname = nts(buf[297:329], encoding, errors)
+	if ti.Linkname, err = nts(buf[157:257], encoding, errors); err != nil {
+		return nil, err
+	}
+	if ti.Uname, err = nts(buf[265:297], encoding, errors); err != nil {
+		return nil, err
+	}
+	if ti.Gname, err = nts(buf[297:329], encoding, errors); err != nil {
+		return nil, err
+	}
 
 	// DevMajor
 	devMajor, err := nti(buf[329:337])
 	if err != nil {
 		return nil, err
 	}
-	ti.DevMajor = int(devMajor)
 
 	// DevMinor
 	devMinor, err := nti(buf[337:345])
 	if err != nil {
 		return nil, err
 	}
+	// Device numbers are 32 bits wide at most.
+	if devMajor < 0 || devMajor > math.MaxUint32 || devMinor < 0 || devMinor > math.MaxUint32 {
+		return nil, NewInvalidHeaderError(fmt.Sprintf("invalid device number %d,%d", devMajor, devMinor))
+	}
+	ti.DevMajor = int(devMajor)
 	ti.DevMinor = int(devMinor)
 
-	prefix := nts(buf[345:500], encoding, errors)
+	prefix, err := nts(buf[345:500], encoding, errors)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only GNU tar writes its own magic and base-256 numbers, and V7
+	// headers have no magic at all. procPax marks members with an
+	// extended header as PAX_FORMAT.
+	switch {
+	case string(buf[257:265]) == GNU_MAGIC:
+		ti.Format = GNU_FORMAT
+	case bytes.HasPrefix(buf[257:], []byte("ustar")):
+		ti.Format = USTAR_FORMAT
+	default:
+		ti.Format = V7_FORMAT
+	}
+	for _, field := range [][2]int{{100, 108}, {108, 116}, {116, 124}, {124, 136}, {136, 148}, {329, 337}, {337, 345}} {
+		if c := buf[field[0]]; c == 0x80 || c == 0xFF {
+			ti.Format = GNU_FORMAT
+		}
+	}
 
-	if ti.Type == AREGTYPE && strings.HasSuffix(ti.Name, "/") {
+	// Old V7 archives store directories as regular files. They are
+	// recognised by a trailing slash or, for empty members, by the S_IFDIR
+	// bits that some writers left in the mode field.
+	if ti.Type == AREGTYPE && (strings.HasSuffix(ti.Name, "/") || ti.Size == 0 && ti.Mode&0170000 == 0040000) {
 		ti.Type = DIRTYPE
 	}
 	if ti.Type == GNUTYPE_SPARSE {
-		var structs [][2]int64
-		pos := 386
-		for i := 0; i < 4; i++ {
-			offset, err := nti(buf[pos : pos+12])
-			if err != nil {
-				return nil, err
-			}
-			numbytes, err := nti(buf[pos+12 : pos+24])
-			if err != nil {
-				return nil, err
-			}
-			if offset == 0 && numbytes == 0 {
-				break
-			}
-			structs = append(structs, [2]int64{offset, numbytes})
-			pos += 24
+		// The data stored in the archive is Size bytes long; procSparse
+		// reads the rest of the map and sets the real size.
+		structs, err := parseSparseStructs(buf[386:482], 4)
+		if err != nil {
+			return nil, err
 		}
-		isExtended := buf[482] != 0
-		origSize, err := nti(buf[483:495])
+		ti.Sparse = structs
+		ti.sparseExtended = buf[482] != 0
+		ti.origSize, err = nti(buf[483:495])
 		if err != nil {
 			return nil, err
 		}
-		if len(structs) > 0 || isExtended {
-			ti.Sparse = structs
-			if isExtended {
-				// TODO: Handle extended sparse headers
-			}
-			ti.Size = origSize
+		if ti.origSize < 0 {
+			return nil, NewInvalidHeaderError(fmt.Sprintf("negative real size %d", ti.origSize))
 		}
 	}
 
 	if ti.IsDir() {
 		ti.Name = strings.TrimSuffix(ti.Name, "/")
 	}
-	if prefix != "" && !contains(ti.Type, GNU_TYPES) {
+	// GNU headers have no prefix field; incremental archives store the
+	// access and change times there.
+	if prefix != "" && !contains(ti.Type, GNU_TYPES) && string(buf[257:265]) != GNU_MAGIC {
 		ti.Name = prefix + "/" + ti.Name
 	}
 	return ti, nil
@@ -664,9 +1525,11 @@ func (ti *TarInfo) IsFile() bool {
 	return ti.IsReg()
 }
 
-// IsDir returns true if the TarInfo represents a directory.
+// IsDir returns true if the TarInfo represents a directory. The
+// directories of GNU incremental archives, GNUTYPE_DUMPDIR, count as
+// directories as well.
 func (ti *TarInfo) IsDir() bool {
-	return ti.Type == DIRTYPE
+	return ti.Type == DIRTYPE || ti.Type == GNUTYPE_DUMPDIR
 }
 
 // IsSym returns true if the TarInfo represents a symbolic link.
@@ -694,6 +1557,22 @@ func (ti *TarInfo) IsFifo() bool {
 	return ti.Type == FIFOTYPE
 }
 
+// dataSize returns the number of bytes of data the member has in the
+// archive, which for sparse files is only that of the data regions.
+func (ti *TarInfo) dataSize() int64 {
+	if !ti.IsReg() {
+		return 0
+	}
+	if !ti.IsSparse() {
+		return ti.Size
+	}
+	var size int64
+	for _, region := range ti.Sparse {
+		size += region[1]
+	}
+	return size
+}
+
 // IsSparse returns true if the TarInfo represents a sparse file.
 func (ti *TarInfo) IsSparse() bool {
 	return ti.Sparse != nil
@@ -704,6 +1583,43 @@ func (ti *TarInfo) IsDev() bool {
 	return ti.Type == CHRTYPE || ti.Type == BLKTYPE || ti.Type == FIFOTYPE
 }
 
+// FileInfo returns an os.FileInfo for the member, like Header.FileInfo of
+// archive/tar. Its name is the base name of the member and its Sys method
+// returns ti.
+func (ti *TarInfo) FileInfo() os.FileInfo {
+	return &tarFileInfo{name: path.Base(ti.Name), ti: ti}
+}
+
+// ResolveLink returns the member of members that the link ti refers to.
+// The target of a symbolic link is relative to the directory of the
+// link, that of a hard link to the root of the archive. If several
+// members have the target's name the last one is returned. An error is
+// returned if ti is no link, if no member has the target's name or, as an
+// AbsoluteLinkError or LinkOutsideDestinationError, if its target is
+// absolute or outside the archive.
+func (ti *TarInfo) ResolveLink(members []*TarInfo) (*TarInfo, error) {
+	if !ti.IsSym() && !ti.IsLnk() {
+		return nil, fmt.Errorf("%q is not a link", ti.Name)
+	}
+	if path.IsAbs(ti.Linkname) {
+		return nil, NewAbsoluteLinkError(ti.Name)
+	}
+	target := ti.Linkname
+	if ti.IsSym() {
+		target = path.Join(path.Dir(ti.Name), target)
+	}
+	target = path.Clean(target)
+	if target == ".." || strings.HasPrefix(target, "../") {
+		return nil, NewLinkOutsideDestinationError(ti.Name, ti.Linkname)
+	}
+	for i := len(members) - 1; i >= 0; i-- {
+		if m := members[i]; m != ti && path.Clean(m.Name) == target {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("link target %q of %q not found", ti.Linkname, ti.Name)
+}
+
 // Helper function to check if a string is in a slice.
 func contains(s string, slice []string) bool {
 	for _, v := range slice {
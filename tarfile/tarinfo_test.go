@@ -0,0 +1,873 @@
+package tarfile
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPaxRecordLength(t *testing.T) {
+	for _, tt := range []struct{ size, want int }{
+		{1, 5},
+		{6, 11},
+		{94, 99},
+		{95, 101},
+		{97, 103},
+		{993, 999},
+		{994, 1001},
+	} {
+		if got := paxRecordLength(tt.size); got != tt.want {
+			t.Errorf("paxRecordLength(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+// paxRecord returns the PAX record of keyword and value.
+func paxRecord(keyword, value string) string {
+	record := fmt.Sprintf(" %s=%s\n", keyword, value)
+	n := len(record) + len(strconv.Itoa(len(record)))
+	if len(strconv.Itoa(n)) > len(strconv.Itoa(len(record))) {
+		n++
+	}
+	return strconv.Itoa(n) + record
+}
+
+func TestParsePaxRecordsHdrcharset(t *testing.T) {
+	for _, tt := range []struct {
+		buf  string
+		want string
+	}{
+		// The record applies to the records before it.
+		{paxRecord("path", "caf\xe9") + paxRecord("hdrcharset", "BINARY"), "café"},
+		// A value that looks like the record does not count.
+		{paxRecord("path", "café") + paxRecord("comment", "a hdrcharset=BINARY\n"), "café"},
+	} {
+		headers := make(map[string]string)
+		if err := parsePaxRecords([]byte(tt.buf), headers, "iso8859-1", "strict"); err != nil {
+			t.Fatal(err)
+		}
+		if headers["path"] != tt.want {
+			t.Errorf("path = %q, want %q", headers["path"], tt.want)
+		}
+	}
+}
+
+func TestFromTarFileKeepsFactoryFields(t *testing.T) {
+	owner := &TarFile{}
+	factory := func() *TarInfo {
+		ti := NewTarInfo("")
+		ti.tarfile = owner
+		return ti
+	}
+	tf, err := Open(tempFile(t, "a.tar", tarBytes(t, "a")), "r", nil, 4096, WithTarInfoFactory(factory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	ti, err := tf.GetMember("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.Name != "a" || ti.tarfile != owner {
+		t.Errorf("member %q has tarfile %p, want %p", ti.Name, ti.tarfile, owner)
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xattrs.tar")
+	tf, err := Open(path, "w", nil, 4096, WithFormat(PAX_FORMAT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := NewTarInfo("f")
+	ti.Xattrs = map[string][]byte{"user.a": []byte("\x00\xff"), "user.b": nil}
+	if err := tf.AddFile(ti, nil); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(paxRecord("SCHILY.xattr.user.a", "\x00\xff"))) {
+		t.Error("no xattr record written")
+	}
+
+	tf = openArchive(t, path, WithPreserveXattrs(true))
+	ti, err = tf.GetMember("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ti.Xattrs["user.a"]) != "\x00\xff" || len(ti.Xattrs) != 2 {
+		t.Errorf("xattrs %q", ti.Xattrs)
+	}
+	dest := t.TempDir()
+	if err := tf.ExtractAll(dest); err != nil {
+		if strings.Contains(err.Error(), "not supported") {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	value := make([]byte, 16)
+	if n, err := unix.Lgetxattr(filepath.Join(dest, "f"), "user.a", value); err != nil || string(value[:n]) != "\x00\xff" {
+		t.Errorf("extracted xattr %q, %v", value[:n], err)
+	}
+}
+
+func TestParsePaxRecordsXattrName(t *testing.T) {
+	buf := paxRecord("SCHILY.xattr.user.caf\xe9", "\xff") + paxRecord("hdrcharset", "BINARY")
+	headers := make(map[string]string)
+	if err := parsePaxRecords([]byte(buf), headers, "iso8859-1", "strict"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := headers["SCHILY.xattr.user.café"]; !ok || v != "\xff" {
+		t.Errorf("headers = %q", headers)
+	}
+
+	ti := NewTarInfo("a")
+	ti.Xattrs = map[string][]byte{"user.café": []byte("\xff")}
+	ti.Uname = "caf\xe9"
+	header, err := ti.ToBuf(PAX_FORMAT, "iso8859-1", "surrogateescape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(header), " SCHILY.xattr.user.caf\xe9=\xff\n") {
+		t.Errorf("xattr name not encoded in %q", header[BLOCKSIZE:2*BLOCKSIZE])
+	}
+}
+
+func TestUstarMagic(t *testing.T) {
+	ti := NewTarInfo("f")
+	ti.Uname, ti.Gname = "user", "group"
+	for _, format := range []int{USTAR_FORMAT, PAX_FORMAT} {
+		buf, err := ti.ToBuf(format, ENCODING, "surrogateescape")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if magic := string(buf[257:265]); magic != "ustar\x0000" {
+			t.Errorf("format %d: magic and version %q", format, magic)
+		}
+		hdr, err := tar.NewReader(bytes.NewReader(append(buf, make([]byte, 2*BLOCKSIZE)...))).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Uname != "user" || hdr.Gname != "group" {
+			t.Errorf("format %d: archive/tar read owner %q:%q", format, hdr.Uname, hdr.Gname)
+		}
+	}
+}
+
+func TestGnuSparseExtendedHeaders(t *testing.T) {
+	// Written by GNU tar 1.34 with --format=gnu --sparse from a file
+	// with six 4 KiB data regions 64 KiB apart and a trailing hole.
+	tf := openArchive(t, filepath.Join("testdata", "gnu-sparse.tar"))
+	ti, err := tf.GetMember("sparse.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ti.IsSparse() || ti.Size != 6*65536+8192 {
+		t.Fatalf("member is sparse %v with size %d", ti.IsSparse(), ti.Size)
+	}
+	var regions [][2]int64
+	for _, region := range ti.Sparse {
+		if region[1] > 0 {
+			regions = append(regions, region)
+		}
+	}
+	if len(regions) != 6 {
+		t.Fatalf("sparse map = %v, want 6 data regions", ti.Sparse)
+	}
+	for i, region := range regions {
+		if region != [2]int64{int64(i) * 65536, 4096} {
+			t.Errorf("region %d = %v", i, region)
+		}
+	}
+}
+
+func TestLatin1Names(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "latin1.tar")
+	tf, err := Open(path, "w", nil, 4096, WithFormat(GNU_FORMAT), WithEncoding("latin-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("café", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("caf\xe9\x00")) {
+		t.Fatalf("name stored as %q", data[:8])
+	}
+
+	for _, tt := range []struct {
+		encoding, errors, want string
+	}{
+		{"latin-1", "strict", "café"},
+		{"utf-8", "surrogateescape", "caf\xe9"},
+		{"utf-8", "replace", "caf\ufffd"},
+	} {
+		tf, err := Open(path, "r|", nil, 4096, WithEncoding(tt.encoding), WithErrors(tt.errors))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ti, err := tf.Next()
+		if err != nil || ti == nil {
+			t.Errorf("%s/%s: %v, %v", tt.encoding, tt.errors, ti, err)
+		} else if ti.Name != tt.want {
+			t.Errorf("%s/%s: name %q, want %q", tt.encoding, tt.errors, ti.Name, tt.want)
+		}
+		tf.Close()
+	}
+	tf, err = Open(path, "r|", nil, 4096, WithErrors("strict"))
+	if err == nil {
+		_, err = tf.Next()
+		tf.Close()
+	}
+	if err == nil {
+		t.Error("latin-1 name decoded as strict UTF-8")
+	}
+}
+
+func TestFromBufSignedChecksum(t *testing.T) {
+	ti := NewTarInfo("été")
+	buf, err := ti.ToBuf(USTAR_FORMAT, "latin-1", "strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, signed := calcChecksums(buf)
+	if unsigned == signed {
+		t.Fatal("name does not make the checksums differ")
+	}
+	copy(buf[148:], fmt.Sprintf("%06o\x00 ", signed))
+	if ti, err := FromBuf(buf, "latin-1", "strict"); err != nil || ti.Name != "été" {
+		t.Errorf("FromBuf() with a signed checksum = %v, %v", ti, err)
+	}
+	copy(buf[148:], fmt.Sprintf("%06o\x00 ", signed+1))
+	if _, err := FromBuf(buf, "latin-1", "strict"); err == nil {
+		t.Error("FromBuf() accepted a bad checksum")
+	}
+}
+
+func TestPaxSubsecondMtime(t *testing.T) {
+	mtime := time.Unix(1700000000, 123456789)
+	path := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "mtime.tar")
+	tf, err := Open(archive, "w", nil, 4096, WithFormat(PAX_FORMAT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.Add(path, "f", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(paxRecord("mtime", "1700000000.123456789"))) {
+		t.Error("no fractional mtime record written")
+	}
+
+	if ti, err := openArchive(t, archive).GetMember("f"); err != nil {
+		t.Fatal(err)
+	} else if !ti.Mtime.Equal(mtime) {
+		t.Errorf("mtime %v, want %v", ti.Mtime, mtime)
+	}
+}
+
+func TestPaxAtimeCtime(t *testing.T) {
+	atime, ctime := time.Unix(1600000000, 5e8), time.Unix(1500000000, 0)
+	path := filepath.Join(t.TempDir(), "times.tar")
+	tf, err := Open(path, "w", nil, 4096, WithFormat(PAX_FORMAT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.AddReader("a", strings.NewReader(""), 0, func(ti *TarInfo) { ti.Atime, ti.Ctime = atime, ctime }); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.AddReader("plain", strings.NewReader(""), 0); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte(" atime=")); n != 1 {
+		t.Errorf("%d atime records written, want 1", n)
+	}
+
+	tf = openArchive(t, path)
+	ti, err := tf.GetMember("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ti.Atime.Equal(atime) || !ti.Ctime.Equal(ctime) {
+		t.Errorf("atime %v, ctime %v", ti.Atime, ti.Ctime)
+	}
+	if ti, err := tf.GetMember("plain"); err != nil || !ti.Atime.IsZero() || !ti.Ctime.IsZero() {
+		t.Errorf("member without times: %v, %v", ti, err)
+	}
+
+	dest := t.TempDir()
+	if err := tf.ExtractAll(dest); err != nil {
+		t.Fatal(err)
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(filepath.Join(dest, "a"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Unix(st.Atim.Unix()); !got.Equal(atime) {
+		t.Errorf("extracted atime %v, want %v", got, atime)
+	}
+}
+
+func TestLargeNumberFields(t *testing.T) {
+	mtime := time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)
+	newMember := func() *TarInfo {
+		ti := NewTarInfo("big")
+		ti.UID, ti.GID, ti.Mtime = 10_000_000, 10_000_000, mtime
+		return ti
+	}
+	if _, err := newMember().ToBuf(USTAR_FORMAT, ENCODING, "surrogateescape"); err == nil {
+		t.Error("ustar header with a uid of 10000000 written")
+	}
+	for _, format := range []int{PAX_FORMAT, GNU_FORMAT} {
+		buf, err := newMember().ToBuf(format, ENCODING, "surrogateescape")
+		if err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if format == PAX_FORMAT {
+			for _, record := range []string{paxRecord("uid", "10000000"), paxRecord("gid", "10000000"), paxRecord("mtime", "32503680000")} {
+				if !bytes.Contains(buf, []byte(record)) {
+					t.Errorf("no record %q", record)
+				}
+			}
+		}
+		tf := openArchive(t, tempFile(t, "big.tar", append(buf, make([]byte, 2*BLOCKSIZE)...)))
+		ti, err := tf.GetMember("big")
+		if err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if ti.UID != 10_000_000 || ti.GID != 10_000_000 || !ti.Mtime.Equal(mtime) {
+			t.Errorf("format %d: uid %d, gid %d, mtime %v", format, ti.UID, ti.GID, ti.Mtime)
+		}
+	}
+}
+
+func TestUstarHeaderFields(t *testing.T) {
+	reg := NewTarInfo("short")
+	reg.DevMajor, reg.DevMinor = 8, 1 // Meaningless for a regular file
+	dev := NewTarInfo("dev/sda1")
+	dev.Type, dev.DevMajor, dev.DevMinor = BLKTYPE, 8, 1
+	for _, tt := range []struct {
+		ti                 *TarInfo
+		devmajor, devminor string
+	}{
+		{reg, "", ""},
+		{dev, "0000010", "0000001"},
+	} {
+		if _, ok := tt.ti.GetInfo()["prefix"]; !ok {
+			t.Errorf("%s: GetInfo() has no prefix", tt.ti.Name)
+		}
+		buf, err := tt.ti.ToBuf(USTAR_FORMAT, ENCODING, "surrogateescape")
+		if err != nil {
+			t.Fatal(err)
+		}
+		devmajor, _ := nts(buf[329:337], "ascii", "strict")
+		devminor, _ := nts(buf[337:345], "ascii", "strict")
+		prefix, _ := nts(buf[345:500], "ascii", "strict")
+		if devmajor != tt.devmajor || devminor != tt.devminor || prefix != "" {
+			t.Errorf("%s: devmajor %q, devminor %q, prefix %q", tt.ti.Name, devmajor, devminor, prefix)
+		}
+	}
+}
+
+func TestSolarisExtendedHeader(t *testing.T) {
+	records := paxRecord("path", "solaris/long-name") + paxRecord("size", "3") + paxRecord("SUN.holesdata", " 0 3")
+	xhd := NewTarInfo("././@LongHeader")
+	xhd.Type = SOLARIS_XHDTYPE
+	xhd.Size = int64(len(records))
+	var archive bytes.Buffer
+	archive.Write(headerBytes(t, xhd))
+	archive.WriteString(records)
+	archive.Write(make([]byte, BLOCKSIZE-len(records)))
+	member := NewTarInfo("short")
+	archive.Write(headerBytes(t, member))
+	archive.WriteString("abc")
+	archive.Write(make([]byte, BLOCKSIZE-3+2*BLOCKSIZE))
+
+	tf := openArchive(t, tempFile(t, "solaris.tar", archive.Bytes()))
+	ti, err := tf.GetMember("solaris/long-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.Name != "solaris/long-name" || ti.Size != 3 || ti.PaxHeaders["SUN.holesdata"] != " 0 3" {
+		t.Errorf("member %q of size %d with records %v", ti.Name, ti.Size, ti.PaxHeaders)
+	}
+	if data, err := io.ReadAll(NewExFileObject(tf, ti)); err != nil || string(data) != "abc" {
+		t.Errorf("read %q, %v", data, err)
+	}
+}
+
+func TestFileInfo(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	for _, tt := range []struct {
+		name, typ string
+		mode      int64
+		want      os.FileMode
+	}{
+		{"dir/sub", DIRTYPE, 0755, os.ModeDir | 0755},
+		{"dir/link", SYMTYPE, 0777, os.ModeSymlink | 0777},
+		{"dev/null", CHRTYPE, 0666, os.ModeDevice | os.ModeCharDevice | 0666},
+		{"dev/sda", BLKTYPE, 0660, os.ModeDevice | 0660},
+		{"fifo", FIFOTYPE, 0644, os.ModeNamedPipe | 0644},
+		{"suid", REGTYPE, 04755, os.ModeSetuid | 0755},
+	} {
+		ti := NewTarInfo(tt.name)
+		ti.Type, ti.Mode, ti.Mtime = tt.typ, tt.mode, mtime
+		fi := ti.FileInfo()
+		if fi.Mode() != tt.want {
+			t.Errorf("%s: mode %v, want %v", tt.name, fi.Mode(), tt.want)
+		}
+		if fi.Name() != filepath.Base(tt.name) || fi.IsDir() != (tt.typ == DIRTYPE) || !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: name %q, dir %v, mtime %v", tt.name, fi.Name(), fi.IsDir(), fi.ModTime())
+		}
+	}
+}
+
+func TestTarInfoFromFileInfo(t *testing.T) {
+	fsys := fstest.MapFS{
+		"suid": {Data: []byte("abc"), Mode: os.ModeSetuid | os.ModeSetgid | 0755},
+		"tmp":  {Mode: os.ModeDir | os.ModeSticky | 0777},
+		"link": {Data: []byte("suid"), Mode: os.ModeSymlink | 0777},
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := map[string]fs.DirEntry{}
+	for _, e := range entries {
+		infos[e.Name()] = e
+	}
+	for _, tt := range []struct {
+		name, typ string
+		mode      int64
+		size      int64
+		link      string
+	}{
+		{"suid", REGTYPE, 06755, 3, ""},
+		{"tmp", DIRTYPE, 01777, 0, ""},
+		{"link", SYMTYPE, 0777, 0, "suid"},
+	} {
+		// Directory entries do not follow the symlink.
+		fi, err := infos[tt.name].Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ti, err := TarInfoFromFileInfo(fi, tt.link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ti.Name != tt.name || ti.Type != tt.typ || ti.Mode != tt.mode || ti.Size != tt.size || ti.Linkname != tt.link {
+			t.Errorf("%s: type %q, mode %o, size %d, link %q", tt.name, ti.Type, ti.Mode, ti.Size, ti.Linkname)
+		}
+	}
+
+	orig := NewTarInfo("dir/f")
+	orig.Mode, orig.UID, orig.Uname = 0600, 1000, "user"
+	ti, err := TarInfoFromFileInfo(orig.FileInfo(), "")
+	if err != nil || ti.Name != "f" || ti.Mode != 0600 || ti.UID != 1000 || ti.Uname != "user" {
+		t.Errorf("from FileInfo(): %+v, %v", ti, err)
+	}
+}
+
+func TestToBufRejectsNul(t *testing.T) {
+	for _, format := range []int{USTAR_FORMAT, GNU_FORMAT, PAX_FORMAT} {
+		for _, name := range []string{"a\x00b", "a\nb"} {
+			ti := NewTarInfo(name)
+			_, err := ti.ToBuf(format, ENCODING, "surrogateescape")
+			if strings.Contains(name, "\x00") != (err != nil) {
+				t.Errorf("format %d: ToBuf(%q) = %v", format, name, err)
+			}
+		}
+	}
+
+	// A newline is kept intact through a PAX record.
+	path := filepath.Join(t.TempDir(), "names.tar")
+	tf, err := Open(path, "w", nil, 4096, WithFormat(PAX_FORMAT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("a\x00b", nil, 0644); err == nil {
+		t.Error("AddBytes() accepted a name with a NUL byte")
+	}
+	if _, err := tf.AddBytes("line\nbreak", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+	if ti, err := openArchive(t, path).GetMember("line\nbreak"); err != nil || ti.Name != "line\nbreak" {
+		t.Errorf("read back %v, %v", ti, err)
+	}
+}
+
+func TestResolveLink(t *testing.T) {
+	member := func(name, typ, link string) *TarInfo {
+		ti := NewTarInfo(name)
+		ti.Type, ti.Linkname = typ, link
+		return ti
+	}
+	file := member("dir/file", REGTYPE, "")
+	other := member("other", REGTYPE, "")
+	links := map[string]*TarInfo{
+		"relative": member("dir/sub/rel", SYMTYPE, "../file"),
+		"sibling":  member("dir/sib", SYMTYPE, "./file"),
+		"hard":     member("hard", LNKTYPE, "dir/file"),
+		"absolute": member("dir/abs", SYMTYPE, "/etc/passwd"),
+		"outside":  member("dir/out", SYMTYPE, "../../x"),
+		"dangling": member("dir/dangling", SYMTYPE, "missing"),
+	}
+	members := []*TarInfo{file, other}
+	for _, link := range links {
+		members = append(members, link)
+	}
+
+	for _, name := range []string{"relative", "sibling", "hard"} {
+		if target, err := links[name].ResolveLink(members); err != nil || target != file {
+			t.Errorf("%s: resolved to %v, %v", name, target, err)
+		}
+	}
+	if _, err := links["absolute"].ResolveLink(members); !errorAs[*AbsoluteLinkError](err) {
+		t.Errorf("absolute: %v, want an AbsoluteLinkError", err)
+	}
+	if _, err := links["outside"].ResolveLink(members); !errorAs[*LinkOutsideDestinationError](err) {
+		t.Errorf("outside: %v, want a LinkOutsideDestinationError", err)
+	}
+	if target, err := links["dangling"].ResolveLink(members); err == nil {
+		t.Errorf("dangling: resolved to %v", target)
+	}
+	if _, err := file.ResolveLink(members); err == nil {
+		t.Error("resolved a regular file")
+	}
+}
+
+func TestDetectedFormat(t *testing.T) {
+	ustar := filepath.Join(t.TempDir(), "ustar.tar")
+	tf, err := Open(ustar, "w", nil, 4096, WithFormat(USTAR_FORMAT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.AddBytes("a", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	for path, want := range map[string]int{
+		ustar: USTAR_FORMAT,
+		filepath.Join("testdata", "gnu-sparse.tar"):     GNU_FORMAT,
+		filepath.Join("testdata", "pax-sparse-1.0.tar"): PAX_FORMAT,
+	} {
+		tf := openArchive(t, path)
+		if ti, err := tf.GetMemberAt(0); err != nil || ti.Format != want {
+			t.Errorf("%s: member format %v, %v, want %d", path, ti, err, want)
+		}
+		if format, err := tf.DetectedFormat(); err != nil || format != want {
+			t.Errorf("%s: DetectedFormat() = %d, %v, want %d", path, format, err, want)
+		}
+	}
+}
+
+func TestV7RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v7.tar")
+	tf, err := Open(path, "w", nil, 4096, WithFormat(V7_FORMAT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := NewTarInfo("dir")
+	dir.Type, dir.Mode = DIRTYPE, 0755
+	if err := tf.AddFile(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.AddReader("dir/file", strings.NewReader("data"), 4, func(ti *TarInfo) { ti.Mtime = time.Unix(1e9, 0) }); err != nil {
+		t.Fatal(err)
+	}
+	link := NewTarInfo("dir/link")
+	link.Type, link.Linkname = SYMTYPE, "file"
+	if err := tf.AddFile(link, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.AddReader(strings.Repeat("x", 101), strings.NewReader(""), 0); err == nil {
+		t.Error("name of 101 characters written in V7 format")
+	}
+	dev := NewTarInfo("dev")
+	dev.Type = CHRTYPE
+	if err := tf.AddFile(dev, nil); err == nil {
+		t.Error("device written in V7 format")
+	}
+	tf.Close()
+	archive, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magic := archive[257:265]; !bytes.Equal(magic, make([]byte, 8)) {
+		t.Errorf("V7 header has magic %q", magic)
+	}
+
+	tf = openArchive(t, path)
+	var got []string
+	err = tf.Walk(func(ti *TarInfo, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		got = append(got, fmt.Sprintf("%s %q %s %q %d", ti.Name, ti.Type, ti.Linkname, data, ti.Mtime.Unix()))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Regular files are stored with the old type.
+	want := []string{
+		fmt.Sprintf(`dir "5"  "" %d`, dir.Mtime.Unix()),
+		`dir/file "\x00"  "data" 1000000000`,
+		fmt.Sprintf(`dir/link "2" file "" %d`, link.Mtime.Unix()),
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+func TestToBytesFromBytes(t *testing.T) {
+	for _, format := range []int{V7_FORMAT, USTAR_FORMAT, GNU_FORMAT, PAX_FORMAT} {
+		ti := NewTarInfo("dir/file")
+		ti.Size, ti.Mode, ti.UID, ti.GID = 10, 0640, 1000, 100
+		ti.Mtime = time.Unix(1e9, 0)
+		buf, err := ti.ToBytes(format)
+		if err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if len(buf) != BLOCKSIZE {
+			t.Fatalf("format %d: header of %d bytes", format, len(buf))
+		}
+		got, err := TarInfoFromBytes(buf)
+		if err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if got.Name != ti.Name || !got.IsReg() || got.Size != ti.Size || got.Mode != ti.Mode ||
+			got.UID != ti.UID || got.GID != ti.GID || !got.Mtime.Equal(ti.Mtime) {
+			t.Errorf("format %d: read back %+v", format, got)
+		}
+	}
+
+	long := NewTarInfo(strings.Repeat("x", 200))
+	buf, err := long.ToBytes(GNU_FORMAT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header, err := TarInfoFromBytes(buf[:BLOCKSIZE]); err != nil || header.Type != GNUTYPE_LONGNAME {
+		t.Errorf("first block of a long name = %v, %v, want a GNU long name header", header, err)
+	}
+
+	if _, err := TarInfoFromBytes(make([]byte, BLOCKSIZE-1)); !errorAs[*TruncatedHeaderError](err) {
+		t.Errorf("TarInfoFromBytes(511 bytes) = %v, want a TruncatedHeaderError", err)
+	}
+	if _, err := TarInfoFromBytes(nil); !errorAs[*EmptyHeaderError](err) {
+		t.Errorf("TarInfoFromBytes(nil) = %v, want an EmptyHeaderError", err)
+	}
+}
+
+func FuzzFromBuf(f *testing.F) {
+	for _, format := range []int{V7_FORMAT, USTAR_FORMAT, GNU_FORMAT, PAX_FORMAT} {
+		for _, ti := range []*TarInfo{
+			{Name: "file", Type: REGTYPE, Size: 1 << 40, Mode: 0644, Mtime: time.Unix(1e9, 0)},
+			{Name: "dir", Type: DIRTYPE, Mode: 0755},
+			{Name: "link", Type: SYMTYPE, Linkname: "file"},
+			{Name: "dev", Type: CHRTYPE, DevMajor: 1, DevMinor: 3},
+			{Name: strings.Repeat("x", 150), Type: REGTYPE, UID: 1 << 30},
+		} {
+			if buf, err := ti.ToBuf(format, ENCODING, "surrogateescape"); err == nil {
+				f.Add(buf[:BLOCKSIZE])
+			}
+		}
+	}
+	for _, name := range []string{"gnu-sparse.tar", "pax-sparse-0.1.tar", "pax-sparse-1.0.tar"} {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data[:BLOCKSIZE])
+	}
+	// A size of all 0xFF bytes is -1 in base-256.
+	buf, err := NewTarInfo("file").ToBuf(GNU_FORMAT, ENCODING, "surrogateescape")
+	if err != nil {
+		f.Fatal(err)
+	}
+	copy(buf[124:136], bytes.Repeat([]byte{0xFF}, 12))
+	f.Add(buf[:BLOCKSIZE])
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		if len(buf) == BLOCKSIZE {
+			// Fix up the checksum, or almost no input gets past it.
+			buf = slices.Clone(buf)
+			copy(buf[148:156], "        ")
+			unsigned, _ := calcChecksums(buf)
+			copy(buf[148:], fmt.Sprintf("%06o\x00 ", unsigned))
+		}
+		ti, err := FromBuf(buf, ENCODING, "surrogateescape")
+		if err != nil {
+			return
+		}
+		if ti.Size < 0 || ti.Mode < 0 || ti.Mode > 07777777 || ti.DevMajor < 0 || ti.DevMinor < 0 {
+			t.Errorf("FromBuf() accepted size %d, mode %o, device %d,%d", ti.Size, ti.Mode, ti.DevMajor, ti.DevMinor)
+		}
+	})
+}
+
+func TestPaxRecordRead(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "built", Mode: 0644, Format: tar.FormatPAX, PAXRecords: map[string]string{"acme.build-id": "1f2e3d", "comment": "release build"}},
+		{Name: "plain", Mode: 0644, Format: tar.FormatPAX},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tf := openArchive(t, tempFile(t, "pax.tar", buf.Bytes()))
+	built, err := tf.GetMember("built")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"acme.build-id": "1f2e3d", "comment": "release build"} {
+		if value, ok := built.PaxRecord(key); !ok || value != want {
+			t.Errorf("PaxRecord(%q) = %q, %v, want %q", key, value, ok, want)
+		}
+	}
+	plain, err := tf.GetMember("plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := plain.PaxRecord("acme.build-id"); ok {
+		t.Errorf("member without the record has acme.build-id %q", value)
+	}
+}
+
+func TestSetPaxRecord(t *testing.T) {
+	ti := NewTarInfo("file")
+	ti.Mtime = time.Unix(1e9, 0)
+	for key, value := range map[string]string{"mtime": "1000000000.5", "x.vendor": "acme"} {
+		if err := ti.SetPaxRecord(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"", "a=b", "a\nb"} {
+		if err := ti.SetPaxRecord(key, "v"); err == nil {
+			t.Errorf("SetPaxRecord(%q) succeeded", key)
+		}
+	}
+
+	buf, err := ti.ToBuf(PAX_FORMAT, ENCODING, "surrogateescape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := FromBuf(buf[:BLOCKSIZE], ENCODING, "surrogateescape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Type != XHDTYPE {
+		t.Fatalf("first block has type %q, want an extended header", header.Type)
+	}
+	records := string(buf[BLOCKSIZE : BLOCKSIZE+header.Size])
+	for _, record := range []string{paxRecord("mtime", "1000000000.5"), paxRecord("x.vendor", "acme")} {
+		if strings.Count(records, record) != 1 {
+			t.Errorf("extended header %q does not hold %q once", records, record)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "pax.tar")
+	tf, err := Open(path, "w", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tf.AddFile(ti, nil); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+	got, err := openArchive(t, path).GetMember("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vendor, _ := got.PaxRecord("x.vendor"); vendor != "acme" || !got.Mtime.Equal(time.Unix(1e9, 5e8)) {
+		t.Errorf("read back x.vendor %q, mtime %v", vendor, got.Mtime)
+	}
+}
+
+func TestDumpdir(t *testing.T) {
+	listing := "Yfile\x00Nold\x00Dsub\x00\x00"
+	var archive bytes.Buffer
+	dir := NewTarInfo("dir/")
+	dir.Type, dir.Mode, dir.Size = GNUTYPE_DUMPDIR, 0755, int64(len(listing))
+	file := NewTarInfo("dir/file")
+	file.Size = 4
+	for _, member := range []struct {
+		ti   *TarInfo
+		data string
+	}{{dir, listing}, {file, "data"}} {
+		buf, err := member.ti.ToBuf(GNU_FORMAT, ENCODING, "surrogateescape")
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive.Write(buf)
+		archive.WriteString(member.data)
+		archive.Write(make([]byte, member.ti.block(member.ti.Size)-member.ti.Size))
+	}
+	archive.Write(make([]byte, 2*BLOCKSIZE))
+
+	tf := openArchive(t, tempFile(t, "incremental.tar", archive.Bytes()))
+	members, err := tf.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || members[1].Name != "dir/file" {
+		t.Fatalf("read %v", members)
+	}
+	got := members[0]
+	want := []DumpdirEntry{{'Y', "file"}, {'N', "old"}, {'D', "sub"}}
+	if got.Name != "dir" || !got.IsDir() || got.IsReg() || !slices.Equal(got.Dumpdir, want) {
+		t.Errorf("dumpdir member %q, IsDir %v, IsReg %v, listing %q", got.Name, got.IsDir(), got.IsReg(), got.Dumpdir)
+	}
+	if _, err := parseDumpdir([]byte("Yfile"), ENCODING, "surrogateescape"); err == nil {
+		t.Error("parseDumpdir accepted an unterminated entry")
+	}
+
+	dest := t.TempDir()
+	if err := tf.ExtractAll(dest); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "dir", "file")); err != nil || string(data) != "data" {
+		t.Errorf("dir/file = %q, %v", data, err)
+	}
+}
@@ -6,29 +6,42 @@ import (
 	"math"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
 )
 
-func nts(s []byte, encoding, errors string) string {
+// nts converts a null-terminated byte field to a string, decoding it
+// from encoding.
+func nts(s []byte, encoding, errors string) (string, error) {
 	p := bytes.IndexByte(s, NUL)
 	if p != -1 {
 		s = s[:p]
 	}
-	// TODO: Implement proper encoding/decoding based on encoding and errors
-	return string(s)
+	return decode(s, encoding, errors)
 }
 
 func nti(s []byte) (int64, error) {
 	if s[0] == 0x80 || s[0] == 0xFF {
+		// GNU base-256: the bytes after the marker are a big endian two's
+		// complement number. Fields wider than 8 bytes wrap around to the
+		// right int64 value on their own.
 		n := int64(0)
 		for i := 1; i < len(s); i++ {
 			n = (n << 8) + int64(s[i])
 		}
-		if s[0] == 0xFF {
-			n = -n
+		if bits := 8 * (len(s) - 1); s[0] == 0xFF && bits < 64 {
+			n -= 1 << bits
 		}
 		return n, nil
 	}
-	str := strings.TrimSpace(nts(s, "ascii", "strict"))
+	str, err := nts(s, "ascii", "strict")
+	if err != nil {
+		return 0, NewInvalidHeaderError("invalid number field")
+	}
+	str = strings.TrimSpace(str)
 	if str == "" {
 		return 0, nil
 	}
@@ -43,40 +56,249 @@ func itn(n int64, digits int, format int) ([]byte, error) {
 	if 0 <= n && n < int64(math.Pow(8, float64(digits-1))) {
 		octal := fmt.Sprintf("%0*o", digits-1, n)
 		return append([]byte(octal), NUL), nil
-	} else if format == GNU_FORMAT && -int64(math.Pow(256, float64(digits-1))) <= n && n < int64(math.Pow(256, float64(digits-1))) {
+	} else if format == GNU_FORMAT && fitsBase256(n, digits-1) {
+		// GNU base-256: a marker byte followed by the number as big endian
+		// two's complement.
 		buf := make([]byte, digits)
 		if n >= 0 {
 			buf[0] = 0x80
 		} else {
 			buf[0] = 0xFF
-			n = -n
 		}
 		for i := digits - 1; i > 0; i-- {
-			buf[i] = byte(n & 0xFF)
+			buf[i] = byte(n)
 			n >>= 8
 		}
 		return buf, nil
 	}
-	return nil, fmt.Errorf("overflow in number field")
+	if format == GNU_FORMAT {
+		return nil, fmt.Errorf("overflow in number field: %d", n)
+	}
+	// Only the GNU and PAX formats can store numbers beyond the octal range.
+	return nil, fmt.Errorf("overflow in number field: %d does not fit in %d octal digits", n, digits-1)
 }
 
-func stn(s string, length int, encoding string) []byte {
-	b := []byte(s)
+// fitsBase256 reports whether n can be stored in size bytes of GNU
+// base-256 encoding.
+func fitsBase256(n int64, size int) bool {
+	bits := 8 * size
+	if bits >= 64 {
+		return true
+	}
+	return -(1<<bits) <= n && n < 1<<bits
+}
+
+// stn converts a string to a null-padded byte field of the given length,
+// encoding it with encoding.
+func stn(s string, length int, encoding, errors string) ([]byte, error) {
+	b, err := encode(s, encoding, errors)
+	if err != nil {
+		return nil, err
+	}
 	if len(b) > length {
 		b = b[:length]
 	}
-	return append(b, make([]byte, length-len(b))...)
+	return append(b, make([]byte, length-len(b))...), nil
+}
+
+// encodingAliases maps Python codec names that the IANA registry does not
+// know to names it does.
+var encodingAliases = map[string]string{
+	"latin-1": "latin1",
+	"cp1252":  "windows-1252",
+}
+
+// lookupEncoding returns the encoding called name. UTF-8 and ASCII are
+// handled by decode and encode themselves, for them it returns nil.
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	normalized := strings.ReplaceAll(strings.ToLower(name), "_", "-")
+	switch normalized {
+	case "utf-8", "utf8", "ascii", "us-ascii":
+		return nil, nil
+	}
+	if alias, ok := encodingAliases[normalized]; ok {
+		normalized = alias
+	} else if strings.HasPrefix(normalized, "iso8859-") {
+		normalized = "iso-" + normalized[3:]
+	}
+	for _, n := range []string{name, normalized} {
+		if enc, err := ianaindex.IANA.Encoding(n); err == nil && enc != nil {
+			return enc, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown encoding: %s", name)
+}
+
+// isASCII reports whether name is an ASCII encoding.
+func isASCII(name string) bool {
+	name = strings.ReplaceAll(strings.ToLower(name), "_", "-")
+	return name == "ascii" || name == "us-ascii"
+}
+
+// decode decodes b from encoding. How bytes that cannot be decoded are
+// handled depends on errors, like in Python: "strict" fails, "replace"
+// substitutes U+FFFD and "surrogateescape" keeps the raw bytes in the
+// string so that encode writes them back unchanged. Other encodings than
+// UTF-8 and ASCII treat "surrogateescape" like "replace".
+func decode(b []byte, encodingName, errors string) (string, error) {
+	enc, err := lookupEncoding(encodingName)
+	if err != nil {
+		return "", err
+	}
+	if enc != nil {
+		s, err := enc.NewDecoder().Bytes(b)
+		if err != nil {
+			return "", err
+		}
+		if errors == "strict" && bytes.ContainsRune(s, utf8.RuneError) {
+			return "", fmt.Errorf("'%s' codec can't decode %q", encodingName, b)
+		}
+		return string(s), nil
+	}
+
+	ascii := isASCII(encodingName)
+	if !ascii && utf8.Valid(b) {
+		return string(b), nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if ascii && r >= utf8.RuneSelf {
+			r, size = utf8.RuneError, 1
+		}
+		if r != utf8.RuneError || size > 1 {
+			sb.WriteRune(r)
+			i += size
+			continue
+		}
+		switch errors {
+		case "surrogateescape":
+			sb.WriteByte(b[i])
+		case "replace":
+			sb.WriteRune(utf8.RuneError)
+		default:
+			return "", fmt.Errorf("'%s' codec can't decode byte %#x in position %d", encodingName, b[i], i)
+		}
+		i++
+	}
+	return sb.String(), nil
+}
+
+// encode encodes s with encoding. errors works as for decode: "strict"
+// fails on characters the encoding cannot represent, "replace" writes "?"
+// instead and "surrogateescape" writes bytes of s that are not valid
+// UTF-8 unchanged.
+func encode(s, encodingName, errors string) ([]byte, error) {
+	enc, err := lookupEncoding(encodingName)
+	if err != nil {
+		return nil, err
+	}
+	ascii := isASCII(encodingName)
+	if enc == nil && !ascii && utf8.ValidString(s) {
+		return []byte(s), nil
+	}
+
+	var encoder *encoding.Encoder
+	if enc != nil {
+		encoder = enc.NewEncoder()
+	}
+	var buf []byte
+	for i, r := range s {
+		if r == utf8.RuneError && !strings.HasPrefix(s[i:], "\uFFFD") {
+			// A byte that is not valid UTF-8.
+			switch errors {
+			case "surrogateescape":
+				buf = append(buf, s[i])
+			case "replace":
+				buf = append(buf, '?')
+			default:
+				return nil, fmt.Errorf("'%s' codec can't encode byte %#x in position %d", encodingName, s[i], i)
+			}
+			continue
+		}
+
+		switch {
+		case encoder != nil:
+			b, err := encoder.String(string(r))
+			if err == nil {
+				buf = append(buf, b...)
+				continue
+			}
+		case !ascii || r < utf8.RuneSelf:
+			buf = utf8.AppendRune(buf, r)
+			continue
+		}
+		if errors != "replace" {
+			return nil, fmt.Errorf("'%s' codec can't encode character %q in position %d", encodingName, r, i)
+		}
+		buf = append(buf, '?')
+	}
+	return buf, nil
 }
 
 func calcChecksum(buf []byte) int64 {
+	unsigned, _ := calcChecksums(buf)
+	return unsigned
+}
+
+// calcChecksums returns the unsigned and the signed checksum of a header
+// block. Some old tar implementations summed the bytes as signed chars, so
+// a header is valid if its stored checksum matches either of them.
+func calcChecksums(buf []byte) (int64, int64) {
 	unsigned := int64(256) // 8 spaces
+	signed := int64(256)
 	for i, b := range buf {
 		if i >= 148 && i < 156 {
 			continue
 		}
 		unsigned += int64(b)
+		signed += int64(int8(b))
 	}
-	return unsigned
+	return unsigned, signed
+}
+
+// validChecksum reports whether chksum matches the header block buf.
+func validChecksum(buf []byte, chksum int64) bool {
+	unsigned, signed := calcChecksums(buf)
+	return chksum == unsigned || chksum == signed
+}
+
+// formatPaxTime formats t as the decimal seconds since the epoch used by
+// PAX time records, with a fraction for sub-second precision.
+func formatPaxTime(t time.Time) string {
+	secs, nsecs := t.Unix(), int64(t.Nanosecond())
+	if nsecs == 0 {
+		return strconv.FormatInt(secs, 10)
+	}
+	sign := ""
+	if secs < 0 {
+		// -1.5s is stored as secs -2 and nsecs 5e8.
+		sign = "-"
+		secs, nsecs = -(secs + 1), 1e9-nsecs
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%09d", sign, secs, nsecs), "0")
+}
+
+// parsePaxTime parses a PAX time record such as "1700000000.123456789".
+// Digits beyond nanoseconds are dropped.
+func parsePaxTime(s string) (time.Time, error) {
+	ss, sn, _ := strings.Cut(s, ".")
+	secs, err := strconv.ParseInt(ss, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	if sn == "" {
+		return time.Unix(secs, 0), nil
+	}
+	if strings.Trim(sn, "0123456789") != "" {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	sn = (sn + "000000000")[:9]
+	nsecs, _ := strconv.ParseInt(sn, 10, 64)
+	if strings.HasPrefix(ss, "-") {
+		return time.Unix(secs, -nsecs), nil
+	}
+	return time.Unix(secs, nsecs), nil
 }
 
 // divmod returns the quotient and remainder of a divided by b.
@@ -89,3 +311,46 @@ func divmod(a, b int64) (int64, int64) {
 func divmodInt(a, b int) (int, int) {
 	return a / b, a % b
 }
+
+// filemode renders the type and permission bits of a member the way
+// `ls -l` does, e.g. "drwxr-xr-x". Hard links are shown with an "h" like
+// GNU tar does.
+func filemode(ti *TarInfo) string {
+	buf := []byte("----------")
+	switch {
+	case ti.IsDir():
+		buf[0] = 'd'
+	case ti.IsSym():
+		buf[0] = 'l'
+	case ti.IsLnk():
+		buf[0] = 'h'
+	case ti.IsChr():
+		buf[0] = 'c'
+	case ti.IsBlk():
+		buf[0] = 'b'
+	case ti.IsFifo():
+		buf[0] = 'p'
+	}
+	const rwx = "rwxrwxrwx"
+	for i := 0; i < 9; i++ {
+		if ti.Mode&(1<<(8-i)) != 0 {
+			buf[i+1] = rwx[i]
+		}
+	}
+	// The setuid, setgid and sticky bits replace the execute bits.
+	for i, special := range []struct {
+		bit  int64
+		char byte
+	}{{04000, 's'}, {02000, 's'}, {01000, 't'}} {
+		if ti.Mode&special.bit == 0 {
+			continue
+		}
+		pos := 3 * (i + 1)
+		if buf[pos] == 'x' {
+			buf[pos] = special.char
+		} else {
+			buf[pos] = special.char - 'a' + 'A'
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,132 @@
+package tarfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Verify checks that the archive is consistent without extracting it. It
+// walks all headers from the start of the archive, recomputes their
+// checksums, checks that the data of each member is complete and that the
+// archive ends with two zero blocks. The error for the first inconsistency
+// found names its offset.
+func (tf *TarFile) Verify() error {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	if err := tf.check("r"); err != nil {
+		return err
+	}
+	if tf.stream {
+		return NewStreamError("cannot verify a stream")
+	}
+	defer tf.fileObj.Seek(tf.offset, io.SeekStart)
+
+	buf := make([]byte, BLOCKSIZE)
+	pos := tf.start
+	paxSize := int64(-1) // Size from a PAX header for the next member
+	for {
+		if err := tf.readBlockAt(buf, pos); err != nil {
+			return NewReadError(fmt.Sprintf("0x%X: truncated header", pos))
+		}
+		if bytes.Count(buf, []byte{NUL}) == BLOCKSIZE {
+			if err := tf.readBlockAt(buf, pos+BLOCKSIZE); err != nil || bytes.Count(buf, []byte{NUL}) != BLOCKSIZE {
+				return NewReadError(fmt.Sprintf("0x%X: missing second end-of-archive block", pos+BLOCKSIZE))
+			}
+			return nil
+		}
+
+		chksum, err := nti(buf[148:156])
+		if err != nil || !validChecksum(buf, chksum) {
+			return NewInvalidHeaderError(fmt.Sprintf("0x%X: bad checksum", pos))
+		}
+		size, err := nti(buf[124:136])
+		if err != nil || size < 0 {
+			return NewInvalidHeaderError(fmt.Sprintf("0x%X: invalid size field", pos))
+		}
+		typ := string(buf[156])
+		if typ == GNUTYPE_SPARSE {
+			// Extended sparse headers follow without a checksum of their own.
+			for extended := buf[482] != 0; extended; extended = buf[504] != 0 {
+				pos += BLOCKSIZE
+				if err := tf.readBlockAt(buf, pos); err != nil {
+					return NewReadError(fmt.Sprintf("0x%X: truncated sparse header", pos))
+				}
+			}
+		}
+		pos += BLOCKSIZE
+
+		hasData := contains(typ, REGULAR_TYPES) || typ == GNUTYPE_DUMPDIR || !contains(typ, SUPPORTED_TYPES)
+		if paxSize >= 0 && hasData {
+			size = paxSize
+		}
+		paxSize = -1
+		if typ == XHDTYPE || typ == SOLARIS_XHDTYPE {
+			headers := map[string]string{}
+			payload, err := tf.readUpTo(pos, size)
+			if err != nil {
+				return NewReadError(fmt.Sprintf("0x%X: truncated pax header", pos))
+			}
+			if err := parsePaxRecords(payload, headers, tf.encoding, tf.errors); err != nil {
+				return NewInvalidHeaderError(fmt.Sprintf("0x%X: %v", pos, err))
+			}
+			if v, ok := headers["size"]; ok {
+				if paxSize, err = strconv.ParseInt(v, 10, 64); err != nil || paxSize < 0 {
+					return NewInvalidHeaderError(fmt.Sprintf("0x%X: invalid pax size", pos))
+				}
+			}
+		}
+		if !hasData && typ != XHDTYPE && typ != XGLTYPE && typ != SOLARIS_XHDTYPE && typ != GNUTYPE_LONGNAME && typ != GNUTYPE_LONGLINK {
+			continue
+		}
+
+		end := pos + size
+		if tf.fileSize >= 0 && end > tf.fileSize {
+			return NewReadError(fmt.Sprintf("0x%X: data of %d bytes is truncated", pos, size))
+		}
+		if tf.fileSize < 0 && size > 0 {
+			// The length of compressed data is unknown, so read the last byte.
+			if err := tf.readAt(buf[:1], end-1); err != nil {
+				return NewReadError(fmt.Sprintf("0x%X: data of %d bytes is truncated", pos, size))
+			}
+		}
+		pos += (&TarInfo{}).block(size)
+	}
+}
+
+// readBlockAt reads a full block at pos of the archive file into buf.
+func (tf *TarFile) readBlockAt(buf []byte, pos int64) error {
+	return tf.readAt(buf[:BLOCKSIZE], pos)
+}
+
+// readUpTo reads size bytes from pos of the archive file. Unlike readAt
+// it does not trust size, which comes from a header: it fails without
+// reading if the archive is shorter, and the buffer grows only as far as
+// the data goes.
+func (tf *TarFile) readUpTo(pos, size int64) ([]byte, error) {
+	if tf.fileSize >= 0 && pos+size > tf.fileSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if _, err := tf.fileObj.Seek(pos, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf, err := io.ReadAll(io.LimitReader(tf.fileObj, size))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf, nil
+}
+
+// readAt fills buf from pos of the archive file.
+func (tf *TarFile) readAt(buf []byte, pos int64) error {
+	if _, err := tf.fileObj.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(tf.fileObj, buf)
+	return err
+}
@@ -0,0 +1,82 @@
+package tarfile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+// headerBytes returns the ustar header of ti.
+func headerBytes(t *testing.T, ti *TarInfo) []byte {
+	t.Helper()
+	buf, err := ti.ToBuf(USTAR_FORMAT, ENCODING, "surrogateescape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestVerifyHugePaxSize(t *testing.T) {
+	var archive bytes.Buffer
+	member := NewTarInfo("a")
+	member.Size = 1
+	archive.Write(headerBytes(t, member))
+	archive.Write(make([]byte, BLOCKSIZE))
+	pax := NewTarInfo("pax")
+	pax.Type = XHDTYPE
+	pax.Size = 1 << 32
+	archive.Write(headerBytes(t, pax))
+	archive.Write(make([]byte, 2*BLOCKSIZE))
+	path := filepath.Join(t.TempDir(), "bomb.tar")
+	if err := os.WriteFile(path, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tf, err := Open(path, "r", nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err = tf.Verify()
+	runtime.ReadMemStats(&after)
+	if _, ok := err.(*ReadError); !ok {
+		t.Errorf("Verify() = %v, want a ReadError", err)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("Verify allocated %d bytes", n)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	member := func(name string, size int64, blocks int) []byte {
+		ti := NewTarInfo(name)
+		ti.Size = size
+		return append(headerBytes(t, ti), make([]byte, blocks*BLOCKSIZE)...)
+	}
+	end := make([]byte, 2*BLOCKSIZE)
+	good := slices.Concat(member("a", 1, 1), member("b", 600, 2), end)
+	flipped := slices.Clone(good)
+	flipped[2*BLOCKSIZE]++ // The name of b
+	for _, tt := range []struct {
+		name    string
+		archive []byte
+		want    string // Error message, empty for none
+	}{
+		{"good", good, ""},
+		{"flipped checksum", flipped, "0x400: bad checksum"},
+		{"truncated data", good[:3*BLOCKSIZE], "0x600: data of 600 bytes is truncated"},
+		{"missing end", good[:len(good)-BLOCKSIZE], "0xC00: missing second end-of-archive block"},
+	} {
+		tf := openArchive(t, tempFile(t, "v.tar", tt.archive))
+		err := tf.Verify()
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || err.Error() != tt.want) {
+			t.Errorf("%s: Verify() = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}